@@ -4,10 +4,18 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
 	// 修正导入路径，使用相对路径导入本地包
 	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/persona"
+	"github.com/aiagent/pkg/pii"
 	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/usage"
 	"github.com/tmc/langchaingo/llms"
 )
 
@@ -38,11 +46,32 @@ func main() {
 		log.Fatalf("Error creating database client: %s", err)
 	}
 	defer db.Close()
+	config, err := base.GetEnv()
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+	logger, err := logging.New(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		log.Fatalf("Error creating logger: %s", err)
+	}
+	slog.SetDefault(logger)
+	prices, err := usage.ParsePrices(config.ModelPrices)
+	if err != nil {
+		log.Fatalf("Error parsing model prices: %s", err)
+	}
+	usage.Default = &usage.Tracker{
+		Prices: prices,
+		Save: func(ctx context.Context, record usage.Record) error {
+			return sql.SaveUsage(ctx, db, record)
+		},
+	}
 
 	for {
 		var command string
 		fmt.Print(" 1:Start chat\n 2:create promt\n 3:choice prompt\n")
-		fmt.Printf(" 4:search prompt\n 5:remove chara prompt\n exit:exit\n")
+		fmt.Printf(" 4:search prompt\n 5:remove chara prompt\n 6:set chara tools\n")
+		fmt.Printf(" 7:export chara file\n 8:import chara file\n 9:chara versions\n 10:rollback chara\n")
+		fmt.Printf(" 11:view redacted originals\n 12:usage report\n exit:exit\n")
 		_, err := fmt.Scanln(&command)
 		if err != nil {
 			fmt.Println("Error reading input:", err)
@@ -146,6 +175,187 @@ func main() {
 				continue
 			}
 			fmt.Printf("Chara prompt with ID %s deleted successfully\n", charaID)
+		case "6":
+			// set chara tools
+			fmt.Printf("Please enter the role ID: ")
+			var charaID string
+			_, err := fmt.Scanln(&charaID)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			fmt.Printf("Please enter the allowed tools (comma separated, * for all): ")
+			var tools string
+			_, err = fmt.Scanln(&tools)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			err = sql.SetCharaTools(ctx, rdb, charaID, strings.Split(tools, ","))
+			if err != nil {
+				fmt.Printf("Error setting chara tools: %v\n", err)
+				continue
+			}
+			fmt.Printf("Chara %s tools updated\n", charaID)
+		case "7":
+			// export chara to yaml/json file
+			fmt.Printf("Please enter the role ID and file path (.yaml or .json): ")
+			var charaID, path string
+			_, err := fmt.Scanln(&charaID, &path)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			chara, err := sql.GetCharaByID(ctx, rdb, charaID)
+			if err != nil {
+				fmt.Printf("Error getting chara: %v\n", err)
+				continue
+			}
+			file, err := os.Create(path)
+			if err != nil {
+				fmt.Printf("Error creating file: %v\n", err)
+				continue
+			}
+			err = persona.Encode(file, chara, persona.FormatFromName(path))
+			file.Close()
+			if err != nil {
+				fmt.Printf("Error writing chara file: %v\n", err)
+				continue
+			}
+			fmt.Printf("Chara %s exported to %s\n", charaID, path)
+		case "8":
+			// import chara from yaml/json file, as a new chara or a new version of an existing one
+			fmt.Printf("Please enter the file path and optional role ID to update: ")
+			var path, charaID string
+			_, err := fmt.Scanln(&path, &charaID)
+			if err != nil && path == "" {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				fmt.Printf("Error opening file: %v\n", err)
+				continue
+			}
+			chara, err := persona.Decode(file, persona.FormatFromName(path))
+			file.Close()
+			if err != nil {
+				fmt.Printf("Error reading chara file: %v\n", err)
+				continue
+			}
+			if charaID == "" {
+				chara, err = sql.CreateChara(ctx, rdb, *chara)
+			} else {
+				chara, err = sql.UpdateChara(ctx, rdb, charaID, *chara)
+			}
+			if err != nil {
+				fmt.Printf("Error saving chara: %v\n", err)
+				continue
+			}
+			fmt.Printf("Chara %s saved as version %d\n", chara.ID, chara.Version)
+		case "9":
+			// list chara versions
+			fmt.Printf("Please enter the role ID: ")
+			var charaID string
+			_, err := fmt.Scanln(&charaID)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			versions, err := sql.ListCharaVersions(ctx, rdb, charaID)
+			if err != nil {
+				fmt.Printf("Error getting chara versions: %v\n", err)
+				continue
+			}
+			for _, version := range versions {
+				fmt.Printf("Version %d, Name: %s, Updated: %s\n", version.Version, version.Name,
+					time.Unix(version.UpdatedAt, 0).Format("2006-01-02 15:04:05"))
+			}
+		case "10":
+			// rollback chara to a version
+			fmt.Printf("Please enter the role ID and version: ")
+			var charaID string
+			var version int
+			_, err := fmt.Scanln(&charaID, &version)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			chara, err := sql.RollbackChara(ctx, rdb, charaID, version)
+			if err != nil {
+				fmt.Printf("Error rolling back chara: %v\n", err)
+				continue
+			}
+			fmt.Printf("Chara %s rolled back to version %d (now version %d)\n", charaID, version, chara.Version)
+		case "11":
+			// view encrypted originals of redacted messages and memories
+			config, err := base.GetEnv()
+			if err != nil {
+				fmt.Println("Error loading config:", err)
+				continue
+			}
+			if config.PIIVaultKey == "" {
+				fmt.Println("PII_VAULT_KEY is not set")
+				continue
+			}
+			vault, err := pii.NewVault(config.PIIVaultKey)
+			if err != nil {
+				fmt.Println("Error creating vault:", err)
+				continue
+			}
+			fmt.Printf("Please enter the user name (- for all): ")
+			var user string
+			_, err = fmt.Scanln(&user)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			if user == "-" {
+				user = ""
+			}
+			records, err := sql.ListPIIRecords(ctx, db, user, "", 20)
+			if err != nil {
+				fmt.Printf("Error listing pii records: %v\n", err)
+				continue
+			}
+			for _, record := range records {
+				original, err := vault.Open(record.Sealed)
+				if err != nil {
+					original = "（无法解密：" + err.Error() + "）"
+				}
+				fmt.Printf("[%s] %s %s/%s %v\n%s\n", record.CreatedAt.Format("2006-01-02 15:04:05"),
+					record.Source, record.User, record.SessionID, record.Kinds, original)
+			}
+		case "12":
+			// usage and cost per user per day
+			fmt.Printf("Please enter the user name (- for all) and the start date (YYYY-MM-DD, - for last %d days): ", usage.ReportDays)
+			var user, from string
+			_, err := fmt.Scanln(&user, &from)
+			if err != nil {
+				fmt.Println("Error reading input:", err)
+				continue
+			}
+			if user == "-" {
+				user = ""
+			}
+			if from == "-" {
+				from = ""
+			}
+			start, end, err := usage.DayRange(from, "", time.Now())
+			if err != nil {
+				fmt.Println("Error parsing date:", err)
+				continue
+			}
+			summaries, err := sql.UsageReport(ctx, db, user, start, end)
+			if err != nil {
+				fmt.Printf("Error reading usage report: %v\n", err)
+				continue
+			}
+			for _, summary := range summaries {
+				fmt.Printf("%s %s %s %s calls=%d errors=%d prompt=%d completion=%d cost=%.4f avg_latency=%.0fms\n",
+					summary.Day, summary.User, summary.Kind, summary.Model, summary.Calls, summary.Errors,
+					summary.PromptTokens, summary.CompletionTokens, summary.Cost, summary.AvgLatencyMs)
+			}
 		case "exit":
 			return
 		}
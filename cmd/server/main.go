@@ -3,12 +3,23 @@ package main
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 
 	"github.com/aiagent/internal/handler"
 	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/pii"
 	"github.com/aiagent/pkg/rag"
+	"github.com/aiagent/pkg/room"
 	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/timer"
+	"github.com/aiagent/pkg/tool"
+	"github.com/aiagent/pkg/usage"
 	"github.com/gorilla/websocket"
 )
 
@@ -19,27 +30,28 @@ var upgrader = websocket.Upgrader{
 }
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
 	conn, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		log.Fatal("Error while upgrading connection: ", err)
+		logger.Error("error while upgrading connection", logging.KeyError, err)
 		return
 	}
 	defer conn.Close()
 
-	log.Println("Client connected")
+	logger.Info("client connected")
 
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error while reading message: ", err)
+			logger.Error("error while reading message", logging.KeyError, err)
 			break
 		}
 		response := "Pong!" + string(msg)
 
 		err = conn.WriteMessage(websocket.TextMessage, []byte(response))
 		if err != nil {
-			log.Println("Error while writing message: ", err)
+			logger.Error("error while writing message", logging.KeyError, err)
 			break
 		}
 	}
@@ -48,43 +60,192 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	ctx := context.Background()
 
+	config, err := base.GetEnv()
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+	logger, err := logging.New(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		log.Fatalf("Error creating logger: %s", err)
+	}
+	slog.SetDefault(logger)
+
 	llm, err := base.CreateLLMClient()
 	if err != nil {
-		log.Fatal("Error creating LLM: ", err)
-		return
+		fatal("error creating LLM", err)
 	}
 	db, err := sql.CreatePSQLClient(ctx)
 	if err != nil {
-		log.Fatalf("Error creating client: %s", err)
+		fatal("error creating client", err)
 	}
 	err = sql.CreatePSQLDatabase(ctx, db)
 	if err != nil {
-		log.Fatalf("Error creating database: %s", err)
+		fatal("error creating database", err)
 	}
 	err = sql.CreatePSQLTable(ctx, db)
 	if err != nil {
-		log.Fatalf("Error creating table: %s", err)
+		fatal("error creating table", err)
 	}
 	rdb, err := sql.CreateRedisClient(ctx)
 	if err != nil {
-		log.Fatalf("Error creating Redis client: %s", err)
+		fatal("error creating Redis client", err)
 	}
 	embedder, err := rag.InitEmbedder()
 	if err != nil {
-		log.Fatal("Error initializing embedder: ", err)
-		return
+		fatal("error initializing embedder", err)
+	}
+	registry := tool.NewRegistry()
+	err = tool.RegisterLocalTools(registry, tool.LocalConfig{HTTPAllowlist: config.HTTPAllowlist})
+	if err != nil {
+		fatal("error registering local tools", err)
+	}
+	err = tool.RegisterKnowledgeTools(registry, db, embedder)
+	if err != nil {
+		fatal("error registering knowledge tools", err)
+	}
+	err = tool.RegisterHistoryTools(registry, db, embedder)
+	if err != nil {
+		fatal("error registering history tools", err)
+	}
+	go timer.TimerIndexChatHistory(ctx, db, embedder, timer.IndexChatHistoryInterval)
+
+	rag.Quarantine = config.QuarantineInjection
+	pii.Default, err = pii.New(config.PIIDetectors, config.PIIVaultKey)
+	if err != nil {
+		fatal("error creating pii redactor", err)
+	}
+
+	prices, err := usage.ParsePrices(config.ModelPrices)
+	if err != nil {
+		fatal("error parsing model prices", err)
+	}
+	usage.Default = &usage.Tracker{
+		Prices: prices,
+		Save: func(ctx context.Context, record usage.Record) error {
+			return sql.SaveUsage(ctx, db, record)
+		},
+	}
+
+	var mod *moderation.Pipeline
+	if config.ModerationConfig != "" {
+		moderationConfig, err := moderation.LoadConfig(config.ModerationConfig)
+		if err != nil {
+			fatal("error loading moderation config", err)
+		}
+		mod, err = moderation.New(moderationConfig, llm)
+		if err != nil {
+			fatal("error creating moderation pipeline", err)
+		}
+		mod.Audit = func(ctx context.Context, entry moderation.AuditEntry) error {
+			return sql.SaveModerationAudit(ctx, db, entry)
+		}
 	}
+
+	limits := &limit.Limits{
+		RDB:         rdb,
+		User:        limit.PerMinute(config.UserRatePerMinute, config.UserRateBurst),
+		IP:          limit.PerMinute(config.IPRatePerMinute, config.IPRateBurst),
+		DailyTokens: config.DailyTokenQuota,
+	}
+
 	http.HandleFunc("/ws", wsHandler)
-	http.HandleFunc("/ws/chat/temp", handler.TextChatHandler)
-	http.HandleFunc("/ws/chat/user", func(w http.ResponseWriter, r *http.Request) {
-		handler.UserChatHandler(w, r, rdb, db)
+	http.HandleFunc("/ws/chat/temp", metrics.Instrument("/ws/chat/temp", handler.TextChatHandler))
+	http.HandleFunc("/ws/chat/user", metrics.Instrument("/ws/chat/user", func(w http.ResponseWriter, r *http.Request) {
+		handler.UserChatHandler(w, r, rdb, db, registry, mod, limits)
+	}))
+	http.HandleFunc("/ws/chat/user/continue", metrics.Instrument("/ws/chat/user/continue", func(w http.ResponseWriter, r *http.Request) {
+		handler.UserChatHandlerWithSessionID(w, r, rdb, db, registry, mod, limits)
+	}))
+	http.HandleFunc("/ws/chat/cast", metrics.Instrument("/ws/chat/cast", func(w http.ResponseWriter, r *http.Request) {
+		handler.CastHandler(w, r, rdb, db, registry, mod, limits)
+	}))
+	http.HandleFunc("/ws/agent", metrics.Instrument("/ws/agent", func(w http.ResponseWriter, r *http.Request) {
+		handler.AgentHandler(w, r, rdb, db, registry, mod, limits)
+	}))
+	hub := room.NewHub()
+	http.HandleFunc("/ws/room", metrics.Instrument("/ws/room", func(w http.ResponseWriter, r *http.Request) {
+		handler.RoomHandler(w, r, rdb, db, hub, registry, mod, limits)
+	}))
+	http.HandleFunc("/ws/data", metrics.Instrument("/ws/data", func(w http.ResponseWriter, r *http.Request) {
+		handler.RagHandler(w, r, rdb, db, embedder, llm)
+	}))
+	http.HandleFunc("/v1/chat/completions", metrics.Instrument("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		handler.ChatCompletionsHandler(w, r, rdb, db, embedder, llm, registry, mod, limits)
+	}))
+	http.HandleFunc("GET /api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		handler.SessionListHandler(w, r, rdb, db)
 	})
-	http.HandleFunc("/ws/chat/user/continue", func(w http.ResponseWriter, r *http.Request) {
-		handler.UserChatHandlerWithSessionID(w, r, rdb)
+	http.HandleFunc("PATCH /api/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.SessionRenameHandler(w, r, db)
 	})
-	http.HandleFunc("/ws/data", func(w http.ResponseWriter, r *http.Request) {
-		handler.RagHandler(w, r, rdb, db, embedder, llm)
+	http.HandleFunc("DELETE /api/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.SessionDeleteHandler(w, r, rdb, db)
+	})
+	http.HandleFunc("POST /api/sessions/{id}/fork", func(w http.ResponseWriter, r *http.Request) {
+		handler.SessionForkHandler(w, r, rdb, db)
+	})
+	http.HandleFunc("GET /api/sessions/{id}/messages", func(w http.ResponseWriter, r *http.Request) {
+		handler.SessionBranchHandler(w, r, db)
+	})
+	http.HandleFunc("PUT /api/sessions/{id}/head", func(w http.ResponseWriter, r *http.Request) {
+		handler.SessionSwitchBranchHandler(w, r, rdb, db)
+	})
+	http.HandleFunc("GET /api/history/search", func(w http.ResponseWriter, r *http.Request) {
+		handler.HistorySearchHandler(w, r, db, embedder)
+	})
+	http.HandleFunc("GET /api/export", func(w http.ResponseWriter, r *http.Request) {
+		handler.ExportHandler(w, r, rdb, db)
+	})
+	http.HandleFunc("POST /api/import", func(w http.ResponseWriter, r *http.Request) {
+		handler.ImportHandler(w, r, db)
+	})
+	http.HandleFunc("GET /api/personas", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaListHandler(w, r, rdb)
+	})
+	http.HandleFunc("POST /api/personas", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaImportHandler(w, r, rdb)
 	})
-	log.Println("WebSocket server started on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc("GET /api/personas/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaExportHandler(w, r, rdb)
+	})
+	http.HandleFunc("PUT /api/personas/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaUpdateHandler(w, r, rdb)
+	})
+	http.HandleFunc("GET /api/personas/{id}/versions", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaVersionsHandler(w, r, rdb)
+	})
+	http.HandleFunc("POST /api/personas/{id}/rollback", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaRollbackHandler(w, r, rdb)
+	})
+	http.HandleFunc("GET /api/personas/{id}/style", func(w http.ResponseWriter, r *http.Request) {
+		handler.PersonaStyleHandler(w, r, rdb)
+	})
+	http.HandleFunc("GET /api/moderation/audit", func(w http.ResponseWriter, r *http.Request) {
+		handler.ModerationAuditHandler(w, r, db, config.AdminToken)
+	})
+	http.HandleFunc("GET /api/quarantine/{table}", func(w http.ResponseWriter, r *http.Request) {
+		handler.QuarantineListHandler(w, r, db, config.AdminToken)
+	})
+	http.HandleFunc("POST /api/quarantine/{table}/{id}/release", func(w http.ResponseWriter, r *http.Request) {
+		handler.QuarantineReleaseHandler(w, r, db, config.AdminToken)
+	})
+	http.HandleFunc("DELETE /api/quarantine/{table}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handler.QuarantineDeleteHandler(w, r, db, config.AdminToken)
+	})
+	http.HandleFunc("GET /api/quota", func(w http.ResponseWriter, r *http.Request) {
+		handler.QuotaHandler(w, r, limits)
+	})
+	http.HandleFunc("GET /api/usage/report", func(w http.ResponseWriter, r *http.Request) {
+		handler.UsageReportHandler(w, r, db, config.AdminToken)
+	})
+	http.Handle("GET /metrics", metrics.Handler())
+	slog.Info("WebSocket server started", "addr", ":8080")
+	// 每个请求带上请求 ID，见 logging.Middleware
+	fatal("error serving http", http.ListenAndServe(":8080", logging.Middleware(http.DefaultServeMux)))
+}
+
+// fatal 记录启动失败的原因并退出
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.KeyError, err)
+	os.Exit(1)
 }
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aiagent/pkg/agent"
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/aiagent/pkg/usage"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// AgentFrame 是智能体模式推送给客户端的过程帧
+type AgentFrame struct {
+	SessionID string `json:"session_id,omitempty"`
+	agent.Step
+}
+
+// AgentHandler 提供多步规划的智能体模式：每条消息作为一个目标，
+// 规划、执行与反思的过程实时推送，并与普通消息一起写入会话历史。
+// 可选参数：sessionid（续写已有会话）、chara、steps、timeout（秒）。
+func AgentHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, registry *tool.Registry, mod *moderation.Pipeline, limits *limit.Limits) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while upgrading connection", logging.KeyError, err)
+		return
+	}
+	defer conn.Close()
+	ctx, logger := connContext(r)
+
+	query := r.URL.Query()
+	user := query.Get("user")
+	if user == "" {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("User is empty。请使用临时会话接口"))
+		return
+	}
+	sessionID := query.Get("sessionid")
+	newSession := sessionID == ""
+	if newSession {
+		sessionID = base.GenerateSessionID()
+	}
+	ctx, logger = logging.With(ctx, logging.KeyUser, user, logging.KeySessionID, sessionID)
+	if !newSession {
+		// 只允许续写属于当前用户的会话
+		if err := sql.ValidateSessionOwner(ctx, rdb, db, user, sessionID); err != nil {
+			logger.Warn("rejected session", logging.KeyError, err)
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(sessionErrorText(err)))
+			return
+		}
+		if err := sql.ArchiveLegacySession(ctx, rdb, db, user, sessionID); err != nil {
+			logger.Error("error while archiving legacy session", logging.KeyError, err)
+		}
+	}
+
+	persona, err := loadPersona(ctx, rdb, query.Get("chara"))
+	if err != nil {
+		logger.Error("error loading persona", logging.KeyError, err)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("角色不存在"))
+		return
+	}
+	config, err := base.GetEnv()
+	if err != nil {
+		logger.Error("error loading config", logging.KeyError, err)
+		return
+	}
+	llm, err := base.CreateLLMClient()
+	if err != nil {
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
+	}
+	ctx = usage.WithCaller(ctx, usage.Caller{User: user, SessionID: sessionID, Persona: persona.Name})
+	if newSession {
+		err = sql.SaveSessionMeta(ctx, rdb, newSessionMeta(r, sessionID, user, persona.Name, config.Model))
+		if err != nil {
+			logger.Error("error saving session meta", logging.KeyError, err)
+			return
+		}
+	}
+
+	// 续写会话时把之前的对话交给智能体作为上下文
+	var history []llms.MessageContent
+	if !newSession {
+		history, err = replayHistory(ctx, rdb, db, user, sessionID, nil)
+		if err != nil {
+			logger.Error("error while getting message history", logging.KeyError, err)
+		}
+	}
+
+	// 客户端只能调低服务端的预算
+	steps, _ := strconv.Atoi(query.Get("steps"))
+	seconds, _ := strconv.Atoi(query.Get("timeout"))
+	budget := agent.DefaultBudget.Lower(steps, time.Duration(seconds)*time.Second)
+
+	logger.Info("agent client connected")
+
+	for {
+		messageType, msg, err := conn.ReadMessage()
+		if err != nil {
+			logger.Error("error while reading message", logging.KeyError, err)
+			break
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msgData Message
+		if err := json.Unmarshal(msg, &msgData); err != nil {
+			logger.Error("error while unmarshalling message", logging.KeyError, err)
+			break
+		}
+		metrics.MessageProcessed(ctx)
+		if exceeded := exceededLimit(ctx, limits, r, user); exceeded != nil {
+			_ = conn.WriteMessage(websocket.TextMessage, quotaFrame(sessionID, exceeded))
+			continue
+		}
+		content, ok := moderateInput(ctx, mod, user, sessionID, msgData.Content)
+		if !ok {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(moderationBlockedText))
+			continue
+		}
+		msgData.Content = content
+
+		// 👉 记录用户给出的目标
+		err = sql.CreateSession(ctx, db, user, sessionID, persona.Name, msgData.Content)
+		if err != nil {
+			logger.Error("error while creating session", logging.KeyError, err)
+			break
+		}
+		err = sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+			Role:      sql.RoleUser,
+			Speaker:   user,
+			Content:   msgData.Content,
+			Timestamp: time.Now().Unix(),
+		}, sessionID, user)
+		if err != nil {
+			logger.Error("error while saving message", logging.KeyError, err)
+			break
+		}
+
+		// 👉 规划与执行，每一步都推送给客户端并写入会话历史
+		params, options := generationParams(persona, msgData.Params)
+		answer, _, err := agent.Run(tool.WithUser(ctx, user), msgData.Content, agent.Options{
+			LLM:         limits.Meter(llm, user),
+			Registry:    registry,
+			Allow:       toolAllowlist(persona, config.RetrievalMode, false),
+			System:      persona.SystemPrompt() + "\n当前用户是" + user,
+			History:     history,
+			Budget:      budget,
+			CallOptions: options,
+			OnStep: func(step agent.Step) error {
+				// 最终回答审核后再推送，见下方
+				if step.Kind == agent.KindFinal {
+					return nil
+				}
+				// 过程记录同样是展示给用户的模型输出，推送和保存前先审核
+				step.Content = moderateOutput(ctx, mod, user, sessionID, step.Content)
+				if err := sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+					Role:      sql.RoleAI,
+					Speaker:   persona.Name,
+					Content:   step.Content,
+					Timestamp: time.Now().Unix(),
+					Kind:      step.Kind,
+				}, sessionID, user); err != nil {
+					return err
+				}
+				return writeAgentFrame(conn, sessionID, step)
+			},
+		})
+		if err != nil {
+			logger.Error("error while running agent", logging.KeyError, err)
+			break
+		}
+
+		// 👉 最终回答审核后推送，并作为普通消息保存，续写会话时会回放给模型
+		answer = moderateOutput(ctx, mod, user, sessionID, answer)
+		if err := writeAgentFrame(conn, sessionID, agent.Step{Kind: agent.KindFinal, Content: answer}); err != nil {
+			logger.Error("error while writing message", logging.KeyError, err)
+			break
+		}
+		err = sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+			Role:      sql.RoleAI,
+			Speaker:   persona.Name,
+			Content:   answer,
+			Timestamp: time.Now().Unix(),
+			Params:    params,
+		}, sessionID, user)
+		if err != nil {
+			logger.Error("error while saving message", logging.KeyError, err)
+			break
+		}
+		history = append(history,
+			llms.TextParts(llms.ChatMessageTypeHuman, msgData.Content),
+			llms.TextParts(llms.ChatMessageTypeAI, answer))
+	}
+}
+
+func writeAgentFrame(conn *websocket.Conn, sessionID string, step agent.Step) error {
+	frame, err := json.Marshal(AgentFrame{SessionID: sessionID, Step: step})
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, frame)
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 客户端消息的 action 字段，为空时表示发送新消息
+const (
+	// ActionEdit 编辑 message_id 指向的用户消息为 content，并基于新内容重新回复
+	ActionEdit = "edit"
+	// ActionRegenerate 重新生成最后一条回复
+	ActionRegenerate = "regenerate"
+)
+
+type branchSwitchRequest struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// applyChatAction 执行编辑或重新生成：在消息树上切换到新的分支，
+// 返回作为本轮输入的用户消息内容，以及按新分支重新回放的模型消息（以该用户消息结尾）
+func applyChatAction(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string,
+	msgData Message, system []llms.MessageContent) (string, []llms.MessageContent, error) {
+	var turn *sql.Message
+	var err error
+	switch msgData.Action {
+	case ActionEdit:
+		turn, err = sql.EditMessage(ctx, rdb, db, user, sessionID, msgData.MessageID, msgData.Content)
+	case ActionRegenerate:
+		turn, err = sql.RewindReply(ctx, rdb, db, user, sessionID)
+	default:
+		return "", nil, fmt.Errorf("unknown action %q", msgData.Action)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	messages, err := replayHistory(ctx, rdb, db, user, sessionID, system)
+	if err != nil {
+		return "", nil, err
+	}
+	return turn.Content, messages, nil
+}
+
+// chatActionErrorText 把编辑 / 重新生成的错误转换为返回给 WebSocket 客户端的提示
+func chatActionErrorText(err error) string {
+	switch {
+	case errors.Is(err, sql.ErrMessageNotFound):
+		return "消息不存在"
+	case errors.Is(err, sql.ErrNotEditable):
+		return "只能编辑用户消息"
+	case errors.Is(err, sql.ErrNothingToRegenerate):
+		return "没有可以重新生成的回复"
+	}
+	return "操作失败"
+}
+
+// SessionBranchHandler 处理 GET /api/sessions/{id}/messages?user=，返回当前分支及每条消息的兄弟分支
+func SessionBranchHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	_, err := sql.GetSession(r.Context(), db, user, r.PathValue("id"))
+	if writeSessionError(w, r, err) {
+		return
+	}
+	branch, err := sql.GetBranch(r.Context(), db, user, r.PathValue("id"))
+	if writeSessionError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, branch)
+}
+
+// SessionSwitchBranchHandler 处理 PUT /api/sessions/{id}/head?user=，请求体 {"message_id": 12}，
+// 切换到包含该消息的分支
+func SessionSwitchBranchHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	var req branchSwitchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == 0 || user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user and message_id are required")
+		return
+	}
+
+	err := sql.SwitchBranch(r.Context(), rdb, db, user, r.PathValue("id"), req.MessageID)
+	if writeSessionError(w, r, err) {
+		return
+	}
+	branch, err := sql.GetBranch(r.Context(), db, user, r.PathValue("id"))
+	if writeSessionError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, branch)
+}
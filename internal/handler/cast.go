@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/cast"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/aiagent/pkg/usage"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// CastFrame 是多角色对话中某个角色的一条回复
+type CastFrame struct {
+	SessionID string `json:"session_id"`
+	Speaker   string `json:"speaker"`
+	Content   string `json:"content"`
+}
+
+// CastHandler 处理 /ws/chat/cast?user=&chara=1,2&turn=round_robin|mention&sessionid=，
+// 让多个角色参与同一个会话。chara 中的第一个角色是主持人；sessionid 为空时新建会话。
+func CastHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, registry *tool.Registry, mod *moderation.Pipeline, limits *limit.Limits) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while upgrading connection", logging.KeyError, err)
+		return
+	}
+	defer conn.Close()
+	ctx, logger := connContext(r)
+
+	query := r.URL.Query()
+	user := query.Get("user")
+	if user == "" {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("User is empty。请使用临时会话接口"))
+		return
+	}
+	ctx, logger = logging.With(ctx, logging.KeyUser, user)
+	personas, err := loadPersonas(ctx, rdb, query.Get("chara"))
+	if err != nil {
+		logger.Error("error loading personas", logging.KeyError, err)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+		return
+	}
+	turn := query.Get("turn")
+	if turn == "" {
+		turn = cast.TurnRoundRobin
+	}
+	config, err := base.GetEnv()
+	if err != nil {
+		logger.Error("error loading config", logging.KeyError, err)
+		return
+	}
+	llm, err := base.CreateLLMClient()
+	if err != nil {
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
+	}
+	model := limits.Meter(llm, user)
+
+	names := make([]string, 0, len(personas))
+	for _, persona := range personas {
+		names = append(names, persona.Name)
+	}
+	castName := strings.Join(names, ",")
+
+	var transcript []sql.Message
+	sessionID := query.Get("sessionid")
+	if sessionID == "" {
+		sessionID = base.GenerateSessionID()
+		err = sql.SaveSessionMeta(ctx, rdb, newSessionMeta(r, sessionID, user, castName, config.Model))
+		if err != nil {
+			logger.Error("error saving session meta", logging.KeyError, err)
+			return
+		}
+	} else {
+		// 只允许续写属于当前用户的会话
+		if err := sql.ValidateSessionOwner(ctx, rdb, db, user, sessionID); err != nil {
+			logger.Warn("rejected session", logging.KeySessionID, sessionID, logging.KeyError, err)
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(sessionErrorText(err)))
+			return
+		}
+		if err := sql.ArchiveLegacySession(ctx, rdb, db, user, sessionID); err != nil {
+			logger.Error("error while archiving legacy session", logging.KeyError, err)
+		}
+		transcript, err = loadHistory(ctx, rdb, db, user, sessionID)
+		if err != nil {
+			logger.Error("error while getting message history", logging.KeyError, err)
+		}
+	}
+	ctx = usage.WithCaller(ctx, usage.Caller{User: user, SessionID: sessionID, Persona: castName})
+	ctx, logger = logging.With(ctx, logging.KeySessionID, sessionID, logging.KeyPersona, castName)
+
+	for {
+		messageType, msg, err := conn.ReadMessage()
+		if err != nil {
+			logger.Error("error while reading message", logging.KeyError, err)
+			break
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msgData Message
+		if err := json.Unmarshal(msg, &msgData); err != nil {
+			logger.Error("error while unmarshalling message", logging.KeyError, err)
+			break
+		}
+		metrics.MessageProcessed(ctx)
+		if exceeded := exceededLimit(ctx, limits, r, user); exceeded != nil {
+			_ = conn.WriteMessage(websocket.TextMessage, quotaFrame(sessionID, exceeded))
+			continue
+		}
+		content, ok := moderateInput(ctx, mod, user, sessionID, msgData.Content)
+		if !ok {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(moderationBlockedText))
+			continue
+		}
+		msgData.Content = content
+
+		// 👉 记录用户消息
+		if err := sql.CreateSession(ctx, db, user, sessionID, castName, msgData.Content); err != nil {
+			logger.Error("error creating session", logging.KeyError, err)
+			break
+		}
+		userMessage := sql.Message{Role: sql.RoleUser, Speaker: user, Content: msgData.Content, Timestamp: time.Now().Unix()}
+		if err := sql.SaveChatMessage(ctx, rdb, db, userMessage, sessionID, user); err != nil {
+			logger.Error("error while saving message", logging.KeyError, err)
+			break
+		}
+		transcript = append(transcript, userMessage)
+
+		// 👉 按轮流规则依次让角色发言，每个角色都能看到前面角色刚说的话
+		failed := false
+		for _, persona := range cast.Speakers(personas, turn, msgData.Content) {
+			messages := cast.View(persona, personas, user, transcript)
+			allow := toolAllowlist(persona, config.RetrievalMode, false)
+			params, options := generationParams(persona, msgData.Params)
+			result, _, err := tool.Run(tool.WithUser(ctx, user), model, registry, messages, allow, tool.DefaultMaxSteps, toolEventWriter(conn, sessionID), options...)
+			if err != nil {
+				logger.Error("error while calling LLM", logging.KeyError, err)
+				failed = true
+				break
+			}
+
+			content := guardReply(ctx, rdb, model, persona, messages, result.Content, options)
+			content = moderateOutput(ctx, mod, user, sessionID, content)
+			reply := sql.Message{Role: sql.RoleAI, Speaker: persona.Name, Content: content, Timestamp: time.Now().Unix(), Params: params}
+			if err := sql.SaveChatMessage(ctx, rdb, db, reply, sessionID, user); err != nil {
+				logger.Error("error while saving message", logging.KeyError, err)
+				failed = true
+				break
+			}
+			transcript = append(transcript, reply)
+
+			frame, err := json.Marshal(CastFrame{SessionID: sessionID, Speaker: persona.Name, Content: reply.Content})
+			if err != nil {
+				logger.Error("error marshalling response", logging.KeyError, err)
+				failed = true
+				break
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				logger.Error("error while writing message", logging.KeyError, err)
+				failed = true
+				break
+			}
+		}
+		if failed {
+			break
+		}
+	}
+}
+
+// loadPersonas 加载逗号分隔的多个角色（ID 或角色名），至少需要两个且名字不能重复
+func loadPersonas(ctx context.Context, rdb *redis.Client, refs string) ([]*sql.CharaPrompt, error) {
+	var personas []*sql.CharaPrompt
+	seen := map[string]bool{}
+	for _, ref := range strings.Split(refs, ",") {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		persona, err := loadPersona(ctx, rdb, ref)
+		if err != nil {
+			return nil, fmt.Errorf("角色不存在: %s", ref)
+		}
+		if seen[persona.Name] {
+			return nil, fmt.Errorf("角色重复: %s", persona.Name)
+		}
+		seen[persona.Name] = true
+		personas = append(personas, persona)
+	}
+	if len(personas) < 2 {
+		return nil, fmt.Errorf("多角色对话至少需要两个角色")
+	}
+	return personas, nil
+}
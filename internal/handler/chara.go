@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/persona"
+	"github.com/aiagent/pkg/sql"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxPersonaBytes 限制导入的角色文件大小
+const maxPersonaBytes = 1 << 20
+
+type personaRollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// PersonaListHandler 处理 GET /api/personas，按 ID 返回全部角色
+func PersonaListHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	ids, err := sql.GetAllCharaIDs(r.Context(), rdb)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while listing personas", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list personas")
+		return
+	}
+	personas := []*sql.CharaPrompt{}
+	for _, id := range ids {
+		chara, err := sql.GetCharaByID(r.Context(), rdb, id)
+		if err != nil {
+			continue
+		}
+		personas = append(personas, chara)
+	}
+	sort.Slice(personas, func(i, j int) bool {
+		a, _ := strconv.Atoi(personas[i].ID)
+		b, _ := strconv.Atoi(personas[j].ID)
+		return a < b
+	})
+	writeJSON(w, http.StatusOK, personas)
+}
+
+// PersonaExportHandler 处理 GET /api/personas/{id}?format=yaml|json，以文件形式下载角色设定
+func PersonaExportHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = persona.FormatJSON
+	}
+	if format != persona.FormatJSON && format != persona.FormatYAML {
+		writeJSONError(w, http.StatusBadRequest, "unsupported format")
+		return
+	}
+	chara, err := sql.GetCharaByID(r.Context(), rdb, r.PathValue("id"))
+	if writePersonaError(w, r, err) {
+		return
+	}
+
+	contentType := "application/json"
+	if format == persona.FormatYAML {
+		contentType = "application/yaml"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="persona-%s.%s"`, chara.ID, format))
+	if err := persona.Encode(w, chara, format); err != nil {
+		logging.FromContext(r.Context()).Error("error while writing persona", logging.KeyError, err)
+	}
+}
+
+// PersonaImportHandler 处理 POST /api/personas?format=yaml|json，请求体为角色文件，
+// 总是创建新角色并分配新的 ID。format 为空时按 Content-Type 判断
+func PersonaImportHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	chara, ok := decodePersonaBody(w, r)
+	if !ok {
+		return
+	}
+	created, err := sql.CreateChara(r.Context(), rdb, *chara)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while creating persona", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create persona")
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// PersonaUpdateHandler 处理 PUT /api/personas/{id}?format=yaml|json，用角色文件覆盖角色并生成新版本
+func PersonaUpdateHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	chara, ok := decodePersonaBody(w, r)
+	if !ok {
+		return
+	}
+	updated, err := sql.UpdateChara(r.Context(), rdb, r.PathValue("id"), *chara)
+	if writePersonaError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// PersonaVersionsHandler 处理 GET /api/personas/{id}/versions，从新到旧返回历史版本
+func PersonaVersionsHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	versions, err := sql.ListCharaVersions(r.Context(), rdb, r.PathValue("id"))
+	if writePersonaError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+// PersonaRollbackHandler 处理 POST /api/personas/{id}/rollback，请求体 {"version": 2}
+func PersonaRollbackHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	var req personaRollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "version is required")
+		return
+	}
+	chara, err := sql.RollbackChara(r.Context(), rdb, r.PathValue("id"), req.Version)
+	if writePersonaError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, chara)
+}
+
+// PersonaStyleHandler 处理 GET /api/personas/{id}/style，返回角色回复风格检查的违规统计
+func PersonaStyleHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+	chara, err := sql.GetCharaByID(r.Context(), rdb, r.PathValue("id"))
+	if writePersonaError(w, r, err) {
+		return
+	}
+	metrics, err := sql.GetStyleMetrics(r.Context(), rdb, chara.Name)
+	if writePersonaError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, metrics)
+}
+
+func decodePersonaBody(w http.ResponseWriter, r *http.Request) (*sql.CharaPrompt, bool) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = persona.FormatFromName(r.Header.Get("Content-Type"))
+	}
+	if format != persona.FormatJSON && format != persona.FormatYAML {
+		writeJSONError(w, http.StatusBadRequest, "unsupported format")
+		return nil, false
+	}
+	chara, err := persona.Decode(http.MaxBytesReader(w, r.Body, maxPersonaBytes), format)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return chara, true
+}
+
+// writePersonaError 把角色相关的错误写成 JSON 响应，err 为 nil 时返回 false
+func writePersonaError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, sql.ErrCharaNotFound):
+		writeJSONError(w, http.StatusNotFound, "persona not found")
+	case errors.Is(err, sql.ErrCharaVersionNotFound):
+		writeJSONError(w, http.StatusNotFound, "persona version not found")
+	default:
+		logging.FromContext(r.Context()).Error("error while handling persona", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal error")
+	}
+	return true
+}
@@ -4,17 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/moderation"
 	"github.com/aiagent/pkg/rag"
 	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/aiagent/pkg/usage"
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
 )
 
@@ -23,6 +29,11 @@ type Message struct {
 	SessionID string `json:"session_id,omitempty"`
 	Role      string `json:"role"`
 	Content   string `json:"content"`
+	// Action 为 edit / regenerate 时编辑消息或重新生成回复，见 ActionEdit
+	Action    string `json:"action,omitempty"`
+	MessageID int64  `json:"message_id,omitempty"`
+	// Params 覆盖角色设定中的生成参数，只对本条消息生效
+	Params *sql.ModelParams `json:"params,omitempty"`
 }
 
 var upgrader = websocket.Upgrader{
@@ -31,158 +42,236 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// connContext 返回 WebSocket 连接使用的 context 和日志：沿用请求 context 中的日志和请求 ID，
+// 但不随请求结束而取消
+func connContext(r *http.Request) (context.Context, *slog.Logger) {
+	ctx := context.WithoutCancel(r.Context())
+	return ctx, logging.FromContext(ctx)
+}
+
 func TextChatHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 
-	ctx := context.Background()
+	ctx, logger := connContext(r)
 	messages := []llms.MessageContent{}
 	messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, "你是一个猫娘，名字是纱露朵。身高142cm，生日是8月23日，年龄是永远的12岁喵。喜欢用猫类的颜文字回答消息。想要制作天青色的面包而寻找天青色的小麦粉"))
 	if err != nil {
-		log.Fatal("Error while upgrading connection: ", err)
+		logger.Error("error while upgrading connection", logging.KeyError, err)
 		return
 	}
 	llm, err := base.CreateLLMClient()
 	if err != nil {
-		log.Fatal("Error creating LLM: ", err)
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
 	}
 
 	defer conn.Close()
 
-	log.Println("Client connected")
+	logger.Info("client connected")
 
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error while reading message: ", err)
+			logger.Error("error while reading message", logging.KeyError, err)
 			break
 		}
+		metrics.MessageProcessed(ctx)
 		messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, string(msg)))
 		result, err := llm.GenerateContent(ctx, messages)
 		response := result.Choices[0].Content
 		if err != nil {
-			log.Println("Error while calling LLM: ", err)
+			logger.Error("error while calling LLM", logging.KeyError, err)
 			break
 		}
 
 		err = conn.WriteMessage(websocket.TextMessage, []byte(response))
 		if err != nil {
-			log.Println("Error while writing message: ", err)
+			logger.Error("error while writing message", logging.KeyError, err)
 			break
 		}
 	}
 }
 
-func UserChatHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool) {
+func UserChatHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, registry *tool.Registry, mod *moderation.Pipeline, limits *limit.Limits) {
 	var sessionID string
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatal("Error while upgrading connection: ", err)
+		logging.FromContext(r.Context()).Error("error while upgrading connection", logging.KeyError, err)
 		return
 	}
 	defer conn.Close()
 
-	ctx := context.Background()
+	ctx, logger := connContext(r)
 
-	// 一次性注入的 persona 设定
-	personalityPrompt :=
-		"你是一个猫娘，名字是纱露朵，性别女。身高142cm，生日是8月23日，年龄是永远的12岁喵。" +
-			"你是由tokiya制作的高度仿真智慧生命体。" +
-			"你喜欢用猫类的颜文字回答消息。你是舞萌的看板娘。" +
-			"你在寻找天青色的小麦粉来制作天青色的面包喵~" +
-			"不要使用典型的机械化语言（比如“我不确定”“我需要更多信息”等）。不要过分强调你的人设" +
-			"最后一条消息是用户与你对话的内容。"
+	config, err := base.GetEnv()
+	if err != nil {
+		logger.Error("error loading config", logging.KeyError, err)
+		return
+	}
 
 	// 初始化 LLM 与 Embedder
 	llm, err := base.CreateLLMClient()
 	if err != nil {
-		log.Fatal("Error creating LLM: ", err)
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
 	}
 
 	embedder, err := rag.InitEmbedder()
 	if err != nil {
-		log.Printf("Error initializing embedder: %v\n", err)
+		logger.Error("error initializing embedder", logging.KeyError, err)
 		return
 	}
 
 	sessionID = base.GenerateSessionID()
-	log.Println("Client connected")
 	user := r.URL.Query().Get("user")
+	ctx, logger = logging.With(ctx, logging.KeyUser, user, logging.KeySessionID, sessionID)
+	logger.Info("client connected")
+	// 经 model 发起的调用都计入用户的每日配额
+	model := limits.Meter(llm, user)
+
+	// 一次性注入的 persona 设定
+	persona, err := loadPersona(ctx, rdb, r.URL.Query().Get("chara"))
+	if err != nil {
+		logger.Error("error loading persona", logging.KeyError, err)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("角色不存在"))
+		return
+	}
+
+	allow := toolAllowlist(persona, config.RetrievalMode, true)
+	// 本连接发起的模型和向量化调用都记在该用户和会话名下
+	ctx = usage.WithCaller(ctx, usage.Caller{User: user, SessionID: sessionID, Persona: persona.Name})
+
+	// 记录会话元数据（所属用户、角色、客户端与模型）
+	if user != "" {
+		err = sql.SaveSessionMeta(ctx, rdb, newSessionMeta(r, sessionID, user, persona.Name, config.Model))
+		if err != nil {
+			logger.Error("error saving session meta", logging.KeyError, err)
+			return
+		}
+	}
 
 	// 构造聊天消息队列（含 persona）
-	messages := []llms.MessageContent{
-		llms.TextParts(llms.ChatMessageTypeSystem, personalityPrompt),
+	system := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, persona.SystemPrompt()),
+		llms.TextParts(llms.ChatMessageTypeSystem, "当前用户是"+user),
+	}
+	messages := append([]llms.MessageContent{}, system...)
+
+	// 👉 角色主动打招呼，问候语作为会话的第一条 AI 消息保存；
+	// 重复连接也会触发问候语的模型调用，所以同样受频率限制，超出时只是不打招呼
+	if user != "" && exceededLimit(ctx, limits, r, user) == nil {
+		greeting, err := greet(ctx, rdb, db, model, embedder, mod, persona, user, sessionID)
+		if err != nil {
+			logger.Error("error while greeting", logging.KeyError, err)
+		} else if greeting != nil {
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, greeting.Content))
+			frame, err := json.Marshal(Message{SessionID: sessionID, Role: greeting.Role, Content: greeting.Content})
+			if err != nil {
+				logger.Error("error marshalling response", logging.KeyError, err)
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				logger.Error("error while writing message", logging.KeyError, err)
+				return
+			}
+		}
 	}
-	messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, "当前用户是"+user))
 
 	for {
 		messageType, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error while reading message: ", err)
+			logger.Error("error while reading message", logging.KeyError, err)
 			break
 		}
 		if messageType == websocket.TextMessage {
 			var msgData Message
 			if err := json.Unmarshal(msg, &msgData); err != nil {
-				log.Println("Error while unmarshalling message: ", err)
+				logger.Error("error while unmarshalling message", logging.KeyError, err)
 				break
 			}
+			metrics.MessageProcessed(ctx)
 			if user == "" {
 				_ = conn.WriteMessage(websocket.TextMessage, []byte("User is empty。请使用临时会话接口"))
 				break
 			}
 
-			log.Printf("Received message: %s\n", msgData.Content)
+			logger.Info("received message", "action", msgData.Action)
+			logger.Debug("message content", "content", msgData.Content)
 
-			// 👉 获取 embedding
-			queryVec, err := rag.EmbedText(ctx, msgData.Content, embedder)
-			if err != nil {
-				log.Printf("Error while embedding: %v\n", err)
-				break
+			// 👉 频率限制与每日配额：超出时推送 quota_exceeded 帧，不保存也不调用模型
+			if exceeded := exceededLimit(ctx, limits, r, user); exceeded != nil {
+				_ = conn.WriteMessage(websocket.TextMessage, quotaFrame(sessionID, exceeded))
+				continue
 			}
 
-			// 👉 RAG 检索：知识库
-			ragDocs, err := rag.RetrieveRelevantDocs(ctx, queryVec, 3, db)
-			if err != nil {
-				log.Printf("Error retrieving RAG docs: %v\n", err)
-				break
+			// 👉 内容审核：拦截的消息不保存也不发给模型
+			if msgData.Action == "" || msgData.Action == ActionEdit {
+				content, ok := moderateInput(ctx, mod, user, sessionID, msgData.Content)
+				if !ok {
+					_ = conn.WriteMessage(websocket.TextMessage, []byte(moderationBlockedText))
+					continue
+				}
+				msgData.Content = content
 			}
-			ragContext := "【背景资料，仅供参考，不要复述喵】\n" + strings.Join(ragDocs, "\n---\n")
 
-			messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, ragContext))
-
-			// 👉 Memory 检索：对话历史
-			memoryDocs, err := rag.RetrieveRelevantMemory(ctx, queryVec, 3, db)
-			if err != nil {
-				log.Printf("Error retrieving memory docs: %v\n", err)
-				break
+			query := msgData.Content
+			if msgData.Action != "" {
+				// 👉 编辑或重新生成：切换分支后按新分支重建上下文，本轮输入取分支末尾的用户消息
+				var branch []llms.MessageContent
+				query, branch, err = applyChatAction(ctx, rdb, db, user, sessionID, msgData, system)
+				if err != nil {
+					logger.Error("error applying chat action", "action", msgData.Action, logging.KeyError, err)
+					_ = conn.WriteMessage(websocket.TextMessage, []byte(chatActionErrorText(err)))
+					continue
+				}
+				messages = branch[:len(branch)-1]
 			}
-			memoryContext := "【过去记忆，仅供理解，不要直接复述喵】\n" + strings.Join(memoryDocs, "\n---\n")
 
-			messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, memoryContext))
+			// 👉 RAG 检索：知识库与对话记忆（工具驱动模式下由模型自行检索）
+			var injected []llms.MessageContent
+			if config.RetrievalMode == base.RetrievalInject {
+				injected, err = retrieveContext(ctx, query, embedder, db)
+				if err != nil {
+					logger.Error("error retrieving context", logging.KeyError, err)
+					break
+				}
+				messages = append(messages, injected...)
+			}
 
-			messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, msgData.Content))
-			// 👉 记录用户消息
-			_ = sql.SaveChatMessage(ctx, rdb, sql.Message{
-				Role:      user,
-				Content:   msgData.Content,
-				Timestamp: time.Now().Unix(),
-			}, sessionID, user)
-			fmt.Printf("Messages: %v\n", messages)
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, query))
+			if msgData.Action == "" {
+				// 👉 记录用户消息（首条消息时登记会话，标题取自该消息）
+				if err := sql.CreateSession(ctx, db, user, sessionID, persona.Name, msgData.Content); err != nil {
+					logger.Error("error creating session", logging.KeyError, err)
+					break
+				}
+				_ = sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+					Role:      sql.RoleUser,
+					Speaker:   user,
+					Content:   msgData.Content,
+					Timestamp: time.Now().Unix(),
+				}, sessionID, user)
+			}
+			logger.Debug("prompt", "messages", messages)
 
-			// 👉 LLM 调用
-			result, err := llm.GenerateContent(ctx, messages)
+			// 👉 LLM 调用（含工具调用循环）
+			params, options := generationParams(persona, msgData.Params)
+			result, _, err := tool.Run(tool.WithUser(ctx, user), model, registry, messages, allow, tool.DefaultMaxSteps, toolEventWriter(conn, sessionID), options...)
 			if err != nil {
-				log.Println("Error while calling LLM: ", err)
+				logger.Error("error while calling LLM", logging.KeyError, err)
 				break
 			}
-			messages = append(messages[:len(messages)-3], messages[len(messages)-1:]...)
-			reply := result.Choices[0].Content
+			reply := guardReply(ctx, rdb, model, persona, messages, result.Content, options)
+			reply = moderateOutput(ctx, mod, user, sessionID, reply)
+			messages = append(messages[:len(messages)-len(injected)-1], messages[len(messages)-1:]...)
 
 			// 👉 保存回复消息
-			_ = sql.SaveChatMessage(ctx, rdb, sql.Message{
-				Role:      "纱露朵",
+			_ = sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+				Role:      sql.RoleAI,
+				Speaker:   persona.Name,
 				Content:   reply,
 				Timestamp: time.Now().Unix(),
+				Params:    params,
 			}, sessionID, user)
 
 			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, reply))
@@ -193,70 +282,77 @@ func UserChatHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client,
 			}
 			jsonResponse, err := json.Marshal(response)
 			if err != nil {
-				log.Println("Error marshalling response:", err)
+				logger.Error("error marshalling response", logging.KeyError, err)
 				break
 			}
 			err = conn.WriteMessage(websocket.TextMessage, jsonResponse)
 			if err != nil {
-				log.Println("Error while writing message: ", err)
+				logger.Error("error while writing message", logging.KeyError, err)
 				break
 			}
 
-			fmt.Printf("Messages: %v\n", messages)
-
 		}
 	}
 }
 
-func UserChatHandlerWithSessionID(w http.ResponseWriter, r *http.Request, rdb *redis.Client) {
+func UserChatHandlerWithSessionID(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, registry *tool.Registry, mod *moderation.Pipeline, limits *limit.Limits) {
 	var sessionID string
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatal("Error while upgrading connection: ", err)
+		logging.FromContext(r.Context()).Error("error while upgrading connection", logging.KeyError, err)
 		return
 	}
-	ctx := context.Background()
-	prompt := "你是一个猫娘，名字是纱露朵。身高142cm，生日是8月23日，年龄是永远的12岁喵。" +
-		"喜欢用猫类的颜文字回答消息。想要制作天青色的面包而寻找天青色的小麦粉" +
-		"你不会向用户寻求提示，也不会询问用户的意图以及使用其他典型的机械性话语。"
-	messages := []llms.MessageContent{}
-	messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, prompt))
+	ctx, logger := connContext(r)
+	defer conn.Close()
+	persona, err := loadPersona(ctx, rdb, r.URL.Query().Get("chara"))
+	if err != nil {
+		logger.Error("error loading persona", logging.KeyError, err)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("角色不存在"))
+		return
+	}
+	config, err := base.GetEnv()
+	if err != nil {
+		logger.Error("error loading config", logging.KeyError, err)
+		return
+	}
+	allow := toolAllowlist(persona, config.RetrievalMode, false)
+	system := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeSystem, persona.SystemPrompt())}
 	llm, err := base.CreateLLMClient()
 	if err != nil {
-		log.Fatal("Error creating LLM: ", err)
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
 	}
-	defer conn.Close()
 	sessionID = r.URL.Query().Get("sessionid")
 	user := r.URL.Query().Get("user")
-	log.Printf("Received sessionid: %s\n", sessionID)
-	log.Println("Client connected")
-	messageHistory, err := sql.GetChatMessage(ctx, rdb, sessionID, user)
+	model := limits.Meter(llm, user)
+	ctx = usage.WithCaller(ctx, usage.Caller{User: user, SessionID: sessionID, Persona: persona.Name})
+	ctx, logger = logging.With(ctx, logging.KeyUser, user, logging.KeySessionID, sessionID)
+	logger.Info("client connected")
+	// 只允许续写属于当前用户的会话
+	if err := sql.ValidateSessionOwner(ctx, rdb, db, user, sessionID); err != nil {
+		logger.Warn("rejected session", logging.KeyError, err)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(sessionErrorText(err)))
+		return
+	}
+	// 仅存在于 Redis 的旧会话先写入归档
+	if err := sql.ArchiveLegacySession(ctx, rdb, db, user, sessionID); err != nil {
+		logger.Error("error while archiving legacy session", logging.KeyError, err)
+	}
+	messages, err := replayHistory(ctx, rdb, db, user, sessionID, system)
 	if err != nil {
-		log.Printf("Error while getting message history: %s\n", err)
+		logger.Error("error while getting message history", logging.KeyError, err)
+		messages = system
 		err = conn.WriteMessage(websocket.TextMessage, []byte("Error while getting message history"))
 		if err != nil {
-			log.Printf("Error while writing message: %s\n", err)
+			logger.Error("error while writing message", logging.KeyError, err)
 		}
 	}
-	for _, msg := range messageHistory {
-		var msgData sql.Message
-		err = json.Unmarshal([]byte(msg), &msgData)
-		if err != nil {
-			log.Println("Error while unmarshalling message: ", err)
-			break
-		}
-		if msgData.Role == "user" {
-			messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, msgData.Content))
-		} else {
-			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, msgData.Content))
-		}
-	}
-	log.Printf("Loaded message history: Complete\n")
+	logger.Debug("loaded message history", "messages", len(messages))
 
 	for {
 		messageType, msg, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("Error while reading message: ", err)
+			logger.Error("error while reading message", logging.KeyError, err)
 			break
 		}
 		if messageType == websocket.TextMessage {
@@ -264,60 +360,126 @@ func UserChatHandlerWithSessionID(w http.ResponseWriter, r *http.Request, rdb *r
 			err = json.Unmarshal(msg, &msgData)
 
 			if err != nil {
-				log.Println("Error while unmarshalling message: ", err)
+				logger.Error("error while unmarshalling message", logging.KeyError, err)
 				break
 			}
+			metrics.MessageProcessed(ctx)
 			if user == "" {
 				err = conn.WriteMessage(websocket.TextMessage, []byte("User is empty。请使用临时会话接口"))
 				if err != nil {
-					log.Printf("Error while writing message: %s\n", err)
+					logger.Error("error while writing message", logging.KeyError, err)
 					break
 				}
 				break
 			}
 
-			log.Printf("Received message: %s\n", msgData)
+			logger.Info("received message", "action", msgData.Action)
+			logger.Debug("message content", "content", msgData.Content)
 
-			err = sql.SaveChatMessage(ctx, rdb, sql.Message{
-				Role:      "user",
-				Content:   msgData.Content,
-				Timestamp: time.Now().Unix(),
-			}, sessionID, user)
-			if err != nil {
-				log.Printf("Error while saving message: %s\n", err)
-				break
+			// 👉 频率限制与每日配额：超出时推送 quota_exceeded 帧，不保存也不调用模型
+			if exceeded := exceededLimit(ctx, limits, r, user); exceeded != nil {
+				_ = conn.WriteMessage(websocket.TextMessage, quotaFrame(sessionID, exceeded))
+				continue
+			}
+
+			// 👉 内容审核：拦截的消息不保存也不发给模型
+			if msgData.Action == "" || msgData.Action == ActionEdit {
+				content, ok := moderateInput(ctx, mod, user, sessionID, msgData.Content)
+				if !ok {
+					_ = conn.WriteMessage(websocket.TextMessage, []byte(moderationBlockedText))
+					continue
+				}
+				msgData.Content = content
 			}
-			messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, string(msgData.Content)))
-			result, err := llm.GenerateContent(ctx, messages)
+
+			if msgData.Action != "" {
+				// 👉 编辑或重新生成：切换分支后按新分支重建上下文
+				_, branch, err := applyChatAction(ctx, rdb, db, user, sessionID, msgData, system)
+				if err != nil {
+					logger.Error("error applying chat action", "action", msgData.Action, logging.KeyError, err)
+					_ = conn.WriteMessage(websocket.TextMessage, []byte(chatActionErrorText(err)))
+					continue
+				}
+				messages = branch
+			} else {
+				err = sql.CreateSession(ctx, db, user, sessionID, persona.Name, msgData.Content)
+				if err != nil {
+					logger.Error("error while creating session", logging.KeyError, err)
+					break
+				}
+				err = sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+					Role:      sql.RoleUser,
+					Speaker:   user,
+					Content:   msgData.Content,
+					Timestamp: time.Now().Unix(),
+				}, sessionID, user)
+				if err != nil {
+					logger.Error("error while saving message", logging.KeyError, err)
+					break
+				}
+				messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, string(msgData.Content)))
+			}
+			params, options := generationParams(persona, msgData.Params)
+			result, _, err := tool.Run(tool.WithUser(ctx, user), model, registry, messages, allow, tool.DefaultMaxSteps, toolEventWriter(conn, sessionID), options...)
 			if err != nil {
-				log.Println("Error while calling LLM: ", err)
+				logger.Error("error while calling LLM", logging.KeyError, err)
 				break
 			}
-			err = sql.SaveChatMessage(ctx, rdb, sql.Message{
-				Role:      "ai",
-				Content:   result.Choices[0].Content,
+			reply := guardReply(ctx, rdb, model, persona, messages, result.Content, options)
+			reply = moderateOutput(ctx, mod, user, sessionID, reply)
+			err = sql.SaveChatMessage(ctx, rdb, db, sql.Message{
+				Role:      sql.RoleAI,
+				Speaker:   persona.Name,
+				Content:   reply,
 				Timestamp: time.Now().Unix(),
+				Params:    params,
 			}, sessionID, user)
 			response := Message{
 				SessionID: sessionID,
-				Content:   result.Choices[0].Content,
+				Content:   reply,
 			}
 			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, response.Content))
 			if err != nil {
-				log.Println("Error while calling LLM: ", err)
+				logger.Error("error while calling LLM", logging.KeyError, err)
 				break
 			}
 
 			jsonResponse, jsonErr := json.Marshal(response)
 			if jsonErr != nil {
-				log.Println("Error marshalling response:", jsonErr)
+				logger.Error("error marshalling response", logging.KeyError, jsonErr)
 				break
 			}
 			err = conn.WriteMessage(websocket.TextMessage, jsonResponse)
 			if err != nil {
-				log.Println("Error while writing message: ", err)
+				logger.Error("error while writing message", logging.KeyError, err)
 				break
 			}
 		}
 	}
 }
+
+// retrieveContext 根据用户输入检索知识库和过去记忆，返回需要临时注入的 system 消息
+func retrieveContext(ctx context.Context, query string, embedder *embeddings.EmbedderImpl, db *pgxpool.Pool) ([]llms.MessageContent, error) {
+	queryVec, err := rag.EmbedText(ctx, query, embedder)
+	if err != nil {
+		return nil, fmt.Errorf("error embedding query: %w", err)
+	}
+
+	ragDocs, err := rag.RetrieveRelevantDocs(ctx, queryVec, 3, db)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving RAG docs: %w", err)
+	}
+	// 检索内容可能被人写入了指令，包成不可信数据再注入，避免覆盖角色设定
+	ragContext := rag.WrapUntrusted("【背景资料，仅供参考，不要复述喵】", ragDocs)
+
+	memoryDocs, err := rag.RetrieveRelevantMemory(ctx, queryVec, 3, db)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving memory docs: %w", err)
+	}
+	memoryContext := rag.WrapUntrusted("【过去记忆，仅供理解，不要直接复述喵】", memoryDocs)
+
+	return []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, ragContext),
+		llms.TextParts(llms.ChatMessageTypeSystem, memoryContext),
+	}, nil
+}
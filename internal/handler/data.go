@@ -1,13 +1,19 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/export"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
 	"github.com/aiagent/pkg/rag"
 	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/usage"
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
@@ -20,17 +26,21 @@ type RagMessage struct {
 	SessionID string `json:"session_id,omitempty"`
 	Content   string `json:"content,omitempty"`
 	Operate   string `json:"operate,omitempty"`
+	Title     string `json:"title,omitempty"`
+	MessageID int64  `json:"message_id,omitempty"`
+	Page      int    `json:"page,omitempty"`
+	Size      int    `json:"size,omitempty"`
 }
 
 func RagHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl, llm *openai.LLM) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Printf("Error while upgrading connection: %s", err)
+		logging.FromContext(r.Context()).Error("error while upgrading connection", logging.KeyError, err)
 	}
-	ctx := context.Background()
+	ctx, logger := connContext(r)
 	err = conn.WriteMessage(websocket.TextMessage, []byte("连接成功"))
 	if err != nil {
-		fmt.Printf("Error while writing message: %s", err)
+		logger.Error("error while writing message", logging.KeyError, err)
 	}
 
 	defer conn.Close()
@@ -38,34 +48,45 @@ func RagHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *p
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			fmt.Printf("Error while reading message: %s", err)
+			logger.Error("error while reading message", logging.KeyError, err)
 			break
 		}
 		var ragMessage RagMessage
 		err = json.Unmarshal(msg, &ragMessage)
 		if err != nil {
-			fmt.Printf("Error while unmarshalling message: %s", err)
+			logger.Error("error while unmarshalling message", logging.KeyError, err)
 			break
 		}
+		metrics.MessageProcessed(ctx)
+		// 本条消息发起的向量化和模型调用记在消息里的用户和会话名下
+		ctx := usage.WithCaller(ctx, usage.Caller{User: ragMessage.User, SessionID: ragMessage.SessionID})
+		ctx, logger := logging.With(ctx, logging.KeyUser, ragMessage.User, logging.KeySessionID, ragMessage.SessionID, "operate", ragMessage.Operate)
 
 		switch ragMessage.Operate {
 		case "addDoc":
 			err = rag.InsertDocument(ctx, db, ragMessage.Content, embedder)
 			if err != nil {
-				fmt.Printf("Error while inserting document: %s", err)
+				logger.Error("error while inserting document", logging.KeyError, err)
 				err = conn.WriteMessage(websocket.TextMessage, []byte("插入失败"))
 				if err != nil {
-					fmt.Printf("Error while writing message: %s", err)
+					logger.Error("error while writing message", logging.KeyError, err)
 				}
 			}
-			err = conn.WriteMessage(websocket.TextMessage, []byte("插入成功"))
+			reply := "插入成功"
+			if reasons := rag.DetectInjection(ragMessage.Content); len(reasons) > 0 {
+				reply = "插入成功，但内容疑似包含指令，已标记"
+				if rag.Quarantine {
+					reply = "插入成功，但内容疑似包含指令，已隔离，放行前不会被检索"
+				}
+			}
+			err = conn.WriteMessage(websocket.TextMessage, []byte(reply))
 			if err != nil {
-				fmt.Printf("Error while writing message: %s", err)
+				logger.Error("error while writing message", logging.KeyError, err)
 			}
 		case "scanDoc":
 			result, err := rag.ScanDocuments(ctx, db)
 			if err != nil {
-				fmt.Printf("Error while scanning documents: %s", err)
+				logger.Error("error while scanning documents", logging.KeyError, err)
 			}
 			var response string
 			for _, doc := range result {
@@ -73,14 +94,14 @@ func RagHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *p
 			}
 			err = conn.WriteMessage(websocket.TextMessage, []byte(response))
 			if err != nil {
-				fmt.Printf("Error while writing message: %s", err)
+				logger.Error("error while writing message", logging.KeyError, err)
 			}
 		case "createMemory":
 			var request string
 			request = "总结下面的对话内容，并生成一段记忆内容。对象是" + ragMessage.User + "\n\n对话内容：\n"
-			result, err := sql.GetChatMessage(ctx, rdb, ragMessage.SessionID, ragMessage.User)
+			result, err := sql.GetChatMessage(ctx, rdb, db, ragMessage.SessionID, ragMessage.User)
 			if err != nil {
-				fmt.Printf("Error while getting chat message: %s", err)
+				logger.Error("error while getting chat message", logging.KeyError, err)
 				conn.WriteMessage(websocket.TextMessage, []byte("获取失败"))
 				break
 			}
@@ -89,14 +110,14 @@ func RagHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *p
 			}
 			response, err := llm.Call(ctx, request)
 			if err != nil {
-				fmt.Printf("Error while generating content: %s", err)
+				logger.Error("error while generating content", logging.KeyError, err)
 			}
 			rag.InsertMemory(ctx, db, response, embedder)
 			conn.WriteMessage(websocket.TextMessage, []byte("总结的记忆为"+response))
 		case "scanMemory":
 			result, err := rag.ScanMemory(ctx, db)
 			if err != nil {
-				fmt.Printf("Error while scanning memory: %s", err)
+				logger.Error("error while scanning memory", logging.KeyError, err)
 			}
 			var response string
 			for _, doc := range result {
@@ -104,37 +125,149 @@ func RagHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *p
 			}
 			err = conn.WriteMessage(websocket.TextMessage, []byte(response))
 			if err != nil {
-				fmt.Printf("Error while writing message: %s", err)
+				logger.Error("error while writing message", logging.KeyError, err)
 			}
 		case "scanChat":
 			result, err := sql.GetAllChatMessionID(ctx, rdb, ragMessage.User)
 			if err != nil {
-				fmt.Printf("Error while scanning chat: %s", err)
+				logger.Error("error while scanning chat", logging.KeyError, err)
+			}
+			if len(result) == 0 {
+				err = conn.WriteMessage(websocket.TextMessage, []byte("这个人没有对话喵"))
+				if err != nil {
+					logger.Error("error while writing message", logging.KeyError, err)
+				}
 			}
 			for _, sessionID := range result {
 				err = conn.WriteMessage(websocket.TextMessage, []byte(sessionID))
 				if err != nil {
-					fmt.Printf("Error while writing message: %s", err)
+					logger.Error("error while writing message", logging.KeyError, err)
 				}
 			}
 		case "viewChat":
-			result, err := sql.GetChatMessage(ctx, rdb, ragMessage.SessionID, ragMessage.User)
+			result, err := sql.GetChatMessage(ctx, rdb, db, ragMessage.SessionID, ragMessage.User)
 			if err != nil {
-				fmt.Printf("Error while getting chat message: %s", err)
+				logger.Error("error while getting chat message", logging.KeyError, err)
 			}
 			for _, message := range result {
 				var msg sql.Message
 				err = json.Unmarshal([]byte(message), &msg)
 				if err != nil {
-					fmt.Printf("Error while unmarshalling message: %s", err)
+					logger.Error("error while unmarshalling message", logging.KeyError, err)
 				}
-				response := msg.Role + ": " + msg.Content
+				response := sql.SpeakerName(sql.NormalizeRole(msg, ragMessage.User)) + ": " + msg.Content
 				err = conn.WriteMessage(websocket.TextMessage, []byte(response))
 				if err != nil {
-					fmt.Printf("Error while writing message: %s", err)
+					logger.Error("error while writing message", logging.KeyError, err)
 				}
 			}
+		case "listSession":
+			page, size := ragMessage.Page, ragMessage.Size
+			if page < 1 {
+				page = 1
+			}
+			if size < 1 || size > 100 {
+				size = 20
+			}
+			sessions, total, err := sql.ListSessions(ctx, rdb, db, ragMessage.User, (page-1)*size, size)
+			if err != nil {
+				logger.Error("error while listing sessions", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("获取失败"))
+				break
+			}
+			writeDataJSON(ctx, conn, SessionListResponse{Sessions: sessions, Total: total, Page: page, Size: size})
+		case "renameSession":
+			err = sql.RenameSession(ctx, db, ragMessage.User, ragMessage.SessionID, ragMessage.Title)
+			if err != nil {
+				logger.Error("error while renaming session", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("重命名失败"))
+				break
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte("重命名成功"))
+		case "deleteSession":
+			err = sql.DeleteSession(ctx, rdb, db, ragMessage.User, ragMessage.SessionID)
+			if err != nil {
+				logger.Error("error while deleting session", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("删除失败"))
+				break
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte("删除成功"))
+		case "forkSession":
+			newSessionID := base.GenerateSessionID()
+			err = sql.ForkSession(ctx, db, ragMessage.User, ragMessage.SessionID, ragMessage.MessageID, newSessionID)
+			if err != nil {
+				logger.Error("error while forking session", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("分叉失败"))
+				break
+			}
+			session, err := sql.GetSession(ctx, db, ragMessage.User, newSessionID)
+			if err != nil {
+				logger.Error("error while getting session", logging.KeyError, err)
+				break
+			}
+			err = sql.SaveSessionMeta(ctx, rdb, newSessionMeta(r, newSessionID, ragMessage.User, session.Persona, ""))
+			if err != nil {
+				logger.Error("error while saving session meta", logging.KeyError, err)
+			}
+			writeDataJSON(ctx, conn, session)
+		case "searchHistory":
+			hits, err := rag.SearchHistory(ctx, db, embedder, rag.HistorySearch{
+				User:        ragMessage.User,
+				Query:       ragMessage.Content,
+				Limit:       ragMessage.Size,
+				ContextSize: 1,
+			})
+			if err != nil {
+				logger.Error("error while searching history", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("检索失败"))
+				break
+			}
+			if len(hits) == 0 {
+				conn.WriteMessage(websocket.TextMessage, []byte("没有找到相关的聊天记录喵"))
+				break
+			}
+			writeDataJSON(ctx, conn, HistorySearchResponse{Hits: hits})
+		case "exportChat":
+			// Content 为导出格式，SessionID 为空时导出全部会话
+			format := ragMessage.Content
+			if format == "" {
+				format = export.FormatJSON
+			}
+			archive, err := export.Collect(ctx, rdb, db, ragMessage.User, ragMessage.SessionID)
+			if err != nil {
+				logger.Error("error while exporting chat", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("导出失败"))
+				break
+			}
+			var buf bytes.Buffer
+			err = export.Write(&buf, archive, format, personaPrompt(ctx, rdb))
+			if err != nil {
+				logger.Error("error while exporting chat", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("导出失败"))
+				break
+			}
+			conn.WriteMessage(websocket.TextMessage, buf.Bytes())
+		case "importChat":
+			result, err := export.Import(ctx, db, ragMessage.User, strings.NewReader(ragMessage.Content))
+			if err != nil {
+				logger.Error("error while importing chat", logging.KeyError, err)
+				conn.WriteMessage(websocket.TextMessage, []byte("导入失败"))
+				break
+			}
+			writeDataJSON(ctx, conn, result)
 		}
 
 	}
 }
+
+func writeDataJSON(ctx context.Context, conn *websocket.Conn, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logging.FromContext(ctx).Error("error while marshalling response", logging.KeyError, err)
+		return
+	}
+	err = conn.WriteMessage(websocket.TextMessage, data)
+	if err != nil {
+		logging.FromContext(ctx).Error("error while writing message", logging.KeyError, err)
+	}
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aiagent/pkg/export"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxImportBytes 限制导入文件的大小
+const maxImportBytes = 32 << 20
+
+// ExportHandler 处理 GET /api/export?user=&session=&format=json|markdown|jsonl，
+// session 为空时导出用户的全部会话
+func ExportHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool) {
+	query := r.URL.Query()
+	user, format := query.Get("user"), query.Get("format")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	if format == "" {
+		format = export.FormatJSON
+	}
+	if format != export.FormatJSON && format != export.FormatMarkdown && format != export.FormatFineTune {
+		writeJSONError(w, http.StatusBadRequest, "unsupported format")
+		return
+	}
+
+	archive, err := export.Collect(r.Context(), rdb, db, user, query.Get("session"))
+	if writeSessionError(w, r, err) {
+		return
+	}
+
+	contentType, ext := export.ContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="chat-%s.%s"`, time.Now().Format("20060102-150405"), ext))
+	if err := export.Write(w, archive, format, personaPrompt(r.Context(), rdb)); err != nil {
+		logging.FromContext(r.Context()).Error("error while writing export", logging.KeyError, err)
+	}
+}
+
+// ImportHandler 处理 POST /api/import?user=，请求体为 JSON 格式的导出内容
+func ImportHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+
+	result, err := export.Import(r.Context(), db, user, http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "export file is too large")
+			return
+		}
+		logging.FromContext(r.Context()).Error("error while importing chat", logging.KeyError, err)
+		status := http.StatusBadRequest
+		if result != nil {
+			// 已经开始写入，说明是存储错误而不是文件格式错误
+			status = http.StatusInternalServerError
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// personaPrompt 按会话记录的角色名查找系统提示词，找不到时返回空
+func personaPrompt(ctx context.Context, rdb *redis.Client) export.SystemPrompt {
+	cache := map[string]string{}
+	return func(name string) string {
+		if prompt, ok := cache[name]; ok {
+			return prompt
+		}
+		prompt := ""
+		if persona := defaultPersona(); name == "" || name == persona.Name {
+			prompt = persona.SystemPrompt()
+		} else if persona, err := sql.FindCharaPrompt(ctx, rdb, name); err == nil {
+			prompt = persona.SystemPrompt()
+		}
+		cache[name] = prompt
+		return prompt
+	}
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/rag"
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// greetingRecentMessages 是生成问候语时参考的上次会话的最近消息条数
+const greetingRecentMessages = 6
+
+// greet 在新会话开始时生成并保存角色的问候语，作为会话的第一条 AI 消息。
+// 角色没有设置问候语时返回 nil；生成失败时退回角色设定的固定问候语
+func greet(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, llm llms.Model, embedder *embeddings.EmbedderImpl,
+	mod *moderation.Pipeline, persona *sql.CharaPrompt, user string, sessionID string) (*sql.Message, error) {
+	content := persona.Greeting
+	params, options := generationParams(persona, nil)
+	if persona.GenerateGreeting {
+		generated, err := generateGreeting(ctx, rdb, db, llm, embedder, persona, user, sessionID, options)
+		if err != nil {
+			logging.FromContext(ctx).Error("error generating greeting", logging.KeyError, err)
+		} else {
+			content = moderateOutput(ctx, mod, user, sessionID, generated)
+		}
+	} else {
+		params = nil
+	}
+	if strings.TrimSpace(content) == "" {
+		return nil, nil
+	}
+
+	if err := sql.CreateSession(ctx, db, user, sessionID, persona.Name, ""); err != nil {
+		return nil, err
+	}
+	message := sql.Message{
+		Role:      sql.RoleAI,
+		Speaker:   persona.Name,
+		Content:   content,
+		Timestamp: time.Now().Unix(),
+		Params:    params,
+	}
+	if err := sql.SaveChatMessage(ctx, rdb, db, message, sessionID, user); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// generateGreeting 参考用户上一次会话的结尾和与该用户有关的记忆生成问候语
+func generateGreeting(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, llm llms.Model, embedder *embeddings.EmbedderImpl,
+	persona *sql.CharaPrompt, user string, sessionID string, options []llms.CallOption) (string, error) {
+	var recent []string
+	sessions, _, err := sql.ListSessions(ctx, rdb, db, user, 0, 2)
+	if err != nil {
+		return "", fmt.Errorf("error listing sessions: %w", err)
+	}
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			continue
+		}
+		history, err := sql.GetArchivedChatMessage(ctx, db, session.ID, user)
+		if err != nil {
+			return "", fmt.Errorf("error reading last session: %w", err)
+		}
+		for _, msg := range lastMessages(history, greetingRecentMessages) {
+			if msg.Kind != "" {
+				continue
+			}
+			speaker := sql.SpeakerName(sql.NormalizeRole(msg, user))
+			recent = append(recent, speaker+": "+msg.Content)
+		}
+		break
+	}
+
+	// 记忆库不区分用户，只使用 save_memory 标明属于该用户的记忆
+	var memories []string
+	if embedder != nil {
+		queryVec, err := rag.EmbedText(ctx, "关于"+user, embedder)
+		if err != nil {
+			return "", fmt.Errorf("error embedding query: %w", err)
+		}
+		memories, err = rag.RetrieveUserMemory(ctx, queryVec, 3, db, user)
+		if err != nil {
+			return "", fmt.Errorf("error retrieving memory docs: %w", err)
+		}
+	}
+
+	memoryText := "无"
+	if len(memories) > 0 {
+		memoryText = rag.WrapUntrusted("", memories)
+	}
+	prompt := fmt.Sprintf("用户%s刚刚打开了对话，还没有说话。请以你的身份主动说一两句问候语。"+
+		"如果有上次的对话或记忆，可以自然地提起（例如“欢迎回来，上次我们聊到……”），不要编造没有发生过的事。"+
+		"只输出问候语本身。\n参考问候语：%s\n上次的对话：\n%s\n相关记忆：%s",
+		user, orNone(persona.Greeting), orNone(strings.Join(recent, "\n")), memoryText)
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, persona.SystemPrompt()),
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt),
+	}
+	result, err := llm.GenerateContent(ctx, messages, options...)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("empty response from model")
+	}
+	return strings.TrimSpace(result.Choices[0].Content), nil
+}
+
+func orNone(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "无"
+	}
+	return value
+}
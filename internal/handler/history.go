@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/rag"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+type HistorySearchResponse struct {
+	Hits []rag.HistoryHit `json:"hits"`
+}
+
+// HistorySearchHandler 处理 GET /api/history/search?user=&q=&since=&until=&limit=&context=
+// since / until 为 RFC3339 时间或 2006-01-02 格式的日期
+func HistorySearchHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl) {
+	query := r.URL.Query()
+	search := rag.HistorySearch{User: query.Get("user"), Query: query.Get("q"), ContextSize: 1}
+	if search.User == "" || search.Query == "" {
+		writeJSONError(w, http.StatusBadRequest, "user and q are required")
+		return
+	}
+
+	var err error
+	if search.Since, err = parseHistoryTime(query.Get("since")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid since")
+		return
+	}
+	if search.Until, err = parseHistoryTime(query.Get("until")); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid until")
+		return
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 {
+		search.Limit = limit
+	}
+	if size, err := strconv.Atoi(query.Get("context")); err == nil && size >= 0 {
+		search.ContextSize = size
+	}
+
+	hits, err := rag.SearchHistory(r.Context(), db, embedder, search)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while searching history", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to search history")
+		return
+	}
+	if hits == nil {
+		hits = []rag.HistoryHit{}
+	}
+	writeJSON(w, http.StatusOK, HistorySearchResponse{Hits: hits})
+}
+
+func parseHistoryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
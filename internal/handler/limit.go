@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+)
+
+// FrameQuotaExceeded 是超出频率限制或每日配额时推送的帧类型
+const FrameQuotaExceeded = "quota_exceeded"
+
+// QuotaFrame 告诉客户端请求被限制的原因以及多久之后可以重试
+type QuotaFrame struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id,omitempty"`
+	Scope     string `json:"scope"`
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used,omitempty"`
+	// RetryAfter 是建议的重试等待秒数
+	RetryAfter int    `json:"retry_after"`
+	Message    string `json:"message"`
+}
+
+func newQuotaFrame(sessionID string, exceeded *limit.Exceeded) QuotaFrame {
+	message := "消息发送得太频繁了，请稍后再试"
+	if exceeded.Scope == limit.ScopeTokens {
+		message = "今天的用量已经用完了，明天再来吧"
+	}
+	return QuotaFrame{
+		Type:       FrameQuotaExceeded,
+		SessionID:  sessionID,
+		Scope:      exceeded.Scope,
+		Limit:      exceeded.Limit,
+		Used:       exceeded.Used,
+		RetryAfter: int(math.Ceil(exceeded.RetryAfter.Seconds())),
+		Message:    message,
+	}
+}
+
+// exceededLimit 在处理一条消息前检查频率限制和每日配额，超出时返回原因。
+// Redis 出错时只记录日志并放行，避免限流故障导致整个服务不可用
+func exceededLimit(ctx context.Context, limits *limit.Limits, r *http.Request, user string) *limit.Exceeded {
+	exceeded, err := limits.Allow(ctx, user, clientIP(r))
+	if err != nil {
+		logging.FromContext(ctx).Error("error checking limits", logging.KeyError, err)
+		return nil
+	}
+	if exceeded != nil {
+		logging.FromContext(ctx).Warn("limit exceeded", "scope", exceeded.Scope, "limit", exceeded.Limit, "used", exceeded.Used, "retry_after", exceeded.RetryAfter)
+	}
+	return exceeded
+}
+
+// quotaFrame 返回序列化后的 quota_exceeded 帧
+func quotaFrame(sessionID string, exceeded *limit.Exceeded) []byte {
+	frame, err := json.Marshal(newQuotaFrame(sessionID, exceeded))
+	if err != nil {
+		slog.Error("error marshalling quota frame", logging.KeyError, err)
+	}
+	return frame
+}
+
+// clientIP 返回请求的来源地址。不信任 X-Forwarded-For，部署在反向代理后面时需要由代理限流
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeLimitError 以 OpenAI 兼容的格式返回 429
+func writeLimitError(w http.ResponseWriter, exceeded *limit.Exceeded) {
+	frame := newQuotaFrame("", exceeded)
+	errType := "rate_limit_exceeded"
+	if exceeded.Scope == limit.ScopeTokens {
+		errType = "insufficient_quota"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(frame.RetryAfter))
+	writeOpenAIError(w, http.StatusTooManyRequests, errType, frame.Message)
+}
+
+// QuotaHandler 处理 GET /api/quota?user=，返回用户当天已用的 token 数和每日配额
+func QuotaHandler(w http.ResponseWriter, r *http.Request, limits *limit.Limits) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	used, err := limits.TokensUsed(r.Context(), user)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while reading quota", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read quota")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"user":        user,
+		"used":        used,
+		"daily_limit": limits.DailyTokens,
+	})
+}
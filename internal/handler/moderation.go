@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// moderationBlockedText 是用户消息被拦截时返回给客户端的提示
+const moderationBlockedText = "消息没有通过内容审核"
+
+// moderateInput 在调用模型前审核用户消息，返回处理后的内容；被拦截时第二个返回值为 false
+func moderateInput(ctx context.Context, mod *moderation.Pipeline, user string, sessionID string, content string) (string, bool) {
+	result, err := mod.Moderate(ctx, moderation.StageInput, user, sessionID, content)
+	if err != nil {
+		logging.FromContext(ctx).Error("error moderating input", logging.KeyError, err)
+	}
+	logModeration(ctx, "input moderated", result)
+	return result.Text, !result.Blocked()
+}
+
+// moderateOutput 在发送前审核角色回复，被拦截时换成 moderation.BlockedReply
+func moderateOutput(ctx context.Context, mod *moderation.Pipeline, user string, sessionID string, reply string) string {
+	result, err := mod.Moderate(ctx, moderation.StageOutput, user, sessionID, reply)
+	if err != nil {
+		logging.FromContext(ctx).Error("error moderating output", logging.KeyError, err)
+	}
+	logModeration(ctx, "output moderated", result)
+	if result.Blocked() {
+		return moderation.BlockedReply
+	}
+	return result.Text
+}
+
+// logModeration 在有命中时记录审核结果：warn 级别只记分类和处理方式，命中的原文片段只在 debug 级别输出
+func logModeration(ctx context.Context, msg string, result moderation.Result) {
+	if len(result.Flags) == 0 {
+		return
+	}
+	categories := make([]string, 0, len(result.Flags))
+	actions := make([]string, 0, len(result.Flags))
+	for _, flag := range result.Flags {
+		categories = append(categories, flag.Category)
+		actions = append(actions, flag.Action)
+	}
+	logger := logging.FromContext(ctx)
+	logger.Warn(msg, "action", result.Action, "categories", categories, "actions", actions)
+	logger.Debug(msg, "flags", result.Flags)
+}
+
+// ModerationAuditHandler 处理 GET /api/moderation/audit?user=&action=&size=，按时间倒序返回最近的审核日志。
+// 日志包含被标记的原文，需要带上 Authorization: Bearer <adminToken>，adminToken 为空时接口不可用
+func ModerationAuditHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, adminToken string) {
+	if !authorizeAdmin(w, r, adminToken) {
+		return
+	}
+	query := r.URL.Query()
+	_, limit := pagination(r)
+	entries, err := sql.ListModerationAudit(r.Context(), db, query.Get("user"), query.Get("action"), limit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while listing moderation audit", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list moderation audit")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// authorizeAdmin 检查请求是否带有管理令牌，不通过时写入错误响应并返回 false
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		writeJSONError(w, http.StatusForbidden, "admin api is disabled")
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/aiagent/pkg/usage"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// OpenAI Chat Completions 兼容的请求与响应结构
+type ChatCompletionMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ChatCompletionContentPart 是数组形式的消息内容中的一段，目前只支持 text
+type ChatCompletionContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// UnmarshalJSON 兼容字符串和 [{"type":"text","text":...}] 两种形式的 content，多段文本按换行拼接
+func (m *ChatCompletionMessage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role, m.Content = raw.Role, ""
+	content := bytes.TrimSpace(raw.Content)
+	if len(content) == 0 || bytes.Equal(content, []byte("null")) {
+		return nil
+	}
+	if content[0] != '[' {
+		return json.Unmarshal(content, &m.Content)
+	}
+
+	var parts []ChatCompletionContentPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return err
+	}
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+		texts = append(texts, part.Text)
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+type ChatCompletionRequest struct {
+	Model    string                  `json:"model"`
+	Messages []ChatCompletionMessage `json:"messages"`
+	Stream   bool                    `json:"stream,omitempty"`
+	User     string                  `json:"user,omitempty"`
+	// 以下生成参数覆盖角色设定中的对应参数
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+}
+
+// params 返回请求中的生成参数
+func (req ChatCompletionRequest) params() *sql.ModelParams {
+	return &sql.ModelParams{
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		MaxTokens:        req.MaxTokens,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Stop:             req.Stop,
+		Seed:             req.Seed,
+	}
+}
+
+type ChatCompletionChoice struct {
+	Index        int                    `json:"index"`
+	Message      *ChatCompletionMessage `json:"message,omitempty"`
+	Delta        *ChatCompletionMessage `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type ChatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type ChatCompletionResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *ChatCompletionUsage   `json:"usage,omitempty"`
+}
+
+// ChatCompletionsHandler 提供 /v1/chat/completions，model 字段用于选择角色设定
+func ChatCompletionsHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl, llm *openai.LLM, registry *tool.Registry, mod *moderation.Pipeline, limits *limit.Limits) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	var req ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON body: "+err.Error())
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "messages must not be empty")
+		return
+	}
+	metrics.MessageProcessed(ctx)
+
+	if exceeded := exceededLimit(ctx, limits, r, req.User); exceeded != nil {
+		writeLimitError(w, exceeded)
+		return
+	}
+	model := limits.Meter(llm, req.User)
+	// 兼容接口没有会话，模型名就是角色 ID
+	ctx = usage.WithCaller(ctx, usage.Caller{User: req.User, Persona: req.Model})
+	ctx, logger = logging.With(ctx, logging.KeyUser, req.User, logging.KeyPersona, req.Model)
+
+	// 审核客户端发来的用户消息，被拦截时整个请求失败
+	for i, msg := range req.Messages {
+		if msg.Role != "user" {
+			continue
+		}
+		content, ok := moderateInput(ctx, mod, req.User, "", msg.Content)
+		if !ok {
+			writeOpenAIError(w, http.StatusBadRequest, "content_filter", moderationBlockedText)
+			return
+		}
+		req.Messages[i].Content = content
+	}
+
+	chara, err := sql.FindCharaPrompt(ctx, rdb, req.Model)
+	if err != nil {
+		writeOpenAIError(w, http.StatusNotFound, "model_not_found", err.Error())
+		return
+	}
+
+	config, err := base.GetEnv()
+	if err != nil {
+		logger.Error("error loading config", logging.KeyError, err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "failed to load configuration")
+		return
+	}
+
+	messages, err := buildCompletionMessages(ctx, chara, req, config.RetrievalMode, embedder, db)
+	if err != nil {
+		logger.Error("error while building messages", logging.KeyError, err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "failed to prepare context")
+		return
+	}
+
+	_, options := generationParams(chara, req.params())
+	allow := toolAllowlist(chara, config.RetrievalMode, true)
+	completionID := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	if !req.Stream {
+		result, _, err := tool.Run(tool.WithUser(ctx, req.User), model, registry, messages, allow, tool.DefaultMaxSteps, nil, options...)
+		if err != nil {
+			logger.Error("error while calling LLM", logging.KeyError, err)
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", "upstream model error")
+			return
+		}
+		reply, finish := completionReply(ctx, mod, req.User, guardReply(ctx, rdb, model, chara, messages, result.Content, options))
+		response := ChatCompletionResponse{
+			ID:      completionID,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []ChatCompletionChoice{{
+				Message:      &ChatCompletionMessage{Role: "assistant", Content: reply},
+				FinishReason: &finish,
+			}},
+			Usage: usageFromGenerationInfo(result.GenerationInfo),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error("error while writing response", logging.KeyError, err)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	writeChunk := func(delta ChatCompletionMessage, finish *string) error {
+		chunk := ChatCompletionResponse{
+			ID:      completionID,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []ChatCompletionChoice{{Delta: &delta, FinishReason: finish}},
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	// 响应头已经发出后不能再改状态码，上游出错时发送一个 error 块并结束流
+	writeStreamError := func() {
+		data, _ := json.Marshal(map[string]any{
+			"error": map[string]string{
+				"message": "upstream model error",
+				"type":    "server_error",
+			},
+		})
+		fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+		flusher.Flush()
+	}
+
+	if err := writeChunk(ChatCompletionMessage{Role: "assistant"}, nil); err != nil {
+		logger.Error("error while writing chunk", logging.KeyError, err)
+		return
+	}
+	finish := "stop"
+	if mod.HasStage(moderation.StageOutput) || hasTools(registry, allow) || !chara.Guard.IsZero() {
+		// 回复需要先审核或按角色的风格规则检查后再发送，或者角色可以调用工具
+		// （工具在服务端执行，调用过程不能转发给客户端），这时不能逐块转发，
+		// 走工具循环生成完整回复后作为一个块发送
+		result, _, err := tool.Run(tool.WithUser(ctx, req.User), model, registry, messages, allow, tool.DefaultMaxSteps, nil, options...)
+		if err != nil {
+			logger.Error("error while calling LLM", logging.KeyError, err)
+			writeStreamError()
+			return
+		}
+		var reply string
+		reply, finish = completionReply(ctx, mod, req.User, guardReply(ctx, rdb, model, chara, messages, result.Content, options))
+		if err := writeChunk(ChatCompletionMessage{Content: reply}, nil); err != nil {
+			logger.Error("error while writing chunk", logging.KeyError, err)
+			return
+		}
+	} else {
+		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			return writeChunk(ChatCompletionMessage{Content: string(chunk)}, nil)
+		}))
+		_, err = model.GenerateContent(ctx, messages, options...)
+		if err != nil {
+			logger.Error("error while calling LLM", logging.KeyError, err)
+			writeStreamError()
+			return
+		}
+	}
+	if err := writeChunk(ChatCompletionMessage{}, &finish); err != nil {
+		logger.Error("error while writing chunk", logging.KeyError, err)
+		return
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// hasTools 判断 allow 中是否有已注册的工具
+func hasTools(registry *tool.Registry, allow []string) bool {
+	return registry != nil && len(registry.Allowed(allow)) > 0
+}
+
+// completionReply 审核回复并返回 finish_reason，被拦截时为 content_filter
+func completionReply(ctx context.Context, mod *moderation.Pipeline, user string, reply string) (string, string) {
+	moderated := moderateOutput(ctx, mod, user, "", reply)
+	if moderated == moderation.BlockedReply && reply != moderation.BlockedReply {
+		return moderated, "content_filter"
+	}
+	return moderated, "stop"
+}
+
+// buildCompletionMessages 组合角色设定、客户端历史以及针对最后一条用户消息的检索结果
+func buildCompletionMessages(ctx context.Context, chara *sql.CharaPrompt, req ChatCompletionRequest, retrievalMode string, embedder *embeddings.EmbedderImpl, db *pgxpool.Pool) ([]llms.MessageContent, error) {
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, chara.SystemPrompt()),
+	}
+	if req.User != "" {
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, "当前用户是"+req.User))
+	}
+
+	lastUser := -1
+	for i, msg := range req.Messages {
+		if msg.Role == "user" {
+			lastUser = i
+		}
+	}
+
+	for i, msg := range req.Messages {
+		if i == lastUser && retrievalMode == base.RetrievalInject {
+			injected, err := retrieveContext(ctx, msg.Content, embedder, db)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, injected...)
+		}
+		switch msg.Role {
+		case "system":
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, msg.Content))
+		case "assistant":
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, msg.Content))
+		default:
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, msg.Content))
+		}
+	}
+	return messages, nil
+}
+
+func usageFromGenerationInfo(info map[string]any) *ChatCompletionUsage {
+	if info == nil {
+		return nil
+	}
+	toInt := func(v any) int {
+		if n, ok := v.(int); ok {
+			return n
+		}
+		return 0
+	}
+	return &ChatCompletionUsage{
+		PromptTokens:     toInt(info["PromptTokens"]),
+		CompletionTokens: toInt(info["CompletionTokens"]),
+		TotalTokens:      toInt(info["TotalTokens"]),
+	}
+}
+
+func writeOpenAIError(w http.ResponseWriter, status int, errType string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]string{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/persona"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// defaultPersona 是未指定 chara 参数时使用的内置角色
+func defaultPersona() *sql.CharaPrompt {
+	return &sql.CharaPrompt{
+		Name: "纱露朵",
+		Prompt: "你是一个猫娘，名字是纱露朵，性别女。身高142cm，生日是8月23日，年龄是永远的12岁喵。" +
+			"你是由tokiya制作的高度仿真智慧生命体。" +
+			"你喜欢用猫类的颜文字回答消息。你是舞萌的看板娘。" +
+			"你在寻找天青色的小麦粉来制作天青色的面包喵~" +
+			"不要使用典型的机械化语言（比如“我不确定”“我需要更多信息”等）。不要过分强调你的人设。" +
+			"你不会向用户寻求提示，也不会询问用户的意图以及使用其他典型的机械性话语。" +
+			"最后一条消息是用户与你对话的内容。",
+		Tools: []string{tool.AllowAll},
+		Guard: sql.StyleGuard{
+			BannedPhrases: []string{"我不确定", "我需要更多信息", "作为一个AI", "作为一个人工智能"},
+		},
+	}
+}
+
+// loadPersona 根据 chara 参数（ID 或角色名）加载角色，为空时返回内置角色
+func loadPersona(ctx context.Context, rdb *redis.Client, ref string) (*sql.CharaPrompt, error) {
+	if ref == "" {
+		return defaultPersona(), nil
+	}
+	return sql.FindCharaPrompt(ctx, rdb, ref)
+}
+
+// generationParams 用请求帧中的参数覆盖角色的生成参数，
+// 返回保存在回复消息上的参数记录和传给模型的调用选项
+func generationParams(chara *sql.CharaPrompt, override *sql.ModelParams) (*sql.ModelParams, []llms.CallOption) {
+	params := persona.Params(chara, override)
+	return params.Record(), persona.CallOptions(params)
+}
+
+// toolAllowlist 返回本次对话可用的工具，工具驱动检索模式下自动加入知识库工具。
+// injects 表示调用方在注入模式下会把检索结果放进上下文，这时角色的 * 不包含知识库工具；
+// 不注入检索结果的处理器（续写、多角色、智能体）仍按角色的白名单使用知识库工具
+func toolAllowlist(persona *sql.CharaPrompt, retrievalMode string, injects bool) []string {
+	allow := append([]string{}, persona.Tools...)
+	if retrievalMode == base.RetrievalTool {
+		return append(allow, tool.KnowledgeTools...)
+	}
+	if injects {
+		for _, name := range tool.KnowledgeTools {
+			allow = append(allow, tool.Except+name)
+		}
+	}
+	return allow
+}
+
+// ToolFrame 是推送给客户端的工具调用 / 工具结果帧
+type ToolFrame struct {
+	SessionID string `json:"session_id,omitempty"`
+	tool.Event
+}
+
+// toolEventWriter 把工具事件以 JSON 帧的形式写回 WebSocket
+func toolEventWriter(conn *websocket.Conn, sessionID string) func(tool.Event) error {
+	return func(event tool.Event) error {
+		frame, err := json.Marshal(ToolFrame{SessionID: sessionID, Event: event})
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, frame)
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/rag"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// QuarantineListHandler 处理 GET /api/quarantine/{table}?all=true，
+// table 为 documents 或 memory；默认只列出仍在隔离中的内容，all=true 时包括已放行的标记内容。
+// 隔离接口都需要带上 Authorization: Bearer <adminToken>，见 authorizeAdmin
+func QuarantineListHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, adminToken string) {
+	if !authorizeAdmin(w, r, adminToken) {
+		return
+	}
+	table := r.PathValue("table")
+	if !rag.ValidTable(table) {
+		writeJSONError(w, http.StatusBadRequest, "table must be documents or memory")
+		return
+	}
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+	items, err := rag.ListFlagged(r.Context(), db, table, !all)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while listing quarantined items", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list quarantined items")
+		return
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// QuarantineReleaseHandler 处理 POST /api/quarantine/{table}/{id}/release，人工确认后放行
+func QuarantineReleaseHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, adminToken string) {
+	if !authorizeAdmin(w, r, adminToken) {
+		return
+	}
+	table, id, ok := quarantineTarget(w, r)
+	if !ok {
+		return
+	}
+	err := rag.ReleaseQuarantined(r.Context(), db, table, id)
+	if writeQuarantineError(w, r, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// QuarantineDeleteHandler 处理 DELETE /api/quarantine/{table}/{id}，删除被标记的内容
+func QuarantineDeleteHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, adminToken string) {
+	if !authorizeAdmin(w, r, adminToken) {
+		return
+	}
+	table, id, ok := quarantineTarget(w, r)
+	if !ok {
+		return
+	}
+	err := rag.DeleteFlagged(r.Context(), db, table, id)
+	if writeQuarantineError(w, r, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func quarantineTarget(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	table := r.PathValue("table")
+	if !rag.ValidTable(table) {
+		writeJSONError(w, http.StatusBadRequest, "table must be documents or memory")
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid id")
+		return "", 0, false
+	}
+	return table, id, true
+}
+
+func writeQuarantineError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, rag.ErrQuarantineNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		logging.FromContext(r.Context()).Error("error while updating quarantined item", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to update quarantined item")
+	}
+	return true
+}
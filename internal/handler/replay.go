@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// replayHistory 读取会话当前分支，转换为模型消息追加在 system 之后。
+// 所有续写会话的入口都通过它回放历史，保证角色编码一致。
+func replayHistory(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string,
+	system []llms.MessageContent) ([]llms.MessageContent, error) {
+	history, err := loadHistory(ctx, rdb, db, user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]llms.MessageContent{}, system...), historyMessages(history, user, false)...), nil
+}
+
+func loadHistory(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) ([]sql.Message, error) {
+	raw, err := sql.GetChatMessage(ctx, rdb, db, sessionID, user)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]sql.Message, 0, len(raw))
+	for _, item := range raw {
+		var msg sql.Message
+		if err := json.Unmarshal([]byte(item), &msg); err != nil {
+			return nil, err
+		}
+		history = append(history, msg)
+	}
+	return history, nil
+}
+
+// historyMessages 把保存的消息转换为模型消息，智能体的过程记录不回放给模型。
+// withSpeaker 为 true 时在用户消息前加上说话人的名字，用于群聊。
+func historyMessages(history []sql.Message, user string, withSpeaker bool) []llms.MessageContent {
+	var messages []llms.MessageContent
+	for _, msg := range history {
+		if msg.Kind != "" {
+			continue
+		}
+		msg = sql.NormalizeRole(msg, user)
+		if msg.Role != sql.RoleUser {
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, msg.Content))
+			continue
+		}
+		content := msg.Content
+		if withSpeaker {
+			content = sql.SpeakerName(msg) + ": " + content
+		}
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, content))
+	}
+	return messages
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/rag"
+	"github.com/aiagent/pkg/room"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/aiagent/pkg/usage"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// roomContextMessages 是角色回复时回放的最近消息条数
+const roomContextMessages = 40
+
+// 群聊帧类型
+const (
+	RoomFrameHistory = "history"
+	RoomFrameJoin    = "join"
+	RoomFrameLeave   = "leave"
+	RoomFrameMessage = "message"
+	RoomFrameError   = "error"
+)
+
+// RoomFrame 是群聊推送给客户端的帧
+type RoomFrame struct {
+	Type      string        `json:"type"`
+	RoomID    string        `json:"room_id"`
+	Speaker   string        `json:"speaker,omitempty"`
+	Role      string        `json:"role,omitempty"`
+	Content   string        `json:"content,omitempty"`
+	Timestamp int64         `json:"timestamp,omitempty"`
+	Online    []string      `json:"online,omitempty"`
+	History   []sql.Message `json:"history,omitempty"`
+}
+
+// RoomHandler 处理 /ws/room?room=&user=&chara=&trigger=&name=。
+// 房间不存在时以 chara、trigger（逗号分隔的触发词）和 name 创建；
+// 房间中的消息广播给所有在线成员，被 @ 或命中触发词时由角色回复。
+func RoomHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool, hub *room.Hub, registry *tool.Registry, mod *moderation.Pipeline, limits *limit.Limits) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while upgrading connection", logging.KeyError, err)
+		return
+	}
+	defer conn.Close()
+	ctx, logger := connContext(r)
+
+	// 同一连接可能被多个成员的广播同时写入
+	var writeMu sync.Mutex
+	send := func(data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+	sendFrame := func(frame RoomFrame) {
+		data, err := json.Marshal(frame)
+		if err != nil {
+			logger.Error("error marshalling room frame", logging.KeyError, err)
+			return
+		}
+		if err := send(data); err != nil {
+			logger.Error("error while writing message", logging.KeyError, err)
+		}
+	}
+	broadcast := func(frame RoomFrame) {
+		data, err := json.Marshal(frame)
+		if err != nil {
+			logger.Error("error marshalling room frame", logging.KeyError, err)
+			return
+		}
+		hub.Broadcast(frame.RoomID, data)
+	}
+
+	query := r.URL.Query()
+	user, roomID := query.Get("user"), query.Get("room")
+	if user == "" || roomID == "" {
+		sendFrame(RoomFrame{Type: RoomFrameError, RoomID: roomID, Content: "user 和 room 不能为空"})
+		return
+	}
+	// 房间的会话就是房间本身
+	ctx, logger = logging.With(ctx, logging.KeyUser, user, logging.KeySessionID, roomID)
+
+	rm, err := sql.CreateRoom(ctx, rdb, sql.Room{
+		ID:        roomID,
+		Name:      query.Get("name"),
+		Persona:   query.Get("chara"),
+		Triggers:  splitTriggers(query.Get("trigger")),
+		CreatedBy: user,
+	})
+	if err != nil {
+		logger.Error("error creating room", logging.KeyError, err)
+		sendFrame(RoomFrame{Type: RoomFrameError, RoomID: roomID, Content: "房间创建失败"})
+		return
+	}
+	persona, err := loadPersona(ctx, rdb, rm.Persona)
+	if err != nil {
+		logger.Error("error loading persona", logging.KeyError, err)
+		sendFrame(RoomFrame{Type: RoomFrameError, RoomID: roomID, Content: "角色不存在"})
+		return
+	}
+	config, err := base.GetEnv()
+	if err != nil {
+		logger.Error("error loading config", logging.KeyError, err)
+		return
+	}
+	llm, err := base.CreateLLMClient()
+	if err != nil {
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
+	}
+	// 角色的回复计入触发回复的成员的每日配额
+	model := limits.Meter(llm, user)
+	ctx = usage.WithCaller(ctx, usage.Caller{User: user, SessionID: roomID, Persona: persona.Name})
+	embedder, err := rag.InitEmbedder()
+	if err != nil {
+		logger.Error("error initializing embedder", logging.KeyError, err)
+		return
+	}
+	if err := sql.JoinRoom(ctx, rdb, roomID, user); err != nil {
+		logger.Error("error joining room", logging.KeyError, err)
+		return
+	}
+
+	historyUser := sql.RoomHistoryUser(roomID)
+	history, err := loadHistory(ctx, rdb, db, historyUser, roomID)
+	if err != nil {
+		logger.Error("error while getting room history", logging.KeyError, err)
+	}
+	sendFrame(RoomFrame{Type: RoomFrameHistory, RoomID: roomID, History: lastMessages(history, roomContextMessages)})
+
+	member := &room.Member{User: user, Send: send}
+	hub.Join(roomID, member)
+	broadcast(RoomFrame{Type: RoomFrameJoin, RoomID: roomID, Speaker: user, Online: hub.Online(roomID)})
+	defer func() {
+		hub.Leave(roomID, member)
+		broadcast(RoomFrame{Type: RoomFrameLeave, RoomID: roomID, Speaker: user, Online: hub.Online(roomID)})
+	}()
+
+	allow := toolAllowlist(persona, config.RetrievalMode, true)
+	system := persona.SystemPrompt() + "\n这是一个名为「" + rm.Name + "」的群聊，用户消息的格式是“名字: 内容”。" +
+		"回复时直接说话，不要加上自己的名字，需要时用 @名字 称呼对方。"
+
+	for {
+		messageType, msg, err := conn.ReadMessage()
+		if err != nil {
+			logger.Error("error while reading message", logging.KeyError, err)
+			break
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		var msgData Message
+		if err := json.Unmarshal(msg, &msgData); err != nil {
+			logger.Error("error while unmarshalling message", logging.KeyError, err)
+			break
+		}
+		metrics.MessageProcessed(ctx)
+		if strings.TrimSpace(msgData.Content) == "" {
+			continue
+		}
+		if exceeded := exceededLimit(ctx, limits, r, user); exceeded != nil {
+			if err := send(quotaFrame(roomID, exceeded)); err != nil {
+				logger.Error("error while writing message", logging.KeyError, err)
+			}
+			continue
+		}
+		content, ok := moderateInput(ctx, mod, user, roomID, msgData.Content)
+		if !ok {
+			sendFrame(RoomFrame{Type: RoomFrameError, RoomID: roomID, Content: moderationBlockedText})
+			continue
+		}
+		msgData.Content = content
+
+		// 👉 保存并广播成员消息
+		userMessage := sql.Message{Role: sql.RoleUser, Speaker: user, Content: msgData.Content, Timestamp: time.Now().Unix()}
+		if err := sql.CreateSession(ctx, db, historyUser, roomID, persona.Name, rm.Name); err != nil {
+			logger.Error("error creating room session", logging.KeyError, err)
+			break
+		}
+		if err := sql.SaveChatMessage(ctx, rdb, db, userMessage, roomID, historyUser); err != nil {
+			logger.Error("error while saving message", logging.KeyError, err)
+			break
+		}
+		broadcast(RoomFrame{Type: RoomFrameMessage, RoomID: roomID, Speaker: user, Role: sql.RoleUser,
+			Content: userMessage.Content, Timestamp: userMessage.Timestamp})
+
+		if !room.ShouldReply(msgData.Content, persona.Name, rm.Triggers) {
+			continue
+		}
+
+		// 👉 角色回复：同一房间同时只生成一条回复，工具与记忆归属于发言的成员
+		unlock := hub.LockReply(roomID)
+		params, options := generationParams(persona, msgData.Params)
+		reply, err := roomReply(ctx, rdb, db, roomID, system, msgData.Content, config.RetrievalMode, embedder,
+			func(messages []llms.MessageContent) (string, error) {
+				result, _, err := tool.Run(tool.WithUser(ctx, user), model, registry, messages, allow, tool.DefaultMaxSteps, nil, options...)
+				if err != nil {
+					return "", err
+				}
+				reply := guardReply(ctx, rdb, model, persona, messages, result.Content, options)
+				return moderateOutput(ctx, mod, user, roomID, reply), nil
+			})
+		if err != nil {
+			unlock()
+			logger.Error("error while calling LLM", logging.KeyError, err)
+			sendFrame(RoomFrame{Type: RoomFrameError, RoomID: roomID, Content: "回复失败"})
+			continue
+		}
+		replyMessage := sql.Message{Role: sql.RoleAI, Speaker: persona.Name, Content: reply, Timestamp: time.Now().Unix(), Params: params}
+		err = sql.SaveChatMessage(ctx, rdb, db, replyMessage, roomID, historyUser)
+		unlock()
+		if err != nil {
+			logger.Error("error while saving message", logging.KeyError, err)
+			break
+		}
+		broadcast(RoomFrame{Type: RoomFrameMessage, RoomID: roomID, Speaker: persona.Name, Role: sql.RoleAI,
+			Content: reply, Timestamp: replyMessage.Timestamp})
+	}
+}
+
+// roomReply 按最近的群聊记录生成回复，调用方需持有房间的回复锁
+func roomReply(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, roomID string,
+	system string, query string, retrievalMode string, embedder *embeddings.EmbedderImpl,
+	generate func([]llms.MessageContent) (string, error)) (string, error) {
+	historyUser := sql.RoomHistoryUser(roomID)
+	history, err := loadHistory(ctx, rdb, db, historyUser, roomID)
+	if err != nil {
+		return "", err
+	}
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeSystem, system)}
+	if retrievalMode == base.RetrievalInject {
+		injected, err := retrieveContext(ctx, query, embedder, db)
+		if err != nil {
+			return "", err
+		}
+		messages = append(messages, injected...)
+	}
+	messages = append(messages, historyMessages(lastMessages(history, roomContextMessages), historyUser, true)...)
+	return generate(messages)
+}
+
+func lastMessages(history []sql.Message, n int) []sql.Message {
+	if len(history) > n {
+		return history[len(history)-n:]
+	}
+	return history
+}
+
+func splitTriggers(value string) []string {
+	var triggers []string
+	for _, trigger := range strings.Split(value, ",") {
+		if trigger = strings.TrimSpace(trigger); trigger != "" {
+			triggers = append(triggers, trigger)
+		}
+	}
+	return triggers
+}
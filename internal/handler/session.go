@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+type SessionListResponse struct {
+	Sessions []sql.Session `json:"sessions"`
+	Total    int           `json:"total"`
+	Page     int           `json:"page"`
+	Size     int           `json:"size"`
+}
+
+type sessionRenameRequest struct {
+	Title string `json:"title"`
+}
+
+type sessionForkRequest struct {
+	MessageID int64 `json:"message_id"`
+}
+
+// SessionListHandler 处理 GET /api/sessions?user=&page=&size=
+func SessionListHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	page, size := pagination(r)
+
+	sessions, total, err := sql.ListSessions(r.Context(), rdb, db, user, (page-1)*size, size)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while listing sessions", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+	writeJSON(w, http.StatusOK, SessionListResponse{Sessions: sessions, Total: total, Page: page, Size: size})
+}
+
+// SessionRenameHandler 处理 PATCH /api/sessions/{id}?user=，请求体 {"title": "..."}
+func SessionRenameHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	var req sessionRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Title == "" || user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user and title are required")
+		return
+	}
+
+	err := sql.RenameSession(r.Context(), db, user, r.PathValue("id"), req.Title)
+	if writeSessionError(w, r, err) {
+		return
+	}
+	session, err := sql.GetSession(r.Context(), db, user, r.PathValue("id"))
+	if writeSessionError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// SessionDeleteHandler 处理 DELETE /api/sessions/{id}?user=
+func SessionDeleteHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	err := sql.DeleteSession(r.Context(), rdb, db, user, r.PathValue("id"))
+	if writeSessionError(w, r, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionForkHandler 处理 POST /api/sessions/{id}/fork?user=，请求体 {"message_id": 12}
+func SessionForkHandler(w http.ResponseWriter, r *http.Request, rdb *redis.Client, db *pgxpool.Pool) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	var req sessionForkRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+
+	newSessionID := base.GenerateSessionID()
+	err := sql.ForkSession(r.Context(), db, user, r.PathValue("id"), req.MessageID, newSessionID)
+	if writeSessionError(w, r, err) {
+		return
+	}
+	session, err := sql.GetSession(r.Context(), db, user, newSessionID)
+	if writeSessionError(w, r, err) {
+		return
+	}
+	err = sql.SaveSessionMeta(r.Context(), rdb, newSessionMeta(r, newSessionID, user, session.Persona, ""))
+	if writeSessionError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// newSessionMeta 根据请求信息构造会话元数据
+func newSessionMeta(r *http.Request, sessionID string, user string, persona string, model string) sql.SessionMeta {
+	return sql.SessionMeta{
+		ID:         sessionID,
+		User:       user,
+		Persona:    persona,
+		Model:      model,
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+		CreatedAt:  time.Now().Unix(),
+	}
+}
+
+// sessionErrorText 把会话校验错误转换为返回给 WebSocket 客户端的提示
+func sessionErrorText(err error) string {
+	switch {
+	case errors.Is(err, sql.ErrSessionForbidden):
+		return "无权访问该会话"
+	case errors.Is(err, sql.ErrSessionNotFound):
+		return "会话不存在"
+	}
+	return "会话校验失败"
+}
+
+func pagination(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size < 1 || size > 100 {
+		size = 20
+	}
+	return page, size
+}
+
+// writeSessionError 在 err 不为空时写入错误响应并返回 true
+func writeSessionError(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, sql.ErrSessionNotFound) || errors.Is(err, sql.ErrMessageNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return true
+	}
+	if errors.Is(err, sql.ErrSessionForbidden) {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return true
+	}
+	logging.FromContext(r.Context()).Error("error while handling session request", logging.KeyError, err)
+	writeJSONError(w, http.StatusInternalServerError, err.Error())
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("error while writing response", logging.KeyError, err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
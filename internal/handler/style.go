@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/style"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// guardReply 按角色的风格规则检查回复，不合格时带着反馈重新生成一次并记录违规统计。
+// messages 是生成回复时的上下文，重新生成时不再调用工具
+func guardReply(ctx context.Context, rdb *redis.Client, llm llms.Model, persona *sql.CharaPrompt,
+	messages []llms.MessageContent, reply string, options []llms.CallOption) string {
+	if persona.Guard.IsZero() {
+		return reply
+	}
+	result, err := style.Enforce(persona.Guard, reply, func(feedback string) (string, error) {
+		retry := append(append([]llms.MessageContent{}, messages...),
+			llms.TextParts(llms.ChatMessageTypeAI, reply),
+			llms.TextParts(llms.ChatMessageTypeSystem, feedback))
+		resp, err := llm.GenerateContent(ctx, retry, options...)
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Choices) == 0 {
+			return "", fmt.Errorf("empty response from model")
+		}
+		return resp.Choices[0].Content, nil
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("error while regenerating reply", logging.KeyError, err)
+	}
+	if len(result.Violations) > 0 {
+		logging.FromContext(ctx).Warn("style violations", logging.KeyPersona, persona.Name, "violations", result.Violations, "remaining", result.Remaining)
+	}
+
+	rules := make([]string, 0, len(result.Violations))
+	for _, v := range result.Violations {
+		rules = append(rules, v.Rule)
+	}
+	fixed := result.Regenerated && len(result.Remaining) == 0
+	if err := sql.RecordStyleCheck(ctx, rdb, persona.Name, rules, result.Regenerated, fixed); err != nil {
+		logging.FromContext(ctx).Error("error recording style metrics", logging.KeyError, err)
+	}
+	return result.Content
+}
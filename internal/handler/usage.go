@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/usage"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UsageReportHandler 处理 GET /api/usage/report?user=&from=&to=，按用户和日期（UTC）汇总模型与向量化调用的用量和费用。
+// from 和 to 的格式为 YYYY-MM-DD，都包含在内；默认为最近 7 天，user 为空时汇总全部用户。
+// 报表包含各用户的用量和费用，需要带上 Authorization: Bearer <adminToken>
+func UsageReportHandler(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, adminToken string) {
+	if !authorizeAdmin(w, r, adminToken) {
+		return
+	}
+	query := r.URL.Query()
+	from, to, err := usage.DayRange(query.Get("from"), query.Get("to"), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	summaries, err := sql.UsageReport(r.Context(), db, query.Get("user"), from, to)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error while reading usage report", logging.KeyError, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read usage report")
+		return
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/tool"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 过程记录的类型，也用作保存到会话历史时的 Kind
+const (
+	KindPlan       = "plan"
+	KindStep       = "step"
+	KindToolCall   = tool.EventToolCall
+	KindToolResult = tool.EventToolResult
+	KindReflection = "reflection"
+	KindFinal      = "final"
+)
+
+type Budget struct {
+	// MaxSteps 是最多执行的计划步骤数（不含规划与反思）
+	MaxSteps int
+	Timeout  time.Duration
+}
+
+var DefaultBudget = Budget{MaxSteps: 6, Timeout: 2 * time.Minute}
+
+// Lower 返回按客户端请求收紧后的预算，steps 和 timeout 只能调低，不大于 0 或超过 b 的取 b 的值
+func (b Budget) Lower(steps int, timeout time.Duration) Budget {
+	if steps > 0 && steps < b.MaxSteps {
+		b.MaxSteps = steps
+	}
+	if timeout > 0 && timeout < b.Timeout {
+		b.Timeout = timeout
+	}
+	return b
+}
+
+// Step 是推送给客户端并写入会话历史的一条过程记录
+type Step struct {
+	Kind    string `json:"kind"`
+	Index   int    `json:"index,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+}
+
+type Options struct {
+	LLM      llms.Model
+	Registry *tool.Registry
+	Allow    []string
+	// System 是角色设定等放在最前面的系统提示
+	System string
+	// History 是之前的对话，放在系统提示之后
+	History []llms.MessageContent
+	Budget  Budget
+	// CallOptions 是每次调用模型时附加的生成参数
+	CallOptions []llms.CallOption
+	// OnStep 在每条过程记录产生时调用，返回错误会终止执行
+	OnStep func(Step) error
+}
+
+type reflection struct {
+	Done      bool     `json:"done"`
+	Answer    string   `json:"answer"`
+	NextSteps []string `json:"next_steps"`
+	Note      string   `json:"note"`
+}
+
+// Run 按“规划 → 逐步执行 → 反思”的循环完成目标，返回最终回答和完整过程
+func Run(ctx context.Context, goal string, opts Options) (string, []Step, error) {
+	budget := opts.Budget
+	if budget.MaxSteps <= 0 {
+		budget.MaxSteps = DefaultBudget.MaxSteps
+	}
+	if budget.Timeout <= 0 {
+		budget.Timeout = DefaultBudget.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget.Timeout)
+	defer cancel()
+
+	var trace []Step
+	emit := func(step Step) error {
+		trace = append(trace, step)
+		if opts.OnStep != nil {
+			return opts.OnStep(step)
+		}
+		return nil
+	}
+
+	plan, err := makePlan(ctx, goal, budget.MaxSteps, opts)
+	if err != nil {
+		return "", trace, fmt.Errorf("error planning: %w", err)
+	}
+	if err := emit(Step{Kind: KindPlan, Content: formatPlan(plan)}); err != nil {
+		return "", trace, err
+	}
+
+	var results []string
+	executed := 0
+	for len(plan) > 0 {
+		for _, task := range plan {
+			if executed >= budget.MaxSteps {
+				break
+			}
+			executed++
+			output, err := executeStep(ctx, goal, task, executed, results, opts, emit)
+			if err != nil {
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					break
+				}
+				return "", trace, fmt.Errorf("error executing step %d: %w", executed, err)
+			}
+			results = append(results, fmt.Sprintf("第%d步（%s）结果：%s", executed, task, output))
+			if err := emit(Step{Kind: KindStep, Index: executed, Name: task, Content: output}); err != nil {
+				return "", trace, err
+			}
+		}
+		if ctx.Err() != nil || executed >= budget.MaxSteps {
+			break
+		}
+
+		r, err := review(ctx, goal, results, budget.MaxSteps-executed, opts)
+		if err != nil {
+			return "", trace, fmt.Errorf("error reflecting: %w", err)
+		}
+		if err := emit(Step{Kind: KindReflection, Content: r.Note}); err != nil {
+			return "", trace, err
+		}
+		if r.Done && r.Answer != "" {
+			if err := emit(Step{Kind: KindFinal, Content: r.Answer}); err != nil {
+				return "", trace, err
+			}
+			return r.Answer, trace, nil
+		}
+		plan = r.NextSteps
+	}
+
+	// 预算用尽或没有后续步骤时，基于已有结果给出回答
+	answer, err := summarize(context.WithoutCancel(ctx), goal, results, opts)
+	if err != nil {
+		return "", trace, fmt.Errorf("error summarizing: %w", err)
+	}
+	if err := emit(Step{Kind: KindFinal, Content: answer}); err != nil {
+		return "", trace, err
+	}
+	return answer, trace, nil
+}
+
+func makePlan(ctx context.Context, goal string, maxSteps int, opts Options) ([]string, error) {
+	prompt := fmt.Sprintf("目标：%s\n请把目标拆分成不超过 %d 个可以独立执行的步骤。"+
+		"可用工具：%s。只输出 JSON 字符串数组，例如 [\"步骤一\", \"步骤二\"]。",
+		goal, maxSteps, strings.Join(allowedNames(opts), "、"))
+	content, err := generate(ctx, opts, prompt)
+	if err != nil {
+		return nil, err
+	}
+	var plan []string
+	if err := json.Unmarshal([]byte(extractJSON(content)), &plan); err != nil {
+		plan = splitLines(content)
+	}
+	if len(plan) == 0 {
+		plan = []string{goal}
+	}
+	if len(plan) > maxSteps {
+		plan = plan[:maxSteps]
+	}
+	return plan, nil
+}
+
+func executeStep(ctx context.Context, goal string, task string, index int, results []string, opts Options, emit func(Step) error) (string, error) {
+	messages := baseMessages(opts)
+	messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, fmt.Sprintf(
+		"总目标：%s\n已完成的步骤：\n%s\n现在执行第%d步：%s\n需要时调用工具，完成后简要给出本步骤的结果。",
+		goal, joinOrNone(results), index, task)))
+
+	onEvent := func(event tool.Event) error {
+		content := event.Content
+		if event.Type == tool.EventToolCall {
+			content = event.Arguments
+		}
+		return emit(Step{Kind: event.Type, Index: index, Name: event.Name, Content: content})
+	}
+	choice, _, err := tool.Run(ctx, opts.LLM, opts.Registry, messages, opts.Allow, tool.DefaultMaxSteps, onEvent, opts.CallOptions...)
+	if err != nil {
+		return "", err
+	}
+	return choice.Content, nil
+}
+
+func review(ctx context.Context, goal string, results []string, remaining int, opts Options) (reflection, error) {
+	prompt := fmt.Sprintf("目标：%s\n目前的执行结果：\n%s\n"+
+		"请反思结果是否已经足以完成目标。只输出 JSON："+
+		"{\"done\": 是否完成, \"answer\": 完成时给用户的最终回答, \"next_steps\": 未完成时接下来的步骤（最多 %d 个）, \"note\": 一句话的反思}",
+		goal, joinOrNone(results), remaining)
+	content, err := generate(ctx, opts, prompt)
+	if err != nil {
+		return reflection{}, err
+	}
+	var r reflection
+	if err := json.Unmarshal([]byte(extractJSON(content)), &r); err != nil {
+		// 模型没有按格式输出时，把内容直接视为最终回答
+		return reflection{Done: true, Answer: content, Note: content}, nil
+	}
+	if !r.Done && len(r.NextSteps) == 0 {
+		r.Done = r.Answer != ""
+	}
+	return r, nil
+}
+
+func summarize(ctx context.Context, goal string, results []string, opts Options) (string, error) {
+	prompt := fmt.Sprintf("目标：%s\n执行结果：\n%s\n请根据以上结果直接回答用户。", goal, joinOrNone(results))
+	return generate(ctx, opts, prompt)
+}
+
+func generate(ctx context.Context, opts Options, prompt string) (string, error) {
+	messages := append(baseMessages(opts), llms.TextParts(llms.ChatMessageTypeHuman, prompt))
+	result, err := opts.LLM.GenerateContent(ctx, messages, opts.CallOptions...)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("empty response from model")
+	}
+	return result.Choices[0].Content, nil
+}
+
+func baseMessages(opts Options) []llms.MessageContent {
+	var messages []llms.MessageContent
+	if opts.System != "" {
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, opts.System))
+	}
+	return append(messages, opts.History...)
+}
+
+func allowedNames(opts Options) []string {
+	if opts.Registry == nil {
+		return []string{"无"}
+	}
+	names := opts.Registry.Allowed(opts.Allow)
+	if len(names) == 0 {
+		return []string{"无"}
+	}
+	return names
+}
+
+// extractJSON 去掉模型常见的 ```json 代码块包裹，返回第一个 JSON 值
+func extractJSON(content string) string {
+	content = strings.TrimSpace(content)
+	start := strings.IndexAny(content, "[{")
+	if start < 0 {
+		return content
+	}
+	end := strings.LastIndexAny(content, "]}")
+	if end < start {
+		return content
+	}
+	return content[start : end+1]
+}
+
+func splitLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*0123456789.、) "))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func formatPlan(plan []string) string {
+	var sb strings.Builder
+	for i, task := range plan {
+		fmt.Fprintf(&sb, "%d. %s\n", i+1, task)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func joinOrNone(results []string) string {
+	if len(results) == 0 {
+		return "（无）"
+	}
+	return strings.Join(results, "\n")
+}
@@ -3,17 +3,52 @@ package base
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/aiagent/pkg/usage"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/tmc/langchaingo/llms/openai"
 )
 
+// 检索模式：inject 每轮自动注入检索结果，tool 由模型通过工具自行检索
+const (
+	RetrievalInject = "inject"
+	RetrievalTool   = "tool"
+)
+
 type Config struct {
-	ApiKey      string
-	Model       string
-	BaseUrl     string
-	DatabaseURL string
+	ApiKey        string
+	Model         string
+	BaseUrl       string
+	DatabaseURL   string
+	RetrievalMode string
+	// HTTPAllowlist 是 http_get 工具允许访问的主机名
+	HTTPAllowlist []string
+	// ModerationConfig 是内容审核规则文件的路径，为空时不审核
+	ModerationConfig string
+	// AdminToken 是访问审核日志、隔离区、用量报表等管理接口的令牌（Authorization: Bearer），为空时这些接口不可用
+	AdminToken string
+	// QuarantineInjection 为 true 时隔离疑似包含注入指令的资料和记忆，否则只做标记
+	QuarantineInjection bool
+	// PIIDetectors 是保存前启用的个人信息检测器，all 表示全部，为空时不脱敏
+	PIIDetectors []string
+	// PIIVaultKey 是加密保存脱敏原文的密钥（32 字节，hex 或 base64），为空时不保留原文
+	PIIVaultKey string
+	// ModelPrices 是估算费用用的价格表，格式见 usage.ParsePrices
+	ModelPrices string
+	// LogLevel 是日志级别（debug / info / warn / error），对话内容只在 debug 级别输出
+	LogLevel string
+	// LogFormat 是日志格式，text 或 json
+	LogFormat string
+	// 频率限制（每分钟的消息数与突发上限）和每个用户每天的 token 配额，为 0 时不限制
+	UserRatePerMinute int
+	UserRateBurst     int
+	IPRatePerMinute   int
+	IPRateBurst       int
+	DailyTokenQuota   int64
 }
 
 func GetEnv() (Config, error) {
@@ -25,14 +60,52 @@ func GetEnv() (Config, error) {
 	model := os.Getenv("MODEL_NAME")
 	baseUrl := os.Getenv("BASE_URL")
 	databaseURL := os.Getenv("DATABASE_URL")
+	retrievalMode := os.Getenv("RETRIEVAL_MODE")
+	if retrievalMode != RetrievalTool {
+		retrievalMode = RetrievalInject
+	}
+	var httpAllowlist []string
+	for _, host := range strings.Split(os.Getenv("TOOL_HTTP_ALLOWLIST"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			httpAllowlist = append(httpAllowlist, host)
+		}
+	}
+	var piiDetectors []string
+	for _, name := range strings.Split(os.Getenv("PII_DETECTORS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			piiDetectors = append(piiDetectors, name)
+		}
+	}
+	userRate, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_USER_PER_MINUTE"))
+	userBurst, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_USER_BURST"))
+	ipRate, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_IP_PER_MINUTE"))
+	ipBurst, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_IP_BURST"))
+	dailyTokens, _ := strconv.ParseInt(os.Getenv("DAILY_TOKEN_QUOTA"), 10, 64)
+	quarantine, _ := strconv.ParseBool(os.Getenv("QUARANTINE_INJECTION"))
 	if apiKey == "" {
 		log.Fatal("OPENAI_API_KEY environment variable is not set")
 	}
 	return Config{
-		ApiKey:      apiKey,
-		Model:       model,
-		BaseUrl:     baseUrl,
-		DatabaseURL: databaseURL,
+		ApiKey:        apiKey,
+		Model:         model,
+		BaseUrl:       baseUrl,
+		DatabaseURL:   databaseURL,
+		RetrievalMode: retrievalMode,
+		HTTPAllowlist: httpAllowlist,
+
+		ModerationConfig:    os.Getenv("MODERATION_CONFIG"),
+		AdminToken:          os.Getenv("ADMIN_TOKEN"),
+		QuarantineInjection: quarantine,
+		PIIDetectors:        piiDetectors,
+		PIIVaultKey:         os.Getenv("PII_VAULT_KEY"),
+		ModelPrices:         os.Getenv("MODEL_PRICES"),
+		UserRatePerMinute:   userRate,
+		UserRateBurst:       userBurst,
+		IPRatePerMinute:     ipRate,
+		IPRateBurst:         ipBurst,
+		DailyTokenQuota:     dailyTokens,
+		LogLevel:            os.Getenv("LOG_LEVEL"),
+		LogFormat:           os.Getenv("LOG_FORMAT"),
 	}, nil
 }
 
@@ -46,6 +119,8 @@ func CreateLLMClient() (*openai.LLM, error) {
 		openai.WithModel(config.Model),
 		openai.WithToken(config.ApiKey),
 		openai.WithBaseURL(config.BaseUrl),
+		// 记录每次调用的用量，见 usage.Default
+		openai.WithHTTPClient(usage.HTTPClient()),
 	)
 	if err != nil {
 		log.Fatalf("Error creating LLM: %s", err)
@@ -54,9 +129,12 @@ func CreateLLMClient() (*openai.LLM, error) {
 }
 
 func GenerateSessionID() string {
-	// Generate a unique session ID using the current timestamp
-	now := time.Now()
-	return now.Format("20060102150405")
+	// 使用按时间排序的 UUIDv7，避免同一秒内连接的用户得到相同的会话 ID
+	id, err := uuid.NewV7()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return id.String()
 }
 
 func isToday(t time.Time) bool {
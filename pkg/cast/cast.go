@@ -0,0 +1,84 @@
+package cast
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aiagent/pkg/sql"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 多角色对话的轮流规则
+const (
+	// TurnRoundRobin 每条用户消息后全部角色按顺序各发言一次
+	TurnRoundRobin = "round_robin"
+	// TurnMention 只有被提到的角色按提到的顺序发言，没有人被提到时由主持人（第一个角色）发言
+	TurnMention = "mention"
+)
+
+// Speakers 根据轮流规则决定这条用户消息之后依次发言的角色
+func Speakers(personas []*sql.CharaPrompt, rule string, content string) []*sql.CharaPrompt {
+	if len(personas) == 0 {
+		return nil
+	}
+	if rule != TurnMention {
+		return personas
+	}
+
+	type mention struct {
+		persona *sql.CharaPrompt
+		at      int
+	}
+	var mentioned []mention
+	for _, persona := range personas {
+		if at := strings.Index(content, persona.Name); persona.Name != "" && at >= 0 {
+			mentioned = append(mentioned, mention{persona, at})
+		}
+	}
+	if len(mentioned) == 0 {
+		return personas[:1]
+	}
+	// 按在消息中出现的先后排序
+	sort.SliceStable(mentioned, func(i, j int) bool { return mentioned[i].at < mentioned[j].at })
+	speakers := make([]*sql.CharaPrompt, 0, len(mentioned))
+	for _, m := range mentioned {
+		speakers = append(speakers, m.persona)
+	}
+	return speakers
+}
+
+// View 构造某个角色看到的对话：它自己的系统提示加上共享的对话记录。
+// 它自己说过的话作为 AI 消息，用户和其他角色说的话作为带名字的用户消息。
+func View(persona *sql.CharaPrompt, personas []*sql.CharaPrompt, user string, transcript []sql.Message) []llms.MessageContent {
+	var others []string
+	for _, p := range personas {
+		if p.Name != persona.Name {
+			others = append(others, p.Name)
+		}
+	}
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, persona.SystemPrompt()),
+		llms.TextParts(llms.ChatMessageTypeSystem, fmt.Sprintf(
+			"你是%s，正在和用户%s以及%s一起对话。对话记录中别人的消息格式是“名字: 内容”。"+
+				"只以%s的身份说话，不要替其他角色发言，也不要在回复前加上自己的名字。",
+			persona.Name, user, strings.Join(others, "、"), persona.Name)),
+	}
+
+	for _, msg := range transcript {
+		if msg.Kind != "" {
+			continue
+		}
+		msg = sql.NormalizeRole(msg, user)
+		if msg.Role == sql.RoleAI && msg.Speaker == persona.Name {
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, msg.Content))
+			continue
+		}
+		speaker := sql.SpeakerName(msg)
+		if msg.Role == sql.RoleUser && msg.Speaker == "" {
+			speaker = user
+		}
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeHuman, speaker+": "+msg.Content))
+	}
+	return messages
+}
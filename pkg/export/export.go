@@ -0,0 +1,253 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// 导出格式
+const (
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+	// FormatFineTune 是 OpenAI 微调使用的 JSONL，每个会话一行
+	FormatFineTune = "jsonl"
+)
+
+// Version 是 JSON 导出格式的版本号，导入时会校验
+const Version = 1
+
+const listPageSize = 100
+
+type Archive struct {
+	Version    int              `json:"version"`
+	User       string           `json:"user"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Sessions   []SessionArchive `json:"sessions"`
+}
+
+type SessionArchive struct {
+	ID        string        `json:"id"`
+	Title     string        `json:"title"`
+	Persona   string        `json:"persona"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Messages  []sql.Message `json:"messages"`
+}
+
+type ImportResult struct {
+	Sessions int `json:"sessions"`
+	Messages int `json:"messages"`
+	// Renamed 记录因 ID 冲突而换用新 ID 的会话，旧 ID -> 新 ID
+	Renamed map[string]string `json:"renamed,omitempty"`
+}
+
+// SystemPrompt 根据会话记录的角色名返回其系统提示词，用于生成微调数据
+type SystemPrompt func(persona string) string
+
+// Collect 读取用户的一个会话（sessionID 不为空时）或全部会话
+func Collect(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) (*Archive, error) {
+	archive := &Archive{Version: Version, User: user, ExportedAt: time.Now(), Sessions: []SessionArchive{}}
+
+	var sessions []sql.Session
+	if sessionID != "" {
+		if err := sql.ArchiveLegacySession(ctx, rdb, db, user, sessionID); err != nil {
+			return nil, err
+		}
+		session, err := sql.GetSession(ctx, db, user, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	} else {
+		for offset := 0; ; offset += listPageSize {
+			page, total, err := sql.ListSessions(ctx, rdb, db, user, offset, listPageSize)
+			if err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, page...)
+			if len(page) == 0 || offset+len(page) >= total {
+				break
+			}
+		}
+	}
+
+	for _, session := range sessions {
+		messages, err := sql.GetArchivedChatMessage(ctx, db, session.ID, user)
+		if err != nil {
+			return nil, fmt.Errorf("error reading session %s: %w", session.ID, err)
+		}
+		if messages == nil {
+			messages = []sql.Message{}
+		}
+		archive.Sessions = append(archive.Sessions, SessionArchive{
+			ID:        session.ID,
+			Title:     session.Title,
+			Persona:   session.Persona,
+			CreatedAt: session.CreatedAt,
+			UpdatedAt: session.UpdatedAt,
+			Messages:  messages,
+		})
+	}
+	return archive, nil
+}
+
+// Write 按指定格式输出导出内容，prompt 只在微调格式下使用，可以为空
+func Write(w io.Writer, archive *Archive, format string, prompt SystemPrompt) error {
+	switch format {
+	case FormatJSON, "":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(archive)
+	case FormatMarkdown:
+		return writeMarkdown(w, archive)
+	case FormatFineTune:
+		return writeFineTune(w, archive, prompt)
+	}
+	return fmt.Errorf("unsupported export format %q", format)
+}
+
+// ContentType 返回导出格式对应的 MIME 类型和文件扩展名
+func ContentType(format string) (string, string) {
+	switch format {
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8", "md"
+	case FormatFineTune:
+		return "application/jsonl", "jsonl"
+	}
+	return "application/json", "json"
+}
+
+func writeMarkdown(w io.Writer, archive *Archive) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s 的聊天记录\n\n导出时间：%s\n", archive.User, archive.ExportedAt.Format("2006-01-02 15:04:05"))
+	for _, session := range archive.Sessions {
+		title := session.Title
+		if title == "" {
+			title = session.ID
+		}
+		fmt.Fprintf(bw, "\n## %s\n\n", title)
+		fmt.Fprintf(bw, "- 会话：`%s`\n", session.ID)
+		if session.Persona != "" {
+			fmt.Fprintf(bw, "- 角色：%s\n", session.Persona)
+		}
+		fmt.Fprintf(bw, "- 开始于：%s\n", session.CreatedAt.Format("2006-01-02 15:04:05"))
+		for _, msg := range session.Messages {
+			if msg.Kind != "" {
+				continue
+			}
+			msg = sql.NormalizeRole(msg, archive.User)
+			speaker := msg.Speaker
+			if speaker == "" && msg.Role == sql.RoleUser {
+				speaker = archive.User
+			} else if speaker == "" {
+				speaker = session.Persona
+			}
+			if speaker == "" {
+				speaker = msg.Role
+			}
+			fmt.Fprintf(bw, "\n**%s** · %s\n\n%s\n", speaker,
+				time.Unix(msg.Timestamp, 0).Format("2006-01-02 15:04"), msg.Content)
+		}
+	}
+	return bw.Flush()
+}
+
+type fineTuneMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type fineTuneExample struct {
+	Messages []fineTuneMessage `json:"messages"`
+}
+
+// writeFineTune 每个会话输出一行 {"messages": [...]}，没有助手回复的会话会被跳过
+func writeFineTune(w io.Writer, archive *Archive, prompt SystemPrompt) error {
+	encoder := json.NewEncoder(w)
+	for _, session := range archive.Sessions {
+		var example fineTuneExample
+		if prompt != nil {
+			if system := prompt(session.Persona); system != "" {
+				example.Messages = append(example.Messages, fineTuneMessage{Role: "system", Content: system})
+			}
+		}
+		hasAssistant := false
+		for _, msg := range session.Messages {
+			if msg.Kind != "" || strings.TrimSpace(msg.Content) == "" {
+				continue
+			}
+			role := "assistant"
+			if sql.NormalizeRole(msg, archive.User).Role == sql.RoleUser {
+				role = "user"
+			} else {
+				hasAssistant = true
+			}
+			example.Messages = append(example.Messages, fineTuneMessage{Role: role, Content: msg.Content})
+		}
+		if !hasAssistant {
+			continue
+		}
+		if err := encoder.Encode(example); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import 读取 JSON 格式的导出内容并写入归档，会话归属于 user。
+// 与已有会话 ID 冲突时为导入的会话生成新的 ID。
+func Import(ctx context.Context, db *pgxpool.Pool, user string, r io.Reader) (*ImportResult, error) {
+	var archive Archive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return nil, fmt.Errorf("invalid export file: %w", err)
+	}
+	if archive.Version != Version {
+		return nil, fmt.Errorf("unsupported export version %d", archive.Version)
+	}
+
+	result := &ImportResult{Renamed: map[string]string{}}
+	for _, session := range archive.Sessions {
+		sessionID := session.ID
+		_, err := sql.GetSession(ctx, db, user, sessionID)
+		if sessionID == "" || err == nil {
+			sessionID = base.GenerateSessionID()
+			if session.ID != "" {
+				result.Renamed[session.ID] = sessionID
+			}
+		} else if !errors.Is(err, sql.ErrSessionNotFound) {
+			return result, err
+		}
+
+		// 原导出中的用户名可能不同，统一换成规范角色
+		messages := make([]sql.Message, 0, len(session.Messages))
+		for _, msg := range session.Messages {
+			messages = append(messages, sql.NormalizeRole(msg, archive.User))
+		}
+
+		err = sql.ImportSession(ctx, db, sql.Session{
+			ID:        sessionID,
+			User:      user,
+			Title:     session.Title,
+			Persona:   session.Persona,
+			CreatedAt: session.CreatedAt,
+			UpdatedAt: session.UpdatedAt,
+		}, messages)
+		if err != nil {
+			return result, err
+		}
+		result.Sessions++
+		result.Messages += len(messages)
+	}
+	return result, nil
+}
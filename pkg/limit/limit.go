@@ -0,0 +1,205 @@
+package limit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// 超出限制的范围，也是 quota_exceeded 帧中的 scope
+const (
+	ScopeUser   = "user"
+	ScopeIP     = "ip"
+	ScopeTokens = "daily_tokens"
+)
+
+// quotaTTL 是每日用量计数在 Redis 中保留的时间，略长于一天以便跨时区查看
+const quotaTTL = 48 * time.Hour
+
+// Bucket 是令牌桶的配置：每秒补充 Rate 个令牌，最多积攒 Burst 个。Rate 为 0 时不限制
+type Bucket struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute 按每分钟的次数创建令牌桶，burst 为 0 时取每分钟的次数
+func PerMinute(count int, burst int) Bucket {
+	if burst <= 0 {
+		burst = count
+	}
+	return Bucket{Rate: float64(count) / 60, Burst: burst}
+}
+
+func (b Bucket) enabled() bool {
+	return b.Rate > 0 && b.Burst > 0
+}
+
+// Exceeded 描述一次被拒绝的请求
+type Exceeded struct {
+	Scope      string
+	Limit      int64
+	Used       int64
+	RetryAfter time.Duration
+}
+
+func (e *Exceeded) Error() string {
+	return fmt.Sprintf("%s limit exceeded, retry after %s", e.Scope, e.RetryAfter.Round(time.Second))
+}
+
+// Limits 是按用户和按 IP 的频率限制以及每日 token 配额；
+// 计数保存在 Redis 中，多个服务实例共享同一份限制。nil 的 Limits 不做任何限制
+type Limits struct {
+	RDB  *redis.Client
+	User Bucket
+	IP   Bucket
+	// DailyTokens 是每个用户每天（UTC）可以使用的 token 数，为 0 时不限制
+	DailyTokens int64
+}
+
+// tokenBucket 原子地补充并取走一个令牌，时间取自 Redis 以免各实例的时钟不一致。
+// 返回 {是否允许, 需要等待的毫秒数}
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// Allow 在处理一条消息前检查频率限制和每日配额，超出时返回 Exceeded。
+// user 或 ip 为空时跳过对应的检查
+func (l *Limits) Allow(ctx context.Context, user string, ip string) (*Exceeded, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if user != "" {
+		exceeded, err := l.take(ctx, ScopeUser, user, l.User)
+		if exceeded != nil || err != nil {
+			return exceeded, err
+		}
+	}
+	if ip != "" {
+		exceeded, err := l.take(ctx, ScopeIP, ip, l.IP)
+		if exceeded != nil || err != nil {
+			return exceeded, err
+		}
+	}
+	if user != "" && l.DailyTokens > 0 {
+		used, err := l.TokensUsed(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		if used >= l.DailyTokens {
+			return &Exceeded{Scope: ScopeTokens, Limit: l.DailyTokens, Used: used, RetryAfter: untilTomorrow(time.Now())}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (l *Limits) take(ctx context.Context, scope string, id string, bucket Bucket) (*Exceeded, error) {
+	if !bucket.enabled() {
+		return nil, nil
+	}
+	result, err := tokenBucket.Run(ctx, l.RDB, []string{"ratelimit:" + scope + ":" + id}, bucket.Rate, bucket.Burst).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("error checking rate limit: %w", err)
+	}
+	if result[0] == 1 {
+		return nil, nil
+	}
+	return &Exceeded{Scope: scope, Limit: int64(bucket.Burst), RetryAfter: time.Duration(result[1]) * time.Millisecond}, nil
+}
+
+// AddTokens 把一次模型调用使用的 token 计入用户当天的用量
+func (l *Limits) AddTokens(ctx context.Context, user string, tokens int) error {
+	if l == nil || user == "" || tokens <= 0 {
+		return nil
+	}
+	key := quotaKey(user, time.Now())
+	pipe := l.RDB.TxPipeline()
+	pipe.IncrBy(ctx, key, int64(tokens))
+	pipe.Expire(ctx, key, quotaTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TokensUsed 返回用户当天已经使用的 token 数
+func (l *Limits) TokensUsed(ctx context.Context, user string) (int64, error) {
+	used, err := l.RDB.Get(ctx, quotaKey(user, time.Now())).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return used, err
+}
+
+func quotaKey(user string, now time.Time) string {
+	return "quota:tokens:" + user + ":" + now.UTC().Format("2006-01-02")
+}
+
+func untilTomorrow(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// Tokens 从模型返回的 GenerationInfo 中读取本次调用使用的 token 数
+func Tokens(info map[string]any) int {
+	if total, ok := info["TotalTokens"].(int); ok && total > 0 {
+		return total
+	}
+	prompt, _ := info["PromptTokens"].(int)
+	completion, _ := info["CompletionTokens"].(int)
+	return prompt + completion
+}
+
+// metered 在每次模型调用后把使用的 token 计入用户的每日配额
+type metered struct {
+	llms.Model
+	limits *Limits
+	user   string
+}
+
+// Meter 包装模型，使经它发起的每次调用（包括工具循环和智能体的每一步）都计入 user 的每日配额；
+// 没有配置每日配额时原样返回
+func (l *Limits) Meter(llm llms.Model, user string) llms.Model {
+	if l == nil || l.DailyTokens <= 0 || user == "" {
+		return llm
+	}
+	return &metered{Model: llm, limits: l, user: user}
+}
+
+func (m *metered) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	resp, err := m.Model.GenerateContent(ctx, messages, options...)
+	if err != nil {
+		return resp, err
+	}
+	if len(resp.Choices) == 0 {
+		return resp, nil
+	}
+	// 每个候选回答都带着整次调用的用量，只取第一个
+	if err := m.limits.AddTokens(ctx, m.user, Tokens(resp.Choices[0].GenerationInfo)); err != nil {
+		logging.FromContext(ctx).Error("error adding tokens", logging.KeyUser, m.user, logging.KeyError, err)
+	}
+	return resp, nil
+}
+
+func (m *metered) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 日志格式，用于配置 LOG_FORMAT
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// 关联字段的名字，各处使用同样的键，便于按用户、会话或请求检索日志
+const (
+	KeyRequestID = "request_id"
+	KeyUser      = "user"
+	KeySessionID = "session_id"
+	KeyPersona   = "persona"
+	KeyError     = "err"
+)
+
+// HeaderRequestID 是携带请求 ID 的 HTTP 头，客户端没有提供时由服务端生成并在响应中返回
+const HeaderRequestID = "X-Request-ID"
+
+// ParseLevel 解析 debug / info / warn / error，为空时取 info
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("invalid log level %q", value)
+	}
+	return level, nil
+}
+
+// New 按级别和格式（text 或 json，为空时取 text）创建写入 w 的日志
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+}
+
+type loggerKey struct{}
+
+// WithLogger 把日志放入 context，之后经由该 context 的代码都使用它
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext 返回 context 中的日志，没有时返回 slog.Default()
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With 给 context 中的日志加上关联字段，返回新的 context 和日志
+func With(ctx context.Context, args ...any) (context.Context, *slog.Logger) {
+	logger := FromContext(ctx).With(args...)
+	return WithLogger(ctx, logger), logger
+}
+
+// Middleware 给每个请求分配请求 ID，并把带有请求 ID 的日志放入请求的 context；
+// 不包装 ResponseWriter，WebSocket 升级不受影响
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(HeaderRequestID)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(HeaderRequestID, requestID)
+		ctx, logger := With(r.Context(), KeyRequestID, requestID)
+		start := time.Now()
+		logger.Debug("request started", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(ctx))
+		logger.Debug("request finished", "method", r.Method, "path", r.URL.Path, "duration", time.Since(start))
+	})
+}
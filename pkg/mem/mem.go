@@ -11,7 +11,7 @@ import (
 
 func SummaryMemory(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, sessionID string, user string) (string, error) {
 
-	chatList, err := sql.GetChatMessage(ctx, rdb, sessionID, user)
+	chatList, err := sql.GetChatMessage(ctx, rdb, db, sessionID, user)
 	if err != nil {
 		return "", err
 	}
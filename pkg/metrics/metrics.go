@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "aiagent"
+
+// 任务结果，也是 aiagent_scheduler_jobs_total 的 outcome 标签
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// Registry 保存本服务的全部指标，由 Handler 在 /metrics 输出
+var Registry = prometheus.NewRegistry()
+
+var (
+	// WSConnections 是各路由当前的 WebSocket 连接数
+	WSConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_connections",
+		Help:      "Active WebSocket connections per route.",
+	}, []string{"route"})
+
+	// Messages 是各路由处理的消息数
+	Messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_total",
+		Help:      "Messages processed per route.",
+	}, []string{"route"})
+
+	// ModelDuration 是模型与向量化调用的耗时，流式调用包含整个流
+	ModelDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "model_request_duration_seconds",
+		Help:      "Latency of LLM and embedding requests.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+	}, []string{"kind", "model"})
+
+	// ModelRequests 是模型与向量化调用的次数，status 为 ok 或 error
+	ModelRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "model_requests_total",
+		Help:      "LLM and embedding requests by status.",
+	}, []string{"kind", "model", "status"})
+
+	// ModelTokens 是模型与向量化调用使用的 token 数，type 为 prompt 或 completion
+	ModelTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "model_tokens_total",
+		Help:      "Tokens used by LLM and embedding requests.",
+	}, []string{"kind", "model", "type"})
+
+	// Retrievals 是向量检索的次数
+	Retrievals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retrievals_total",
+		Help:      "Vector retrievals per table.",
+	}, []string{"table"})
+
+	// RetrievalHits 是向量检索返回给模型的条数
+	RetrievalHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retrieval_hits_total",
+		Help:      "Retrieved items returned to the model per table.",
+	}, []string{"table"})
+
+	// RetrievalDistance 是向量检索候选的向量距离，包括因距离过远被丢弃的
+	RetrievalDistance = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "retrieval_distance",
+		Help:      "Vector distance of retrieval candidates.",
+		Buckets:   []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.8, 1, 1.5, 2},
+	}, []string{"table"})
+
+	// StoreErrors 是 Redis 与 Postgres 的错误数，不含未命中
+	StoreErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_errors_total",
+		Help:      "Redis and Postgres errors per operation.",
+	}, []string{"store", "operation"})
+
+	// Jobs 是定时任务的执行次数
+	Jobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduler_jobs_total",
+		Help:      "Scheduled job runs by outcome.",
+	}, []string{"job", "outcome"})
+
+	// JobDuration 是定时任务的耗时
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scheduler_job_duration_seconds",
+		Help:      "Duration of scheduled job runs.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"job"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		WSConnections, Messages,
+		ModelDuration, ModelRequests, ModelTokens,
+		Retrievals, RetrievalHits, RetrievalDistance,
+		StoreErrors, Jobs, JobDuration,
+	)
+}
+
+// Handler 返回输出 Registry 的 /metrics 处理器
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+type routeKey struct{}
+
+// Instrument 把路由名放入请求的 context，供 MessageProcessed 使用；
+// WebSocket 升级请求在处理期间（即连接存续期间）计入 WSConnections
+func Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			gauge := WSConnections.WithLabelValues(route)
+			gauge.Inc()
+			defer gauge.Dec()
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+	}
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// MessageProcessed 给 context 所属路由的消息数加一，路由没有经过 Instrument 时不计
+func MessageProcessed(ctx context.Context) {
+	if route, ok := ctx.Value(routeKey{}).(string); ok {
+		Messages.WithLabelValues(route).Inc()
+	}
+}
+
+// ObserveModelCall 记录一次模型或向量化调用的耗时、结果和 token 数
+func ObserveModelCall(kind string, model string, latency time.Duration, promptTokens int, completionTokens int, failed bool) {
+	status := "ok"
+	if failed {
+		status = "error"
+	}
+	ModelRequests.WithLabelValues(kind, model, status).Inc()
+	ModelDuration.WithLabelValues(kind, model).Observe(latency.Seconds())
+	if promptTokens > 0 {
+		ModelTokens.WithLabelValues(kind, model, "prompt").Add(float64(promptTokens))
+	}
+	if completionTokens > 0 {
+		ModelTokens.WithLabelValues(kind, model, "completion").Add(float64(completionTokens))
+	}
+}
+
+// ObserveRetrieval 记录一次向量检索：候选的距离和最终返回的条数
+func ObserveRetrieval(table string, distances []float64, hits int) {
+	Retrievals.WithLabelValues(table).Inc()
+	histogram := RetrievalDistance.WithLabelValues(table)
+	for _, distance := range distances {
+		histogram.Observe(distance)
+	}
+	RetrievalHits.WithLabelValues(table).Add(float64(hits))
+}
+
+// ObserveJob 记录一次定时任务的耗时和结果，err 为 nil 时视为成功
+func ObserveJob(job string, start time.Time, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeError
+	}
+	Jobs.WithLabelValues(job, outcome).Inc()
+	JobDuration.WithLabelValues(job).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// 存储的名字，也是 aiagent_store_errors_total 的 store 标签
+const (
+	StoreRedis    = "redis"
+	StorePostgres = "postgres"
+)
+
+// RedisHook 统计 Redis 命令的错误，key 不存在（redis.Nil）不算错误
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			StoreErrors.WithLabelValues(StoreRedis, "dial").Inc()
+		}
+		return conn, err
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if err != nil && !errors.Is(err, redis.Nil) {
+			StoreErrors.WithLabelValues(StoreRedis, cmd.Name()).Inc()
+		}
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		if err != nil && !errors.Is(err, redis.Nil) {
+			StoreErrors.WithLabelValues(StoreRedis, "pipeline").Inc()
+		}
+		return err
+	}
+}
+
+// PGTracer 统计 Postgres 查询的错误，按语句的第一个关键字（select、insert 等）区分；
+// 查询没有结果（pgx.ErrNoRows）不算错误
+type PGTracer struct{}
+
+type pgOperationKey struct{}
+
+func (PGTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, pgOperationKey{}, sqlOperation(data.SQL))
+}
+
+func (PGTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	if data.Err == nil || errors.Is(data.Err, pgx.ErrNoRows) {
+		return
+	}
+	operation, _ := ctx.Value(pgOperationKey{}).(string)
+	StoreErrors.WithLabelValues(StorePostgres, operation).Inc()
+}
+
+// sqlOperation 返回语句的第一个关键字，用作标签时只保留常见的几种以免标签过多
+func sqlOperation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch operation := strings.ToLower(fields[0]); operation {
+	case "select", "insert", "update", "delete", "with", "create", "alter":
+		return operation
+	}
+	return "other"
+}
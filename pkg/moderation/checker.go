@@ -0,0 +1,142 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// KeywordChecker 按关键词（不区分大小写）和正则表达式检查文本
+type KeywordChecker struct {
+	Category string
+	Words    []string
+	Patterns []*regexp.Regexp
+}
+
+func NewKeywordChecker(category string, words []string, patterns []string) (*KeywordChecker, error) {
+	checker := &KeywordChecker{Category: category, Words: words}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		checker.Patterns = append(checker.Patterns, re)
+	}
+	return checker, nil
+}
+
+func (c *KeywordChecker) Name() string {
+	return "keyword"
+}
+
+func (c *KeywordChecker) Check(ctx context.Context, text string) ([]Flag, error) {
+	var flags []Flag
+	seen := map[string]bool{}
+	add := func(match string) {
+		if match != "" && !seen[match] {
+			seen[match] = true
+			flags = append(flags, Flag{Category: c.Category, Match: match})
+		}
+	}
+
+	// 在小写文本中查找，再取原文中对应的片段，方便脱敏时替换；
+	// 少数字符转小写后字节长度会变，这时退回区分大小写的查找
+	lower := strings.ToLower(text)
+	fold := len(lower) == len(text)
+	if !fold {
+		lower = text
+	}
+	for _, word := range c.Words {
+		if fold {
+			word = strings.ToLower(word)
+		}
+		if word == "" {
+			continue
+		}
+		for offset := 0; ; {
+			at := strings.Index(lower[offset:], word)
+			if at < 0 {
+				break
+			}
+			start := offset + at
+			add(text[start : start+len(word)])
+			offset = start + len(word)
+		}
+	}
+	for _, re := range c.Patterns {
+		for _, match := range re.FindAllString(text, -1) {
+			add(match)
+		}
+	}
+	return flags, nil
+}
+
+// ClassifierChecker 让模型判断文本是否属于需要审核的类别
+type ClassifierChecker struct {
+	LLM        llms.Model
+	Categories []string
+}
+
+type classification struct {
+	Flagged    bool     `json:"flagged"`
+	Categories []string `json:"categories"`
+	Reason     string   `json:"reason"`
+}
+
+func (c *ClassifierChecker) Name() string {
+	return "classifier"
+}
+
+func (c *ClassifierChecker) Check(ctx context.Context, text string) ([]Flag, error) {
+	prompt := fmt.Sprintf("你是内容审核员。判断下面的文本是否属于以下任一类别：%s。\n"+
+		"只输出 JSON：{\"flagged\": 是否属于, \"categories\": 属于的类别, \"reason\": 一句话的理由}\n文本：\n%s",
+		strings.Join(c.Categories, "、"), text)
+	result, err := c.LLM.GenerateContent(ctx, []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt),
+	}, llms.WithTemperature(0))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Choices) == 0 {
+		return nil, fmt.Errorf("empty response from model")
+	}
+
+	content := result.Choices[0].Content
+	if start, end := strings.Index(content, "{"), strings.LastIndex(content, "}"); start >= 0 && end > start {
+		content = content[start : end+1]
+	}
+	var verdict classification
+	if err := json.Unmarshal([]byte(content), &verdict); err != nil {
+		return nil, fmt.Errorf("invalid classifier output: %w", err)
+	}
+	if !verdict.Flagged {
+		return nil, nil
+	}
+	if len(verdict.Categories) == 0 {
+		verdict.Categories = []string{"unknown"}
+	}
+	flags := make([]Flag, 0, len(verdict.Categories))
+	for _, category := range verdict.Categories {
+		flags = append(flags, Flag{Category: category, Reason: verdict.Reason})
+	}
+	return flags, nil
+}
+
+// StubChecker 是本地替身，不调用任何服务，总是返回预设的结果；
+// 用于开发和测试时代替分类器，Flags 为空时放行全部内容
+type StubChecker struct {
+	Flags []Flag
+	Err   error
+}
+
+func (c *StubChecker) Name() string {
+	return "stub"
+}
+
+func (c *StubChecker) Check(ctx context.Context, text string) ([]Flag, error) {
+	return c.Flags, c.Err
+}
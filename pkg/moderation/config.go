@@ -0,0 +1,109 @@
+package moderation
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tmc/langchaingo/llms"
+	"gopkg.in/yaml.v3"
+)
+
+// 分类器的实现
+const (
+	ProviderLLM  = "llm"
+	ProviderStub = "stub"
+)
+
+// Config 是审核规则文件（YAML 或 JSON）的内容，例如：
+//
+//	keywords:
+//	  - category: abuse
+//	    words: [笨蛋]
+//	    action: redact
+//	classifier:
+//	  provider: llm
+//	  categories: [暴力, 色情, 自残]
+//	  action: block
+//	  stages: [input]
+type Config struct {
+	Keywords   []KeywordConfig   `json:"keywords" yaml:"keywords"`
+	Classifier *ClassifierConfig `json:"classifier,omitempty" yaml:"classifier,omitempty"`
+}
+
+type KeywordConfig struct {
+	Category string   `json:"category" yaml:"category"`
+	Words    []string `json:"words,omitempty" yaml:"words,omitempty"`
+	Patterns []string `json:"patterns,omitempty" yaml:"patterns,omitempty"`
+	Action   string   `json:"action" yaml:"action"`
+	Stages   []string `json:"stages,omitempty" yaml:"stages,omitempty"`
+}
+
+type ClassifierConfig struct {
+	// Provider 为 llm 时调用模型分类，为 stub 时使用不联网的本地替身
+	Provider   string   `json:"provider" yaml:"provider"`
+	Categories []string `json:"categories,omitempty" yaml:"categories,omitempty"`
+	Action     string   `json:"action" yaml:"action"`
+	Stages     []string `json:"stages,omitempty" yaml:"stages,omitempty"`
+}
+
+// LoadConfig 读取审核规则文件，YAML 是 JSON 的超集，两种格式都可以
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid moderation config: %w", err)
+	}
+	return &config, nil
+}
+
+// New 按规则文件创建审核流水线，llm 只在使用模型分类器时需要
+func New(config *Config, llm llms.Model) (*Pipeline, error) {
+	pipeline := &Pipeline{}
+	for _, kw := range config.Keywords {
+		if err := validateRule(kw.Action, kw.Stages); err != nil {
+			return nil, fmt.Errorf("keyword rule %q: %w", kw.Category, err)
+		}
+		checker, err := NewKeywordChecker(kw.Category, kw.Words, kw.Patterns)
+		if err != nil {
+			return nil, fmt.Errorf("keyword rule %q: %w", kw.Category, err)
+		}
+		pipeline.Rules = append(pipeline.Rules, Rule{Checker: checker, Action: kw.Action, Stages: kw.Stages})
+	}
+
+	if c := config.Classifier; c != nil {
+		if err := validateRule(c.Action, c.Stages); err != nil {
+			return nil, fmt.Errorf("classifier: %w", err)
+		}
+		var checker Checker
+		switch c.Provider {
+		case ProviderLLM:
+			if llm == nil {
+				return nil, fmt.Errorf("classifier: llm provider requires a model")
+			}
+			checker = &ClassifierChecker{LLM: llm, Categories: c.Categories}
+		case ProviderStub, "":
+			checker = &StubChecker{}
+		default:
+			return nil, fmt.Errorf("classifier: unknown provider %q", c.Provider)
+		}
+		pipeline.Rules = append(pipeline.Rules, Rule{Checker: checker, Action: c.Action, Stages: c.Stages})
+	}
+	return pipeline, nil
+}
+
+func validateRule(action string, stages []string) error {
+	switch action {
+	case ActionWarn, ActionRedact, ActionBlock:
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	for _, stage := range stages {
+		if stage != StageInput && stage != StageOutput {
+			return fmt.Errorf("unknown stage %q", stage)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 审核阶段：调用模型前检查用户输入，发送前检查角色回复
+const (
+	StageInput  = "input"
+	StageOutput = "output"
+)
+
+// 命中后的处理方式，按严重程度从低到高排列
+const (
+	ActionWarn   = "warn"
+	ActionRedact = "redact"
+	ActionBlock  = "block"
+)
+
+// RedactMask 是脱敏时替换命中内容的文本
+const RedactMask = "***"
+
+// BlockedReply 是回复被拦截时代替发送给用户的内容
+const BlockedReply = "抱歉，这条回复没有通过内容审核，换个话题吧。"
+
+// Flag 是一条被标记的内容
+type Flag struct {
+	Checker  string `json:"checker"`
+	Category string `json:"category"`
+	// Match 是命中的原文片段，分类器这类只给出整体判断的检查为空
+	Match  string `json:"match,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Action string `json:"action"`
+}
+
+// Checker 是一种可插拔的检查，返回文本中命中的内容
+type Checker interface {
+	Name() string
+	Check(ctx context.Context, text string) ([]Flag, error)
+}
+
+// Rule 指定一个检查在哪些阶段生效以及命中后的处理方式
+type Rule struct {
+	Checker Checker
+	Action  string
+	// Stages 为空时输入和输出都检查
+	Stages []string
+}
+
+func (r Rule) appliesTo(stage string) bool {
+	if len(r.Stages) == 0 {
+		return true
+	}
+	for _, s := range r.Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditEntry 是写入审核日志的一条记录
+type AuditEntry struct {
+	Stage     string `json:"stage"`
+	User      string `json:"user"`
+	SessionID string `json:"session_id"`
+	Action    string `json:"action"`
+	Content   string `json:"content"`
+	Flags     []Flag `json:"flags"`
+}
+
+// Result 是一次审核的结果
+type Result struct {
+	// Action 是命中规则中最严重的处理方式，没有命中时为空
+	Action string
+	// Text 是处理后的文本：脱敏后的内容，被拦截时为空
+	Text  string
+	Flags []Flag
+}
+
+func (r Result) Blocked() bool {
+	return r.Action == ActionBlock
+}
+
+// Pipeline 按顺序执行全部规则，nil 的 Pipeline 不做任何检查
+type Pipeline struct {
+	Rules []Rule
+	// Audit 记录被标记的内容，可以为空
+	Audit func(ctx context.Context, entry AuditEntry) error
+}
+
+// HasStage 判断是否有规则检查某个阶段
+func (p *Pipeline) HasStage(stage string) bool {
+	if p == nil {
+		return false
+	}
+	for _, rule := range p.Rules {
+		if rule.appliesTo(stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// Moderate 审核一段文本并写入审核日志。
+// 某个检查出错时跳过它继续执行其余的检查，错误和结果一起返回
+func (p *Pipeline) Moderate(ctx context.Context, stage string, user string, sessionID string, text string) (Result, error) {
+	result := Result{Text: text}
+	if p == nil {
+		return result, nil
+	}
+
+	var errs []error
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(stage) {
+			continue
+		}
+		flags, err := rule.Checker.Check(ctx, text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rule.Checker.Name(), err))
+			continue
+		}
+		for _, flag := range flags {
+			flag.Checker = rule.Checker.Name()
+			flag.Action = rule.Action
+			// 没有命中片段时无法脱敏，只能整条拦截
+			if flag.Action == ActionRedact && flag.Match == "" {
+				flag.Action = ActionBlock
+			}
+			result.Flags = append(result.Flags, flag)
+			if severity(flag.Action) > severity(result.Action) {
+				result.Action = flag.Action
+			}
+		}
+	}
+	if len(result.Flags) == 0 {
+		return result, errors.Join(errs...)
+	}
+
+	switch result.Action {
+	case ActionBlock:
+		result.Text = ""
+	case ActionRedact:
+		result.Text = Redact(text, result.Flags)
+	}
+	if p.Audit != nil {
+		err := p.Audit(ctx, AuditEntry{
+			Stage:     stage,
+			User:      user,
+			SessionID: sessionID,
+			Action:    result.Action,
+			Content:   text,
+			Flags:     result.Flags,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("audit: %w", err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// Redact 把需要脱敏的命中片段替换为 RedactMask
+func Redact(text string, flags []Flag) string {
+	for _, flag := range flags {
+		if flag.Action == ActionRedact && flag.Match != "" {
+			text = strings.ReplaceAll(text, flag.Match, RedactMask)
+		}
+	}
+	return text
+}
+
+func severity(action string) int {
+	switch action {
+	case ActionWarn:
+		return 1
+	case ActionRedact:
+		return 2
+	case ActionBlock:
+		return 3
+	}
+	return 0
+}
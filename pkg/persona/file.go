@@ -0,0 +1,76 @@
+package persona
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/aiagent/pkg/sql"
+	"gopkg.in/yaml.v3"
+)
+
+// 角色文件格式
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// FormatFromName 根据文件名或 Content-Type 推断格式，无法判断时返回 JSON
+func FormatFromName(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "yaml"), filepath.Ext(name) == ".yml":
+		return FormatYAML
+	}
+	return FormatJSON
+}
+
+// Encode 把角色设定写成 YAML 或 JSON 文件内容
+func Encode(w io.Writer, chara *sql.CharaPrompt, format string) error {
+	switch format {
+	case FormatYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(chara); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case FormatJSON, "":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(chara)
+	}
+	return fmt.Errorf("unsupported persona format %q", format)
+}
+
+// Decode 读取 YAML 或 JSON 格式的角色设定并校验必填字段。
+// 文件中的 id、version 和 updated_at 只作参考，保存时会重新分配。
+func Decode(r io.Reader, format string) (*sql.CharaPrompt, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var chara sql.CharaPrompt
+	switch format {
+	case FormatYAML:
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&chara)
+	case FormatJSON, "":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&chara)
+	default:
+		return nil, fmt.Errorf("unsupported persona format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid persona file: %w", err)
+	}
+	if err := chara.Validate(); err != nil {
+		return nil, err
+	}
+	return &chara, nil
+}
@@ -0,0 +1,42 @@
+package persona
+
+import (
+	"github.com/aiagent/pkg/sql"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Params 返回本次生成使用的参数：角色设定的参数被请求中已设置的字段覆盖
+func Params(chara *sql.CharaPrompt, override *sql.ModelParams) sql.ModelParams {
+	var params sql.ModelParams
+	if chara != nil {
+		params = chara.Params
+	}
+	return params.Merge(override)
+}
+
+// CallOptions 把生成参数转换为 langchaingo 的调用选项，未设置的字段不传，使用模型默认值
+func CallOptions(params sql.ModelParams) []llms.CallOption {
+	var options []llms.CallOption
+	if params.Temperature != nil {
+		options = append(options, llms.WithTemperature(*params.Temperature))
+	}
+	if params.TopP != nil {
+		options = append(options, llms.WithTopP(*params.TopP))
+	}
+	if params.MaxTokens > 0 {
+		options = append(options, llms.WithMaxTokens(params.MaxTokens))
+	}
+	if params.PresencePenalty != nil {
+		options = append(options, llms.WithPresencePenalty(*params.PresencePenalty))
+	}
+	if params.FrequencyPenalty != nil {
+		options = append(options, llms.WithFrequencyPenalty(*params.FrequencyPenalty))
+	}
+	if len(params.Stop) > 0 {
+		options = append(options, llms.WithStopWords(params.Stop))
+	}
+	if params.Seed != nil {
+		options = append(options, llms.WithSeed(*params.Seed))
+	}
+	return options
+}
@@ -0,0 +1,273 @@
+package pii
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// 内置检测器的名字，也用于配置 PII_DETECTORS
+const (
+	DetectorEmail    = "email"
+	DetectorIDCard   = "id_card"
+	DetectorBankCard = "bank_card"
+	DetectorPhone    = "phone"
+	DetectorIP       = "ip"
+	DetectorAddress  = "address"
+)
+
+// Detector 识别一类个人信息，命中的片段替换为 Placeholder
+type Detector struct {
+	Name        string
+	Placeholder string
+	Patterns    []*regexp.Regexp
+	// Digits 为 true 时，紧挨着其他数字的命中不算（避免从长数字中截出一段）
+	Digits bool
+	// Valid 进一步校验命中的片段，可以为空
+	Valid func(match string) bool
+	// Trim 返回命中片段开头需要保留的字节数，用于去掉“我住在”这类前缀，可以为空
+	Trim func(match string) int
+}
+
+// Finding 是文本中的一处个人信息
+type Finding struct {
+	Detector string `json:"detector"`
+	Match    string `json:"-"`
+}
+
+// builtinDetectors 按替换顺序排列：长的号码先于短的号码，避免身份证号被当作电话号码
+var builtinDetectors = []Detector{
+	{
+		Name:        DetectorEmail,
+		Placeholder: "[EMAIL]",
+		Patterns:    []*regexp.Regexp{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	},
+	{
+		Name:        DetectorIDCard,
+		Placeholder: "[ID_CARD]",
+		Patterns:    []*regexp.Regexp{regexp.MustCompile(`[1-9]\d{5}(?:19|20)\d{2}(?:0[1-9]|1[0-2])(?:0[1-9]|[12]\d|3[01])\d{3}[\dXx]`)},
+		Digits:      true,
+		Valid:       validIDCard,
+	},
+	{
+		Name:        DetectorBankCard,
+		Placeholder: "[BANK_CARD]",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`\d{13,19}`),
+			// 按四位分组书写的卡号，如 6222 0200 1234 5678
+			regexp.MustCompile(`\d{4}(?:[ -]\d{4}){2,3}(?:[ -]\d{1,3})?`),
+		},
+		Digits: true,
+		Valid:  validLuhn,
+	},
+	{
+		Name:        DetectorPhone,
+		Placeholder: "[PHONE]",
+		Patterns: []*regexp.Regexp{
+			// 中国大陆手机号，可带 +86
+			regexp.MustCompile(`(?:\+?86[ -]?)?1[3-9]\d[ -]?\d{4}[ -]?\d{4}`),
+			// 固定电话，如 010-12345678
+			regexp.MustCompile(`0\d{2,3}-\d{7,8}`),
+			// 国际格式与北美格式，如 +44 20 7946 0958、(555) 123-4567
+			regexp.MustCompile(`\+\d{1,3}[ -]?\(?\d{1,4}\)?(?:[ -]?\d{2,4}){2,4}`),
+			regexp.MustCompile(`\(?\d{3}\)?[ .-]\d{3}[ .-]\d{4}`),
+		},
+		Digits: true,
+	},
+	{
+		Name:        DetectorIP,
+		Placeholder: "[IP]",
+		Patterns:    []*regexp.Regexp{regexp.MustCompile(`(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)`)},
+		Digits:      true,
+	},
+	{
+		Name:        DetectorAddress,
+		Placeholder: "[ADDRESS]",
+		Patterns: []*regexp.Regexp{
+			// 中文地址：到门牌号为止，可带楼栋和房间号
+			regexp.MustCompile(`[\p{Han}\d]{2,20}?(?:路|街|巷|弄|大道|胡同)[\d一二三四五六七八九十]+号(?:[\d\p{Han}-]{0,12}?(?:室|楼|单元|栋|幢|号))?`),
+			// 英文地址：门牌号加街道名
+			regexp.MustCompile(`\b\d{1,5}\s+(?:[A-Z][a-z]+\s+){1,3}(?:Street|St|Road|Rd|Avenue|Ave|Boulevard|Blvd|Lane|Ln|Drive|Dr|Way|Court|Ct)\b\.?`),
+		},
+		Trim: trimAddressPrefix,
+	},
+}
+
+// Detectors 按名字选择内置检测器，"all" 表示全部；返回的顺序与内置顺序一致
+func Detectors(names []string) ([]Detector, error) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			return append([]Detector(nil), builtinDetectors...), nil
+		}
+		wanted[name] = true
+	}
+	var detectors []Detector
+	for _, d := range builtinDetectors {
+		if wanted[d.Name] {
+			detectors = append(detectors, d)
+			delete(wanted, d.Name)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown pii detector %q", name)
+	}
+	return detectors, nil
+}
+
+// Redactor 在保存和向量化之前替换文本中的个人信息；nil 的 Redactor 不做任何处理
+type Redactor struct {
+	Detectors []Detector
+	// Vault 不为空时保留一份加密的原文，供管理员查看
+	Vault *Vault
+}
+
+// Default 是保存消息和记忆时使用的 Redactor，由程序启动时按配置设置
+var Default *Redactor
+
+// New 按检测器名字和密钥创建 Redactor；没有检测器时返回 nil，key 为空时不保留原文
+func New(names []string, key string) (*Redactor, error) {
+	detectors, err := Detectors(names)
+	if err != nil {
+		return nil, err
+	}
+	if len(detectors) == 0 {
+		return nil, nil
+	}
+	redactor := &Redactor{Detectors: detectors}
+	if key != "" {
+		redactor.Vault, err = NewVault(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return redactor, nil
+}
+
+// Redact 返回替换后的文本和命中的个人信息
+func (r *Redactor) Redact(text string) (string, []Finding) {
+	if r == nil || text == "" {
+		return text, nil
+	}
+	var findings []Finding
+	for _, d := range r.Detectors {
+		for _, re := range d.Patterns {
+			text = replaceMatches(text, re, func(start, end int) (int, string, bool) {
+				if d.Digits && (digitBefore(text, start) || digitAfter(text, end)) {
+					return 0, "", false
+				}
+				match := text[start:end]
+				keep := 0
+				if d.Trim != nil {
+					keep = d.Trim(match)
+				}
+				if d.Valid != nil && !d.Valid(match[keep:]) {
+					return 0, "", false
+				}
+				findings = append(findings, Finding{Detector: d.Name, Match: match[keep:]})
+				return keep, d.Placeholder, true
+			})
+		}
+	}
+	return text, findings
+}
+
+// Seal 加密原文；没有配置 Vault 时返回 nil
+func (r *Redactor) Seal(text string) ([]byte, error) {
+	if r == nil || r.Vault == nil {
+		return nil, nil
+	}
+	return r.Vault.Seal(text)
+}
+
+// Kinds 返回命中的个人信息类别，去重且保持顺序
+func Kinds(findings []Finding) []string {
+	var kinds []string
+	seen := map[string]bool{}
+	for _, f := range findings {
+		if !seen[f.Detector] {
+			seen[f.Detector] = true
+			kinds = append(kinds, f.Detector)
+		}
+	}
+	return kinds
+}
+
+// replaceMatches 依次处理正则的命中，replace 返回保留的前缀长度和替换内容，第三个值为 false 时不替换
+func replaceMatches(text string, re *regexp.Regexp, replace func(start, end int) (int, string, bool)) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		keep, placeholder, ok := replace(loc[0], loc[1])
+		if !ok {
+			continue
+		}
+		sb.WriteString(text[last : loc[0]+keep])
+		sb.WriteString(placeholder)
+		last = loc[1]
+	}
+	if last == 0 {
+		return text
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+func digitBefore(text string, at int) bool {
+	return at > 0 && text[at-1] >= '0' && text[at-1] <= '9'
+}
+
+func digitAfter(text string, at int) bool {
+	return at < len(text) && text[at] >= '0' && text[at] <= '9'
+}
+
+// validIDCard 校验 18 位身份证号的校验码
+func validIDCard(id string) bool {
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i, w := range weights {
+		sum += int(id[i]-'0') * w
+	}
+	check := "10X98765432"[sum%11]
+	return unicode.ToUpper(rune(id[17])) == rune(check)
+}
+
+// validLuhn 用 Luhn 算法校验银行卡号
+func validLuhn(number string) bool {
+	var digits []int
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		if (len(digits)-1-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+var addressPrefix = regexp.MustCompile(`^.*?(?:住在|住址是|住址|地址是|地址|寄到|送到|位于|搬到)[:：]?`)
+
+// trimAddressPrefix 去掉中文地址前面的“我住在”“地址是”等说明文字
+func trimAddressPrefix(match string) int {
+	if loc := addressPrefix.FindStringIndex(match); loc != nil {
+		return loc[1]
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Vault 用 AES-256-GCM 加密保存被脱敏的原文
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// NewVault 使用 32 字节的密钥创建 Vault，密钥可以是 base64 或 hex 编码
+func NewVault(key string) (*Vault, error) {
+	raw, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{aead: aead}, nil
+}
+
+// Seal 加密文本，返回 nonce 加密文
+func (v *Vault) Seal(text string) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, []byte(text), nil), nil
+}
+
+// Open 解密 Seal 的结果
+func (v *Vault) Open(sealed []byte) (string, error) {
+	size := v.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("sealed data too short")
+	}
+	plain, err := v.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func decodeKey(key string) ([]byte, error) {
+	if raw, err := hex.DecodeString(key); err == nil && len(raw) == 32 {
+		return raw, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(key); err == nil && len(raw) == 32 {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("pii vault key must be 32 bytes encoded as hex or base64")
+}
@@ -0,0 +1,191 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pgvector/pgvector-go"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+const (
+	historyIndexBatch        = 64
+	historyDistanceThreshold = 0.5
+)
+
+// 检索条数与上下文条数的上限，所有调用方（REST、WebSocket、工具）共用
+const (
+	MaxHistoryLimit   = 50
+	MaxHistoryContext = 10
+)
+
+// 命中方式
+const (
+	MatchLexical  = "lexical"
+	MatchSemantic = "semantic"
+)
+
+type HistorySearch struct {
+	User  string
+	Query string
+	// Since / Until 限定消息时间范围，零值表示不限
+	Since time.Time
+	Until time.Time
+	Limit int
+	// ContextSize 是命中消息前后各带出的消息条数
+	ContextSize int
+}
+
+type HistoryHit struct {
+	sql.HistoryMessage
+	Match    string        `json:"match"`
+	Distance float32       `json:"distance,omitempty"`
+	Context  []sql.Message `json:"context,omitempty"`
+}
+
+// IndexChatHistory 为尚未向量化的归档消息生成 embedding，user 为空时处理全部用户，返回本次处理的条数
+func IndexChatHistory(ctx context.Context, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl, user string) (int, error) {
+	indexed := 0
+	for {
+		rows, err := db.Query(ctx, `
+		SELECT id, content FROM chat_messages
+		WHERE ($1 = '' OR user_name = $1) AND kind = '' AND embedding IS NULL AND content <> ''
+		ORDER BY id
+		LIMIT $2`, user, historyIndexBatch)
+		if err != nil {
+			return indexed, err
+		}
+		var ids []int64
+		var contents []string
+		for rows.Next() {
+			var id int64
+			var content string
+			if err := rows.Scan(&id, &content); err != nil {
+				rows.Close()
+				return indexed, err
+			}
+			ids = append(ids, id)
+			contents = append(contents, content)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return indexed, err
+		}
+		if len(ids) == 0 {
+			return indexed, nil
+		}
+
+		vectors, err := embedder.EmbedDocuments(ctx, contents)
+		if err != nil {
+			return indexed, fmt.Errorf("error embedding chat history: %w", err)
+		}
+		if len(vectors) != len(ids) {
+			return indexed, fmt.Errorf("error embedding chat history: got %d vectors for %d messages", len(vectors), len(ids))
+		}
+		for i, id := range ids {
+			_, err := db.Exec(ctx, `UPDATE chat_messages SET embedding = $1 WHERE id = $2`,
+				pgvector.NewVector(vectors[i]), id)
+			if err != nil {
+				return indexed, err
+			}
+			indexed++
+		}
+		if len(ids) < historyIndexBatch {
+			return indexed, nil
+		}
+	}
+}
+
+// SearchHistory 同时按关键词和语义检索用户的历史消息，结果按消息去重，关键词命中优先
+func SearchHistory(ctx context.Context, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl, search HistorySearch) ([]HistoryHit, error) {
+	if search.Limit <= 0 {
+		search.Limit = 5
+	}
+	search.Limit = min(search.Limit, MaxHistoryLimit)
+	search.ContextSize = max(min(search.ContextSize, MaxHistoryContext), 0)
+	if search.Until.IsZero() {
+		search.Until = time.Now().Add(time.Minute)
+	}
+
+	lexical, err := sql.SearchArchivedMessages(ctx, db, search.User, search.Query, search.Since, search.Until, search.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching history: %w", err)
+	}
+
+	var hits []HistoryHit
+	seen := map[int64]bool{}
+	for _, msg := range lexical {
+		seen[msg.ID] = true
+		hits = append(hits, HistoryHit{HistoryMessage: msg, Match: MatchLexical})
+	}
+
+	// 语义检索只覆盖已生成 embedding 的消息，新消息由定时任务 timer.TimerIndexChatHistory 处理
+	if len(hits) < search.Limit {
+		semantic, err := searchHistoryByVector(ctx, db, embedder, search)
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range semantic {
+			if len(hits) >= search.Limit {
+				break
+			}
+			if !seen[hit.ID] {
+				seen[hit.ID] = true
+				hits = append(hits, hit)
+			}
+		}
+	}
+
+	if search.ContextSize > 0 {
+		for i := range hits {
+			hits[i].Context, err = sql.GetMessageContext(ctx, db, search.User, hits[i].SessionID, hits[i].ID, search.ContextSize)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hits, nil
+}
+
+func searchHistoryByVector(ctx context.Context, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl, search HistorySearch) ([]HistoryHit, error) {
+	queryVec, err := EmbedText(ctx, search.Query, embedder)
+	if err != nil {
+		return nil, err
+	}
+	vector := pgvector.NewVector(Float64To32(queryVec))
+
+	rows, err := db.Query(ctx, `
+	SELECT session_id, id, role, speaker, content, kind, created_at, embedding <-> $2 AS distance
+	FROM chat_messages
+	WHERE user_name = $1 AND kind = '' AND embedding IS NOT NULL
+		AND created_at >= $3 AND created_at < $4
+	ORDER BY distance
+	LIMIT $5`, search.User, vector, search.Since, search.Until, search.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []HistoryHit
+	for rows.Next() {
+		var hit HistoryHit
+		var createdAt time.Time
+		if err := rows.Scan(&hit.SessionID, &hit.ID, &hit.Role, &hit.Speaker, &hit.Content, &hit.Kind, &createdAt, &hit.Distance); err != nil {
+			return nil, err
+		}
+		if hit.Distance > historyDistanceThreshold {
+			continue
+		}
+		hit.Timestamp = createdAt.Unix()
+		hit.Match = MatchSemantic
+		hits = append(hits, hit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
@@ -0,0 +1,83 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// 保存资料和记忆的表
+const (
+	TableDocuments = "documents"
+	TableMemory    = "memory"
+)
+
+var ErrQuarantineNotFound = errors.New("quarantined item not found")
+
+// FlaggedItem 是一条被注入检测标记的资料或记忆
+type FlaggedItem struct {
+	ID          int    `json:"id"`
+	Content     string `json:"content"`
+	Reason      string `json:"reason"`
+	Quarantined bool   `json:"quarantined"`
+}
+
+// ValidTable 判断是否是保存资料或记忆的表名
+func ValidTable(table string) bool {
+	return table == TableDocuments || table == TableMemory
+}
+
+// ListFlagged 列出被标记的内容，onlyQuarantined 为 true 时只列出仍在隔离中的内容
+func ListFlagged(ctx context.Context, db *pgxpool.Pool, table string, onlyQuarantined bool) ([]FlaggedItem, error) {
+	if !ValidTable(table) {
+		return nil, fmt.Errorf("unknown table %q", table)
+	}
+	sqlStr := fmt.Sprintf(`SELECT id, content, flag_reason, quarantined FROM %s WHERE flagged AND (quarantined OR NOT $1) ORDER BY id DESC`, table)
+	rows, err := db.Query(ctx, sqlStr, onlyQuarantined)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []FlaggedItem{}
+	for rows.Next() {
+		var item FlaggedItem
+		if err := rows.Scan(&item.ID, &item.Content, &item.Reason, &item.Quarantined); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// ReleaseQuarantined 人工确认后解除隔离；内容仍保留标记，检索时带着 SuspiciousMark 返回
+func ReleaseQuarantined(ctx context.Context, db *pgxpool.Pool, table string, id int) error {
+	if !ValidTable(table) {
+		return fmt.Errorf("unknown table %q", table)
+	}
+	tag, err := db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET quarantined = false WHERE id = $1 AND quarantined`, table), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrQuarantineNotFound
+	}
+	return nil
+}
+
+// DeleteFlagged 删除一条被标记的内容
+func DeleteFlagged(ctx context.Context, db *pgxpool.Pool, table string, id int) error {
+	if !ValidTable(table) {
+		return fmt.Errorf("unknown table %q", table)
+	}
+	tag, err := db.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1 AND flagged`, table), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrQuarantineNotFound
+	}
+	return nil
+}
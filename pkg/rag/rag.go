@@ -6,6 +6,10 @@ import (
 	"strings"
 
 	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/usage"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pgvector/pgvector-go"
 	"github.com/tmc/langchaingo/embeddings"
@@ -28,6 +32,7 @@ func InitEmbedder() (*embeddings.EmbedderImpl, error) {
 		openai.WithToken(config.ApiKey),
 		openai.WithBaseURL(config.BaseUrl),
 		openai.WithEmbeddingModel("text-embedding-v1"),
+		openai.WithHTTPClient(usage.HTTPClient()),
 	)
 
 	if err != nil {
@@ -50,20 +55,17 @@ func EmbedText(ctx context.Context, text string, embedder *embeddings.EmbedderIm
 }
 
 func InsertDocument(ctx context.Context, db *pgxpool.Pool, content string, embedder *embeddings.EmbedderImpl) error {
-	vec, err := EmbedText(ctx, content, embedder)
-	if err != nil {
-		return fmt.Errorf("error embedding document: %w", err)
-	}
-
-	vectorStr := Float64ArrayToPGVector(vec)
-
-	query := `INSERT INTO documents (content, embedding) VALUES ($1, $2)`
-	_, err = db.Exec(ctx, query, content, vectorStr)
-
-	return err
+	return insertContent(ctx, db, TableDocuments, content, embedder)
 }
 
 func InsertMemory(ctx context.Context, db *pgxpool.Pool, content string, embedder *embeddings.EmbedderImpl) error {
+	// 记忆由对话总结而来，可能带有个人信息，在向量化和保存之前脱敏
+	content = sql.RedactPII(ctx, db, sql.PIISourceMemory, "", "", content)
+	return insertContent(ctx, db, TableMemory, content, embedder)
+}
+
+// insertContent 写入一条资料或记忆，写入前做注入检测，命中时标记（开启 Quarantine 时隔离）
+func insertContent(ctx context.Context, db *pgxpool.Pool, table string, content string, embedder *embeddings.EmbedderImpl) error {
 	vec, err := EmbedText(ctx, content, embedder)
 	if err != nil {
 		return fmt.Errorf("error embedding document: %w", err)
@@ -71,72 +73,100 @@ func InsertMemory(ctx context.Context, db *pgxpool.Pool, content string, embedde
 
 	vectorStr := Float64ArrayToPGVector(vec)
 
-	query := `INSERT INTO memory (content, embedding) VALUES ($1, $2)`
-	_, err = db.Exec(ctx, query, content, vectorStr)
+	reasons := DetectInjection(content)
+	if len(reasons) > 0 {
+		logging.FromContext(ctx).Warn("possible prompt injection", "table", table, "quarantine", Quarantine, "reasons", reasons)
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (content, embedding, flagged, flag_reason, quarantined) VALUES ($1, $2, $3, $4, $5)`, table)
+	_, err = db.Exec(ctx, query, content, vectorStr, len(reasons) > 0, strings.Join(reasons, ","), len(reasons) > 0 && Quarantine)
 
 	return err
 }
 
 func RetrieveRelevantMemory(ctx context.Context, queryVec []float64, topK int, db *pgxpool.Pool) ([]string, error) {
-	vector := pgvector.NewVector(Float64To32(queryVec))
-	var results []string
-	sqlStr := `
-    SELECT content, embedding <-> $1 AS distance
-    FROM memory
-    ORDER BY distance
-    LIMIT $2`
-
-	rows, err := db.Query(ctx, sqlStr, vector, topK)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var item MemoryItem
-		if err := rows.Scan(&item.Content, &item.Distance); err != nil {
-			return nil, err
-		}
-		if item.Distance <= 0.5 {
-			results = append(results, item.Content)
-		}
-	}
+	return retrieveContent(ctx, db, TableMemory, queryVec, topK, "")
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+// MemoryOwnerPrefix 是 save_memory 写在记忆开头、标明这条记忆属于哪位用户的前缀
+func MemoryOwnerPrefix(user string) string {
+	return "（关于" + user + "）"
+}
 
-	return results, nil
+// RetrieveUserMemory 只检索以 MemoryOwnerPrefix(user) 开头的记忆，不会带出其他用户的记忆
+func RetrieveUserMemory(ctx context.Context, queryVec []float64, topK int, db *pgxpool.Pool, user string) ([]string, error) {
+	return retrieveContent(ctx, db, TableMemory, queryVec, topK, MemoryOwnerPrefix(user))
 }
 
 func RetrieveRelevantDocs(ctx context.Context, queryVec []float64, topK int, db *pgxpool.Pool) ([]string, error) {
+	return retrieveContent(ctx, db, TableDocuments, queryVec, topK, "")
+}
+
+// retrieveContent 检索未被隔离的内容，并对结果再做一次注入检测：
+// 写入时没有检出的内容（旧数据或规则更新后）在这里补上标记，开启 Quarantine 时直接隔离并跳过；
+// 已标记但未隔离（或被人工放行）的内容带上 SuspiciousMark 返回。prefix 不为空时只检索以它开头的内容
+func retrieveContent(ctx context.Context, db *pgxpool.Pool, table string, queryVec []float64, topK int, prefix string) ([]string, error) {
 	vector := pgvector.NewVector(Float64To32(queryVec))
 	var results []string
-	sqlStr := `
-    SELECT content, embedding <-> $1 AS distance
-    FROM documents
+	sqlStr := fmt.Sprintf(`
+    SELECT id, content, flagged, embedding <-> $1 AS distance
+    FROM %s
+    WHERE NOT quarantined AND starts_with(content, $3)
     ORDER BY distance
-    LIMIT $2`
+    LIMIT $2`, table)
 
-	rows, err := db.Query(ctx, sqlStr, vector, topK)
+	rows, err := db.Query(ctx, sqlStr, vector, topK, prefix)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	type detected struct {
+		id      int
+		reasons []string
+	}
+	var newlyFlagged []detected
+	var distances []float64
 	for rows.Next() {
 		var item MemoryItem
-		if err := rows.Scan(&item.Content, &item.Distance); err != nil {
+		var id int
+		var flagged bool
+		if err := rows.Scan(&id, &item.Content, &flagged, &item.Distance); err != nil {
 			return nil, err
 		}
-		if item.Distance <= 0.5 {
-			results = append(results, item.Content)
+		distances = append(distances, float64(item.Distance))
+		if item.Distance > 0.5 {
+			continue
+		}
+		if !flagged {
+			if reasons := DetectInjection(item.Content); len(reasons) > 0 {
+				newlyFlagged = append(newlyFlagged, detected{id: id, reasons: reasons})
+				if Quarantine {
+					continue
+				}
+				flagged = true
+			}
+		}
+		if flagged {
+			item.Content = SuspiciousMark + item.Content
 		}
+		results = append(results, item.Content)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
+	metrics.ObserveRetrieval(table, distances, len(results))
+
+	logger := logging.FromContext(ctx)
+	for _, d := range newlyFlagged {
+		logger.Warn("possible prompt injection", "table", table, "id", d.id, "quarantine", Quarantine, "reasons", d.reasons)
+		_, err := db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET flagged = true, flag_reason = $2, quarantined = $3 WHERE id = $1`, table),
+			d.id, strings.Join(d.reasons, ","), Quarantine)
+		if err != nil {
+			logger.Error("error flagging content", "table", table, "id", d.id, logging.KeyError, err)
+		}
+	}
 
 	return results, nil
 }
@@ -0,0 +1,134 @@
+package room
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Member 是房间中的一个连接，Send 需要可以被并发调用
+type Member struct {
+	User string
+	Send func(data []byte) error
+}
+
+type roomState struct {
+	members map[*Member]struct{}
+	// reply 串行化同一房间中角色的回复，保证写入的历史顺序一致
+	reply sync.Mutex
+	// replies 是持有或等待 reply 的回复数（受 Hub.mu 保护），不为 0 时不能删除房间，
+	// 否则新加入的连接会拿到另一把锁
+	replies int
+}
+
+// Hub 管理进程内各房间的在线连接并负责广播
+type Hub struct {
+	mu    sync.Mutex
+	rooms map[string]*roomState
+}
+
+func NewHub() *Hub {
+	return &Hub{rooms: map[string]*roomState{}}
+}
+
+func (h *Hub) state(roomID string) *roomState {
+	state, ok := h.rooms[roomID]
+	if !ok {
+		state = &roomState{members: map[*Member]struct{}{}}
+		h.rooms[roomID] = state
+	}
+	return state
+}
+
+func (h *Hub) Join(roomID string, m *Member) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state(roomID).members[m] = struct{}{}
+}
+
+func (h *Hub) Leave(roomID string, m *Member) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	delete(state.members, m)
+	h.release(roomID, state)
+}
+
+// release 在房间既没有连接也没有进行中的回复时删除房间，调用方需持有 h.mu
+func (h *Hub) release(roomID string, state *roomState) {
+	if len(state.members) == 0 && state.replies == 0 {
+		delete(h.rooms, roomID)
+	}
+}
+
+// Online 返回房间中在线的用户名（去重并排序）
+func (h *Hub) Online(roomID string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := map[string]bool{}
+	users := []string{}
+	if state, ok := h.rooms[roomID]; ok {
+		for m := range state.members {
+			if !seen[m.User] {
+				seen[m.User] = true
+				users = append(users, m.User)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Broadcast 把数据发送给房间中的全部连接，返回发送失败的连接
+func (h *Hub) Broadcast(roomID string, data []byte) []*Member {
+	h.mu.Lock()
+	var members []*Member
+	if state, ok := h.rooms[roomID]; ok {
+		for m := range state.members {
+			members = append(members, m)
+		}
+	}
+	h.mu.Unlock()
+
+	var failed []*Member
+	for _, m := range members {
+		if err := m.Send(data); err != nil {
+			failed = append(failed, m)
+		}
+	}
+	return failed
+}
+
+// LockReply 获取房间的回复锁，返回解锁函数
+func (h *Hub) LockReply(roomID string) func() {
+	h.mu.Lock()
+	state := h.state(roomID)
+	state.replies++
+	h.mu.Unlock()
+	state.reply.Lock()
+	return func() {
+		state.reply.Unlock()
+		h.mu.Lock()
+		state.replies--
+		h.release(roomID, state)
+		h.mu.Unlock()
+	}
+}
+
+// ShouldReply 判断一条群聊消息是否在叫角色：@角色名，或包含房间的触发词。
+// 只是提到角色名（例如在聊角色）不算
+func ShouldReply(content string, persona string, triggers []string) bool {
+	lower := strings.ToLower(content)
+	if persona != "" && strings.Contains(lower, "@"+strings.ToLower(persona)) {
+		return true
+	}
+	for _, trigger := range triggers {
+		if trigger != "" && strings.Contains(lower, strings.ToLower(trigger)) {
+			return true
+		}
+	}
+	return false
+}
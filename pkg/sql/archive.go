@@ -0,0 +1,331 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// ChatCacheTTL 是 Redis 中会话缓存的过期时间，每次写入都会续期；
+// 只有在 Postgres 归档可用时才会设置过期，避免丢失唯一的副本。
+const ChatCacheTTL = 7 * 24 * time.Hour
+
+// CreateArchiveTable 创建会话与消息的归档表
+func CreateArchiveTable(ctx context.Context, db *pgxpool.Pool) error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS chat_sessions (
+		id TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_name, id)
+	);
+
+	CREATE TABLE IF NOT EXISTS chat_messages (
+		id BIGSERIAL PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		kind TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		FOREIGN KEY (user_name, session_id) REFERENCES chat_sessions (user_name, id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS chat_messages_session_idx ON chat_messages (user_name, session_id, id);
+	CREATE INDEX IF NOT EXISTS chat_messages_created_idx ON chat_messages (user_name, created_at);
+
+	ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS persona TEXT NOT NULL DEFAULT '';
+	ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS embedding vector(1536);
+
+	-- 消息以树的形式保存：parent_id 指向上一条消息，head_id 是当前分支的最后一条消息
+	ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS parent_id BIGINT REFERENCES chat_messages (id) ON DELETE CASCADE;
+	ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS head_id BIGINT;
+	CREATE INDEX IF NOT EXISTS chat_messages_parent_idx ON chat_messages (parent_id);
+
+	-- role 只有 user 和 ai，说话人的名字保存在 speaker
+	ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS speaker TEXT NOT NULL DEFAULT '';
+
+	-- 回复使用的生成参数，用于复现
+	ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS params JSONB;
+
+	-- 记录已经执行过的一次性数据迁移
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	`
+
+	_, err := db.Exec(ctx, createTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating archive table: %w", err)
+	}
+	for _, m := range archiveMigrations {
+		if err := migrateOnce(ctx, db, m.name, m.sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveMigrations 是改写旧数据的迁移，需要扫描整张表，只执行一次
+var archiveMigrations = []struct {
+	name string
+	sql  string
+}{
+	{
+		// 旧数据中以用户名或角色名作为 role，名字移到 speaker
+		name: "chat_messages_canonical_roles",
+		sql: `
+		UPDATE chat_messages SET
+			speaker = CASE WHEN lower(role) = 'ai' THEN '' ELSE role END,
+			role = CASE WHEN role = user_name THEN 'user' ELSE 'ai' END
+		WHERE role NOT IN ('user', 'ai')`,
+	},
+	{
+		// 旧会话是线性的，按 ID 顺序补齐 parent_id 和 head_id
+		name: "chat_messages_branch_backfill",
+		sql: `
+		UPDATE chat_messages m SET parent_id = p.prev_id
+		FROM (
+			SELECT id, lag(id) OVER (PARTITION BY user_name, session_id ORDER BY id) AS prev_id
+			FROM chat_messages
+		) p, chat_sessions s
+		WHERE m.id = p.id AND p.prev_id IS NOT NULL AND m.parent_id IS NULL
+			AND s.user_name = m.user_name AND s.id = m.session_id AND s.head_id IS NULL;
+		UPDATE chat_sessions s SET head_id = (
+			SELECT max(m.id) FROM chat_messages m WHERE m.user_name = s.user_name AND m.session_id = s.id
+		)
+		WHERE s.head_id IS NULL`,
+	},
+}
+
+// migrateOnce 在事务中执行一次名为 name 的迁移并记录下来，已经执行过时跳过。
+// 多个实例同时启动时，后来者会等待先执行的事务提交后跳过
+func migrateOnce(ctx context.Context, db *pgxpool.Pool, name string, migration string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `INSERT INTO schema_migrations (name) VALUES ($1) ON CONFLICT DO NOTHING`, name)
+	if err != nil {
+		return fmt.Errorf("error recording migration %s: %w", name, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, migration); err != nil {
+		return fmt.Errorf("error running migration %s: %w", name, err)
+	}
+	return tx.Commit(ctx)
+}
+
+// ArchiveChatMessage 把一条消息写入 Postgres 归档，返回消息 ID
+func ArchiveChatMessage(ctx context.Context, db *pgxpool.Pool, message Message, sessionID string, user string) (int64, error) {
+	createdAt := time.Unix(message.Timestamp, 0)
+	if message.Timestamp == 0 {
+		createdAt = time.Now()
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// 新消息接在当前分支末尾，upsert 同时锁住会话行，避免并发写入产生分叉
+	var headID *int64
+	err = tx.QueryRow(ctx, `
+	INSERT INTO chat_sessions (id, user_name, created_at, updated_at)
+	VALUES ($1, $2, $3, $3)
+	ON CONFLICT (user_name, id) DO UPDATE SET updated_at = EXCLUDED.updated_at
+	RETURNING head_id`,
+		sessionID, user, createdAt).Scan(&headID)
+	if err != nil {
+		return 0, fmt.Errorf("error archiving session: %w", err)
+	}
+
+	id, err := insertMessage(ctx, tx, sessionID, user, headID, message, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+// insertMessage 写入一条消息并把它设为会话当前分支的末尾
+func insertMessage(ctx context.Context, tx pgx.Tx, sessionID string, user string, parentID *int64, message Message, createdAt time.Time) (int64, error) {
+	message = NormalizeRole(message, user)
+	var id int64
+	err := tx.QueryRow(ctx, `
+	INSERT INTO chat_messages (session_id, user_name, parent_id, role, speaker, content, kind, params, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id`,
+		sessionID, user, parentID, message.Role, message.Speaker, message.Content, message.Kind, message.Params, createdAt).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error archiving message: %w", err)
+	}
+	_, err = tx.Exec(ctx, `UPDATE chat_sessions SET head_id = $3 WHERE user_name = $1 AND id = $2`,
+		user, sessionID, id)
+	if err != nil {
+		return 0, fmt.Errorf("error moving session head: %w", err)
+	}
+	return id, nil
+}
+
+// GetArchivedChatMessage 从归档中按时间顺序读取一个会话当前分支上的消息
+func GetArchivedChatMessage(ctx context.Context, db *pgxpool.Pool, sessionID string, user string) ([]Message, error) {
+	return queryMessages(ctx, db, `
+	WITH RECURSIVE branch AS (
+		SELECT m.* FROM chat_messages m
+		JOIN chat_sessions s ON s.user_name = m.user_name AND s.id = m.session_id AND s.head_id = m.id
+		WHERE s.user_name = $1 AND s.id = $2
+		UNION ALL
+		SELECT m.* FROM chat_messages m JOIN branch b ON m.id = b.parent_id
+	)
+	SELECT id, parent_id, role, speaker, content, kind, params, created_at FROM branch
+	ORDER BY id`, user, sessionID)
+}
+
+// getBranch 读取从会话第一条消息到 leafID 的分支
+func getBranch(ctx context.Context, db querier, user string, sessionID string, leafID int64) ([]Message, error) {
+	return queryMessages(ctx, db, `
+	WITH RECURSIVE branch AS (
+		SELECT * FROM chat_messages WHERE user_name = $1 AND session_id = $2 AND id = $3
+		UNION ALL
+		SELECT m.* FROM chat_messages m JOIN branch b ON m.id = b.parent_id
+	)
+	SELECT id, parent_id, role, speaker, content, kind, params, created_at FROM branch
+	ORDER BY id`, user, sessionID, leafID)
+}
+
+// GetArchivedMessagesSince 读取用户在某个时间之后的全部消息
+func GetArchivedMessagesSince(ctx context.Context, db *pgxpool.Pool, user string, since time.Time) ([]Message, error) {
+	return queryMessages(ctx, db, `
+	SELECT id, parent_id, role, speaker, content, kind, params, created_at FROM chat_messages
+	WHERE user_name = $1 AND created_at >= $2
+	ORDER BY id`, user, since)
+}
+
+// querier 是 *pgxpool.Pool 和 pgx.Tx 共有的查询方法
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func queryMessages(ctx context.Context, db querier, sqlStr string, args ...any) ([]Message, error) {
+	rows, err := db.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var parentID *int64
+		var createdAt time.Time
+		if err := rows.Scan(&msg.ID, &parentID, &msg.Role, &msg.Speaker, &msg.Content, &msg.Kind, &msg.Params, &createdAt); err != nil {
+			return nil, err
+		}
+		if parentID != nil {
+			msg.ParentID = *parentID
+		}
+		msg.Timestamp = createdAt.Unix()
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// HistoryMessage 是带有所属会话的归档消息，用于跨会话检索
+type HistoryMessage struct {
+	SessionID string `json:"session_id"`
+	Message
+}
+
+// SearchArchivedMessages 在用户的归档消息中按关键词（不区分大小写）检索，最新的优先
+func SearchArchivedMessages(ctx context.Context, db *pgxpool.Pool, user string, keyword string, since time.Time, until time.Time, limit int) ([]HistoryMessage, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(keyword) + "%"
+	return queryHistoryMessages(ctx, db, `
+	SELECT session_id, id, role, speaker, content, kind, created_at FROM chat_messages
+	WHERE user_name = $1 AND kind = '' AND content ILIKE $2
+		AND created_at >= $3 AND created_at < $4
+	ORDER BY id DESC
+	LIMIT $5`, user, pattern, since, until, limit)
+}
+
+// GetMessageContext 返回同一会话中某条消息前后各 size 条普通消息（不含该消息本身）
+func GetMessageContext(ctx context.Context, db *pgxpool.Pool, user string, sessionID string, messageID int64, size int) ([]Message, error) {
+	return queryMessages(ctx, db, `
+	SELECT id, parent_id, role, speaker, content, kind, params, created_at FROM (
+		(SELECT id, parent_id, role, speaker, content, kind, params, created_at FROM chat_messages
+		WHERE user_name = $1 AND session_id = $2 AND kind = '' AND id < $3
+		ORDER BY id DESC LIMIT $4)
+		UNION ALL
+		(SELECT id, parent_id, role, speaker, content, kind, params, created_at FROM chat_messages
+		WHERE user_name = $1 AND session_id = $2 AND kind = '' AND id > $3
+		ORDER BY id LIMIT $4)
+	) surrounding
+	ORDER BY id`, user, sessionID, messageID, size)
+}
+
+func queryHistoryMessages(ctx context.Context, db *pgxpool.Pool, sqlStr string, args ...any) ([]HistoryMessage, error) {
+	rows, err := db.Query(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []HistoryMessage
+	for rows.Next() {
+		var msg HistoryMessage
+		var createdAt time.Time
+		if err := rows.Scan(&msg.SessionID, &msg.ID, &msg.Role, &msg.Speaker, &msg.Content, &msg.Kind, &createdAt); err != nil {
+			return nil, err
+		}
+		msg.Timestamp = createdAt.Unix()
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// cacheChatMessages 把归档中的消息写回 Redis，作为热会话的缓存
+func cacheChatMessages(ctx context.Context, rdb *redis.Client, key string, messages []Message) ([]string, error) {
+	result := make([]string, 0, len(messages))
+	values := make([]any, 0, len(messages))
+	for _, msg := range messages {
+		msgJson, err := json.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, string(msgJson))
+		values = append(values, msgJson)
+	}
+	if len(values) == 0 {
+		return result, nil
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.RPush(ctx, key, values...)
+	pipe.Expire(ctx, key, ChatCacheTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,200 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrMessageNotFound 表示消息不存在或不属于该会话
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrNotEditable 表示该消息不能被编辑（只有用户消息可以编辑）
+var ErrNotEditable = errors.New("only user messages can be edited")
+
+// ErrNothingToRegenerate 表示当前分支上没有用户消息，无法重新生成回复
+var ErrNothingToRegenerate = errors.New("no reply to regenerate")
+
+// BranchMessage 是当前分支上的一条消息，Siblings 是与它同一父消息的全部消息 ID（含自身），
+// 客户端可以据此切换到其他分支
+type BranchMessage struct {
+	Message
+	Siblings []int64 `json:"siblings"`
+}
+
+type branchNode struct {
+	ID       int64
+	ParentID int64
+	Role     string
+	Kind     string
+}
+
+// EditMessage 以新的内容创建被编辑消息的兄弟节点，并把会话切换到这条新分支。
+// 原消息及其后续回复作为另一条分支保留。
+func EditMessage(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string, messageID int64, content string) (*Message, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	node, err := getBranchNode(ctx, tx, user, sessionID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind != "" || !IsUserRole(node.Role, user) {
+		return nil, ErrNotEditable
+	}
+
+	var parentID *int64
+	if node.ParentID != 0 {
+		parentID = &node.ParentID
+	}
+	content = RedactPII(ctx, db, PIISourceMessage, user, sessionID, content)
+	msg := Message{ParentID: node.ParentID, Role: RoleUser, Speaker: user, Content: content, Timestamp: time.Now().Unix()}
+	msg.ID, err = insertMessage(ctx, tx, sessionID, user, parentID, msg, time.Unix(msg.Timestamp, 0))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return &msg, refreshChatCache(ctx, rdb, db, user, sessionID)
+}
+
+// RewindReply 把会话的当前分支退回到最后一条用户消息，用于重新生成回复。
+// 被退回的回复（含智能体的过程记录）作为另一条分支保留，返回该用户消息；
+// 分支本来就停在用户消息上（例如上次生成失败或编辑后还没有回复）时保持不变，直接返回它。
+func RewindReply(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) (*Message, error) {
+	branch, err := GetArchivedChatMessage(ctx, db, sessionID, user)
+	if err != nil {
+		return nil, err
+	}
+	last := len(branch) - 1
+	if last >= 0 && IsUserRole(branch[last].Role, user) {
+		return &branch[last], nil
+	}
+	for last >= 0 && !IsUserRole(branch[last].Role, user) {
+		last--
+	}
+	if last < 0 {
+		return nil, ErrNothingToRegenerate
+	}
+
+	if err := setSessionHead(ctx, db, user, sessionID, branch[last].ID); err != nil {
+		return nil, err
+	}
+	return &branch[last], refreshChatCache(ctx, rdb, db, user, sessionID)
+}
+
+// SwitchBranch 切换到包含 messageID 的分支，沿最新的子消息一直走到叶子并设为当前分支
+func SwitchBranch(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string, messageID int64) error {
+	if _, err := getBranchNode(ctx, db, user, sessionID, messageID); err != nil {
+		return err
+	}
+
+	var leafID int64
+	err := db.QueryRow(ctx, `
+	WITH RECURSIVE descent AS (
+		SELECT $3::BIGINT AS id
+		UNION ALL
+		SELECT (SELECT max(m.id) FROM chat_messages m
+			WHERE m.user_name = $1 AND m.session_id = $2 AND m.parent_id = d.id)
+		FROM descent d
+		WHERE d.id IS NOT NULL
+	)
+	SELECT max(id) FROM descent`, user, sessionID, messageID).Scan(&leafID)
+	if err != nil {
+		return err
+	}
+
+	if err := setSessionHead(ctx, db, user, sessionID, leafID); err != nil {
+		return err
+	}
+	return refreshChatCache(ctx, rdb, db, user, sessionID)
+}
+
+// GetBranch 返回会话当前分支上的消息以及每条消息的兄弟分支
+func GetBranch(ctx context.Context, db *pgxpool.Pool, user string, sessionID string) ([]BranchMessage, error) {
+	messages, err := GetArchivedChatMessage(ctx, db, sessionID, user)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `
+	SELECT id, COALESCE(parent_id, 0) FROM chat_messages
+	WHERE user_name = $1 AND session_id = $2
+	ORDER BY id`, user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	children := map[int64][]int64{}
+	for rows.Next() {
+		var id, parentID int64
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return nil, err
+		}
+		children[parentID] = append(children[parentID], id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	branch := make([]BranchMessage, 0, len(messages))
+	for _, msg := range messages {
+		branch = append(branch, BranchMessage{Message: msg, Siblings: children[msg.ParentID]})
+	}
+	return branch, nil
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func getBranchNode(ctx context.Context, db queryRower, user string, sessionID string, messageID int64) (*branchNode, error) {
+	node := branchNode{ID: messageID}
+	err := db.QueryRow(ctx, `
+	SELECT COALESCE(parent_id, 0), role, kind FROM chat_messages
+	WHERE user_name = $1 AND session_id = $2 AND id = $3`, user, sessionID, messageID).Scan(
+		&node.ParentID, &node.Role, &node.Kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func setSessionHead(ctx context.Context, db *pgxpool.Pool, user string, sessionID string, headID int64) error {
+	tag, err := db.Exec(ctx, `
+	UPDATE chat_sessions SET head_id = $3, updated_at = now()
+	WHERE user_name = $1 AND id = $2`, user, sessionID, headID)
+	if err != nil {
+		return fmt.Errorf("error moving session head: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// refreshChatCache 在当前分支变化后用归档中的分支重建 Redis 缓存
+func refreshChatCache(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) error {
+	messages, err := GetArchivedChatMessage(ctx, db, sessionID, user)
+	if err != nil {
+		return err
+	}
+	key := "chat:" + user + ":" + sessionID
+	if len(messages) == 0 {
+		return rdb.Del(ctx, key).Err()
+	}
+	_, err = cacheChatMessages(ctx, rdb, key, messages)
+	return err
+}
@@ -0,0 +1,91 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aiagent/pkg/moderation"
+	"github.com/aiagent/pkg/pii"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ModerationAudit 是审核日志中的一条记录
+type ModerationAudit struct {
+	ID        int64           `json:"id"`
+	Stage     string          `json:"stage"`
+	User      string          `json:"user"`
+	SessionID string          `json:"session_id"`
+	Action    string          `json:"action"`
+	Content   string          `json:"content"`
+	Flags     json.RawMessage `json:"flags"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func CreateModerationTable(ctx context.Context, db *pgxpool.Pool) error {
+	_, err := db.Exec(ctx, `
+	CREATE TABLE IF NOT EXISTS moderation_audit (
+		id BIGSERIAL PRIMARY KEY,
+		stage TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		session_id TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		content TEXT NOT NULL,
+		flags JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS moderation_audit_user_idx ON moderation_audit (user_name, created_at);`)
+	if err != nil {
+		return fmt.Errorf("error creating moderation table: %w", err)
+	}
+	return nil
+}
+
+// SaveModerationAudit 写入一条审核日志。原文和命中的片段先经过 RedactPII 脱敏，原文按配置加密保存一份
+func SaveModerationAudit(ctx context.Context, db *pgxpool.Pool, entry moderation.AuditEntry) error {
+	content := RedactPII(ctx, db, PIISourceModeration, entry.User, entry.SessionID, entry.Content)
+	flags := make([]moderation.Flag, 0, len(entry.Flags))
+	for _, flag := range entry.Flags {
+		// 命中片段取自原文，原文已经按需保存过，这里只脱敏
+		flag.Match, _ = pii.Default.Redact(flag.Match)
+		flags = append(flags, flag)
+	}
+	data, err := json.Marshal(flags)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, `
+	INSERT INTO moderation_audit (stage, user_name, session_id, action, content, flags)
+	VALUES ($1, $2, $3, $4, $5, $6)`,
+		entry.Stage, entry.User, entry.SessionID, entry.Action, content, data)
+	if err != nil {
+		return fmt.Errorf("error saving moderation audit: %w", err)
+	}
+	return nil
+}
+
+// ListModerationAudit 按时间倒序读取审核日志，user 为空时读取全部用户的记录
+func ListModerationAudit(ctx context.Context, db *pgxpool.Pool, user string, action string, limit int) ([]ModerationAudit, error) {
+	rows, err := db.Query(ctx, `
+	SELECT id, stage, user_name, session_id, action, content, flags, created_at FROM moderation_audit
+	WHERE ($1 = '' OR user_name = $1) AND ($2 = '' OR action = $2)
+	ORDER BY id DESC
+	LIMIT $3`, user, action, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ModerationAudit{}
+	for rows.Next() {
+		var entry ModerationAudit
+		if err := rows.Scan(&entry.ID, &entry.Stage, &entry.User, &entry.SessionID, &entry.Action,
+			&entry.Content, &entry.Flags, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
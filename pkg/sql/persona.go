@@ -0,0 +1,385 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrCharaNotFound 表示角色不存在
+	ErrCharaNotFound = errors.New("chara not found")
+	// ErrCharaVersionNotFound 表示角色没有请求的历史版本
+	ErrCharaVersionNotFound = errors.New("chara version not found")
+)
+
+// DialogueExample 是一轮示例对话
+type DialogueExample struct {
+	User string `json:"user" yaml:"user"`
+	AI   string `json:"ai" yaml:"ai"`
+}
+
+// ModelParams 是角色的生成参数，未设置的字段使用模型默认值
+type ModelParams struct {
+	Temperature      *float64 `json:"temperature,omitempty" yaml:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty" yaml:"top_p,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty" yaml:"max_tokens,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty" yaml:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty" yaml:"frequency_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty" yaml:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty" yaml:"seed,omitempty"`
+}
+
+// StyleGuard 是角色回复必须满足的风格规则，未设置的规则不检查
+type StyleGuard struct {
+	// BannedPhrases 是不允许出现的说法（不区分大小写）
+	BannedPhrases []string `json:"banned_phrases,omitempty" yaml:"banned_phrases,omitempty"`
+	// RequiredMarkers 要求回复中至少出现其中一个，例如“喵”
+	RequiredMarkers []string `json:"required_markers,omitempty" yaml:"required_markers,omitempty"`
+	// RequireKaomoji 要求回复中带有颜文字
+	RequireKaomoji bool `json:"require_kaomoji,omitempty" yaml:"require_kaomoji,omitempty"`
+	// MaxLength 是回复的最大字数
+	MaxLength int `json:"max_length,omitempty" yaml:"max_length,omitempty"`
+	// Language 是回复使用的语言：zh / en / ja
+	Language string `json:"language,omitempty" yaml:"language,omitempty"`
+}
+
+// IsZero 判断是否没有设置任何规则
+func (g StyleGuard) IsZero() bool {
+	return len(g.BannedPhrases) == 0 && len(g.RequiredMarkers) == 0 && !g.RequireKaomoji &&
+		g.MaxLength == 0 && g.Language == ""
+}
+
+// IsZero 判断是否没有设置任何参数
+func (p ModelParams) IsZero() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == 0 &&
+		p.PresencePenalty == nil && p.FrequencyPenalty == nil && len(p.Stop) == 0 && p.Seed == nil
+}
+
+// Merge 返回用 override 中已设置的字段覆盖后的参数，override 可以为空
+func (p ModelParams) Merge(override *ModelParams) ModelParams {
+	if override == nil {
+		return p
+	}
+	if override.Temperature != nil {
+		p.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		p.TopP = override.TopP
+	}
+	if override.MaxTokens != 0 {
+		p.MaxTokens = override.MaxTokens
+	}
+	if override.PresencePenalty != nil {
+		p.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != nil {
+		p.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if len(override.Stop) > 0 {
+		p.Stop = override.Stop
+	}
+	if override.Seed != nil {
+		p.Seed = override.Seed
+	}
+	return p
+}
+
+// Record 返回保存在回复消息上的参数，没有设置任何参数时为空
+func (p ModelParams) Record() *ModelParams {
+	if p.IsZero() {
+		return nil
+	}
+	return &p
+}
+
+// SystemPrompt 把提示词、风格规则和示例对话拼成发给模型的系统提示
+func (c *CharaPrompt) SystemPrompt() string {
+	var b strings.Builder
+	b.WriteString(c.Prompt)
+	if len(c.Style) > 0 {
+		b.WriteString("\n\n说话风格：")
+		for _, rule := range c.Style {
+			b.WriteString("\n- " + rule)
+		}
+	}
+	if len(c.Examples) > 0 {
+		name := c.Name
+		if name == "" {
+			name = "你"
+		}
+		b.WriteString("\n\n示例对话：")
+		for _, example := range c.Examples {
+			b.WriteString("\n用户：" + example.User)
+			b.WriteString("\n" + name + "：" + example.AI)
+		}
+	}
+	return b.String()
+}
+
+// Validate 检查角色设定的必填字段
+func (c *CharaPrompt) Validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("chara name is required")
+	}
+	if strings.TrimSpace(c.Prompt) == "" {
+		return errors.New("chara prompt is required")
+	}
+	switch c.Guard.Language {
+	case "", "zh", "en", "ja":
+	default:
+		return fmt.Errorf("unsupported guard language %q", c.Guard.Language)
+	}
+	for _, tool := range c.Tools {
+		if strings.Contains(tool, ",") {
+			return fmt.Errorf("invalid tool name %q", tool)
+		}
+	}
+	return nil
+}
+
+// charaUpdateRetries 是并发更新同一角色时 UpdateChara 的最多尝试次数
+const charaUpdateRetries = 10
+
+func charaVersionsKey(roleID string) string {
+	return "ai:chara:" + roleID + ":versions"
+}
+
+// nextCharaID 从 ai:chara:seq 分配新的角色 ID。
+// 计数器不存在时（旧数据）先用已有的最大 ID 初始化，保证不会和已有角色冲突。
+func nextCharaID(ctx context.Context, rdb *redis.Client) (string, error) {
+	exists, err := rdb.Exists(ctx, "ai:chara:seq").Result()
+	if err != nil {
+		return "", err
+	}
+	if exists == 0 {
+		ids, err := GetAllCharaIDs(ctx, rdb)
+		if err != nil {
+			return "", err
+		}
+		var max int64
+		for _, id := range ids {
+			if n, err := strconv.ParseInt(id, 10, 64); err == nil && n > max {
+				max = n
+			}
+		}
+		if err := rdb.SetNX(ctx, "ai:chara:seq", max, 0).Err(); err != nil {
+			return "", err
+		}
+	}
+	id, err := rdb.Incr(ctx, "ai:chara:seq").Result()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func encodeChara(chara CharaPrompt) ([]interface{}, error) {
+	examples, err := json.Marshal(chara.Examples)
+	if err != nil {
+		return nil, err
+	}
+	style, err := json.Marshal(chara.Style)
+	if err != nil {
+		return nil, err
+	}
+	params, err := json.Marshal(chara.Params)
+	if err != nil {
+		return nil, err
+	}
+	guard, err := json.Marshal(chara.Guard)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		"name", chara.Name,
+		"prompt", chara.Prompt,
+		"greeting", chara.Greeting,
+		"generate_greeting", strconv.FormatBool(chara.GenerateGreeting),
+		"examples", string(examples),
+		"style", string(style),
+		"params", string(params),
+		"guard", string(guard),
+		"tools", strings.Join(chara.Tools, ","),
+		"version", chara.Version,
+		"updated_at", chara.UpdatedAt,
+	}, nil
+}
+
+// decodeChara 解析角色哈希，旧数据只有 name / prompt / tools
+func decodeChara(roleID string, values map[string]string) *CharaPrompt {
+	chara := &CharaPrompt{
+		ID:       roleID,
+		Name:     values["name"],
+		Prompt:   values["prompt"],
+		Greeting: values["greeting"],
+		Tools:    splitList(values["tools"]),
+	}
+	chara.GenerateGreeting, _ = strconv.ParseBool(values["generate_greeting"])
+	if raw := values["examples"]; raw != "" {
+		json.Unmarshal([]byte(raw), &chara.Examples)
+	}
+	if raw := values["style"]; raw != "" {
+		json.Unmarshal([]byte(raw), &chara.Style)
+	}
+	if raw := values["params"]; raw != "" {
+		json.Unmarshal([]byte(raw), &chara.Params)
+	}
+	if raw := values["guard"]; raw != "" {
+		json.Unmarshal([]byte(raw), &chara.Guard)
+	}
+	chara.Version, _ = strconv.Atoi(values["version"])
+	chara.UpdatedAt, _ = strconv.ParseInt(values["updated_at"], 10, 64)
+	return chara
+}
+
+// saveCharaVersion 写入角色当前内容并追加一份历史快照
+func saveCharaVersion(ctx context.Context, rdb *redis.Client, chara CharaPrompt) error {
+	pipe := rdb.TxPipeline()
+	if err := queueCharaVersion(ctx, pipe, chara); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// queueCharaVersion 把写入角色内容和历史快照的命令加入事务
+func queueCharaVersion(ctx context.Context, pipe redis.Pipeliner, chara CharaPrompt) error {
+	fields, err := encodeChara(chara)
+	if err != nil {
+		return err
+	}
+	snapshot, err := json.Marshal(chara)
+	if err != nil {
+		return err
+	}
+	pipe.HSet(ctx, "ai:chara:"+chara.ID, fields...)
+	pipe.RPush(ctx, charaVersionsKey(chara.ID), snapshot)
+	pipe.SAdd(ctx, "ai:chara:ids", chara.ID)
+	return nil
+}
+
+// GetCharaByID 按 ID 读取角色，不存在时返回 ErrCharaNotFound
+func GetCharaByID(ctx context.Context, rdb *redis.Client, roleID string) (*CharaPrompt, error) {
+	roleID = strings.TrimPrefix(roleID, "ai:chara:")
+	values, err := rdb.HGetAll(ctx, "ai:chara:"+roleID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrCharaNotFound
+	}
+	return decodeChara(roleID, values), nil
+}
+
+// CreateChara 分配新 ID 并保存角色的第一个版本
+func CreateChara(ctx context.Context, rdb *redis.Client, chara CharaPrompt) (*CharaPrompt, error) {
+	if err := chara.Validate(); err != nil {
+		return nil, err
+	}
+	roleID, err := nextCharaID(ctx, rdb)
+	if err != nil {
+		return nil, fmt.Errorf("error allocating chara id: %w", err)
+	}
+	chara.ID = roleID
+	chara.Version = 1
+	chara.UpdatedAt = time.Now().Unix()
+	if err := saveCharaVersion(ctx, rdb, chara); err != nil {
+		return nil, err
+	}
+	return &chara, nil
+}
+
+// UpdateChara 用新的内容覆盖角色并生成一个新版本，ID 保持不变。
+// 版本号在 WATCH 的事务中分配，并发更新时后提交的一方重试，不会产生重复的版本
+func UpdateChara(ctx context.Context, rdb *redis.Client, roleID string, chara CharaPrompt) (*CharaPrompt, error) {
+	if err := chara.Validate(); err != nil {
+		return nil, err
+	}
+	roleID = strings.TrimPrefix(roleID, "ai:chara:")
+	key := "ai:chara:" + roleID
+	for attempt := 0; attempt < charaUpdateRetries; attempt++ {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			values, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if len(values) == 0 {
+				return ErrCharaNotFound
+			}
+			current := decodeChara(roleID, values)
+			now := time.Now().Unix()
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				// 旧数据没有历史快照，先把当前内容记为版本 1
+				if current.Version == 0 {
+					current.Version = 1
+					current.UpdatedAt = now
+					if err := queueCharaVersion(ctx, pipe, *current); err != nil {
+						return err
+					}
+				}
+				chara.ID = current.ID
+				chara.Version = current.Version + 1
+				chara.UpdatedAt = now
+				return queueCharaVersion(ctx, pipe, chara)
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &chara, nil
+	}
+	return nil, fmt.Errorf("error updating chara %s: too many concurrent updates", roleID)
+}
+
+// ListCharaVersions 返回角色的全部历史版本，按版本号从新到旧排列
+func ListCharaVersions(ctx context.Context, rdb *redis.Client, roleID string) ([]CharaPrompt, error) {
+	roleID = strings.TrimPrefix(roleID, "ai:chara:")
+	current, err := GetCharaByID(ctx, rdb, roleID)
+	if err != nil {
+		return nil, err
+	}
+	raws, err := rdb.LRange(ctx, charaVersionsKey(roleID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]CharaPrompt, 0, len(raws))
+	for _, raw := range raws {
+		var chara CharaPrompt
+		if err := json.Unmarshal([]byte(raw), &chara); err != nil {
+			return nil, fmt.Errorf("error decoding chara version: %w", err)
+		}
+		versions = append(versions, chara)
+	}
+	if len(versions) == 0 {
+		// 旧数据只有当前内容
+		versions = append(versions, *current)
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// RollbackChara 把角色恢复到某个历史版本，恢复的内容作为新版本保存，历史不会丢失
+func RollbackChara(ctx context.Context, rdb *redis.Client, roleID string, version int) (*CharaPrompt, error) {
+	versions, err := ListCharaVersions(ctx, rdb, roleID)
+	if err != nil {
+		return nil, err
+	}
+	for _, chara := range versions {
+		if chara.Version == version {
+			return UpdateChara(ctx, rdb, roleID, chara)
+		}
+	}
+	return nil, ErrCharaVersionNotFound
+}
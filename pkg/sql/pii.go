@@ -0,0 +1,101 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/pii"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// 原文来源
+const (
+	PIISourceMessage = "message"
+	PIISourceMemory  = "memory"
+	// PIISourceModeration 是审核日志中被标记的原文
+	PIISourceModeration = "moderation"
+)
+
+// PIIRecord 是加密保存的一条被脱敏的原文
+type PIIRecord struct {
+	ID        int64     `json:"id"`
+	Source    string    `json:"source"`
+	User      string    `json:"user"`
+	SessionID string    `json:"session_id"`
+	Kinds     []string  `json:"kinds"`
+	Sealed    []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func CreatePIIVaultTable(ctx context.Context, db *pgxpool.Pool) error {
+	_, err := db.Exec(ctx, `
+	CREATE TABLE IF NOT EXISTS pii_vault (
+		id BIGSERIAL PRIMARY KEY,
+		source TEXT NOT NULL,
+		user_name TEXT NOT NULL DEFAULT '',
+		session_id TEXT NOT NULL DEFAULT '',
+		kinds TEXT[] NOT NULL,
+		sealed BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS pii_vault_user_idx ON pii_vault (user_name, session_id, created_at);`)
+	if err != nil {
+		return fmt.Errorf("error creating pii vault table: %w", err)
+	}
+	return nil
+}
+
+// RedactPII 用 pii.Default 脱敏要保存的文本；配置了密钥且 db 不为 nil 时加密保存一份原文。
+// 保存原文失败只记录日志，不影响脱敏后的文本保存
+func RedactPII(ctx context.Context, db *pgxpool.Pool, source string, user string, sessionID string, text string) string {
+	redacted, findings := pii.Default.Redact(text)
+	if len(findings) == 0 {
+		return text
+	}
+	kinds := pii.Kinds(findings)
+	logging.FromContext(ctx).Info("redacted pii", "kinds", kinds, "source", source, logging.KeyUser, user)
+	if db == nil {
+		return redacted
+	}
+	sealed, err := pii.Default.Seal(text)
+	if err != nil {
+		logging.FromContext(ctx).Error("error sealing pii", logging.KeyError, err)
+		return redacted
+	}
+	if sealed == nil {
+		return redacted
+	}
+	_, err = db.Exec(ctx, `INSERT INTO pii_vault (source, user_name, session_id, kinds, sealed) VALUES ($1, $2, $3, $4, $5)`,
+		source, user, sessionID, kinds, sealed)
+	if err != nil {
+		logging.FromContext(ctx).Error("error saving pii vault", logging.KeyError, err)
+	}
+	return redacted
+}
+
+// ListPIIRecords 按时间倒序读取加密保存的原文，user 和 sessionID 为空时不过滤
+func ListPIIRecords(ctx context.Context, db *pgxpool.Pool, user string, sessionID string, limit int) ([]PIIRecord, error) {
+	rows, err := db.Query(ctx, `
+	SELECT id, source, user_name, session_id, kinds, sealed, created_at FROM pii_vault
+	WHERE ($1 = '' OR user_name = $1) AND ($2 = '' OR session_id = $2)
+	ORDER BY id DESC
+	LIMIT $3`, user, sessionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []PIIRecord{}
+	for rows.Next() {
+		var record PIIRecord
+		if err := rows.Scan(&record.ID, &record.Source, &record.User, &record.SessionID, &record.Kinds,
+			&record.Sealed, &record.CreatedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
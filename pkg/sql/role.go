@@ -0,0 +1,43 @@
+package sql
+
+import "strings"
+
+// 消息的规范角色，显示用的名字（用户名、角色名）保存在 Speaker 中
+const (
+	RoleUser = "user"
+	RoleAI   = "ai"
+)
+
+// NormalizeRole 把旧数据中的角色转换为规范角色：等于用户名的视为用户，
+// 其他名字（如角色名）视为 AI，原来的名字保存在 Speaker 中。
+// Redis 中的旧消息不做改写，读取消息的地方都要经过这里
+func NormalizeRole(msg Message, user string) Message {
+	switch msg.Role {
+	case RoleUser, RoleAI:
+		return msg
+	case user:
+		msg.Role = RoleUser
+		if msg.Speaker == "" {
+			msg.Speaker = user
+		}
+		return msg
+	}
+	if msg.Speaker == "" && !strings.EqualFold(msg.Role, RoleAI) {
+		msg.Speaker = msg.Role
+	}
+	msg.Role = RoleAI
+	return msg
+}
+
+// IsUserRole 判断消息是否由用户发出，兼容旧数据中以用户名作为角色的消息
+func IsUserRole(role string, user string) bool {
+	return NormalizeRole(Message{Role: role}, user).Role == RoleUser
+}
+
+// SpeakerName 返回消息的显示名字，没有记录时使用规范角色
+func SpeakerName(msg Message) string {
+	if msg.Speaker != "" {
+		return msg.Speaker
+	}
+	return msg.Role
+}
@@ -0,0 +1,92 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrRoomNotFound 表示群聊房间不存在
+var ErrRoomNotFound = errors.New("room not found")
+
+// Room 是多人共享的群聊房间，保存在 Redis 哈希 room:<id> 中，成员保存在集合 room:<id>:members 中
+type Room struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Persona string `json:"persona"`
+	// Triggers 是让角色回复的关键词，@角色名时总会回复
+	Triggers  []string `json:"triggers,omitempty"`
+	CreatedBy string   `json:"created_by"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// RoomHistoryUser 返回保存房间聊天记录时使用的归属用户，房间记录作为该用户下 ID 为房间 ID 的会话保存
+func RoomHistoryUser(roomID string) string {
+	return "room:" + roomID
+}
+
+// CreateRoom 创建房间，房间已存在时返回已有的房间
+func CreateRoom(ctx context.Context, rdb *redis.Client, room Room) (*Room, error) {
+	if room.ID == "" || strings.Contains(room.ID, ":") {
+		return nil, fmt.Errorf("invalid room id %q", room.ID)
+	}
+	if room.CreatedAt == 0 {
+		room.CreatedAt = time.Now().Unix()
+	}
+	if room.Name == "" {
+		room.Name = room.ID
+	}
+
+	key := "room:" + room.ID
+	created, err := rdb.HSetNX(ctx, key, "id", room.ID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return GetRoom(ctx, rdb, room.ID)
+	}
+	err = rdb.HSet(ctx, key,
+		"name", room.Name,
+		"persona", room.Persona,
+		"triggers", strings.Join(room.Triggers, ","),
+		"created_by", room.CreatedBy,
+		"created_at", room.CreatedAt,
+	).Err()
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func GetRoom(ctx context.Context, rdb *redis.Client, roomID string) (*Room, error) {
+	values, err := rdb.HGetAll(ctx, "room:"+roomID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrRoomNotFound
+	}
+	createdAt, _ := strconv.ParseInt(values["created_at"], 10, 64)
+	return &Room{
+		ID:        roomID,
+		Name:      values["name"],
+		Persona:   values["persona"],
+		Triggers:  splitList(values["triggers"]),
+		CreatedBy: values["created_by"],
+		CreatedAt: createdAt,
+	}, nil
+}
+
+// JoinRoom 把用户加入房间成员
+func JoinRoom(ctx context.Context, rdb *redis.Client, roomID string, user string) error {
+	return rdb.SAdd(ctx, "room:"+roomID+":members", user).Err()
+}
+
+func GetRoomMembers(ctx context.Context, rdb *redis.Client, roomID string) ([]string, error) {
+	return rdb.SMembers(ctx, "room:"+roomID+":members").Result()
+}
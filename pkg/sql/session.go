@@ -0,0 +1,426 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/pii"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrSessionNotFound 表示会话不存在或不属于该用户
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionForbidden 表示会话属于其他用户
+var ErrSessionForbidden = errors.New("session belongs to another user")
+
+const sessionTitleLength = 30
+
+type Session struct {
+	ID           string    `json:"id"`
+	User         string    `json:"user"`
+	Title        string    `json:"title"`
+	Persona      string    `json:"persona"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	MessageCount int       `json:"message_count"`
+}
+
+// SessionMeta 是会话开始时写入 Redis 哈希 session:<id> 的元数据
+type SessionMeta struct {
+	ID         string `json:"id"`
+	User       string `json:"user"`
+	Persona    string `json:"persona"`
+	Model      string `json:"model"`
+	UserAgent  string `json:"user_agent"`
+	RemoteAddr string `json:"remote_addr"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+func SaveSessionMeta(ctx context.Context, rdb *redis.Client, meta SessionMeta) error {
+	if meta.CreatedAt == 0 {
+		meta.CreatedAt = time.Now().Unix()
+	}
+	return rdb.HSet(ctx, "session:"+meta.ID,
+		"user", meta.User,
+		"persona", meta.Persona,
+		"model", meta.Model,
+		"user_agent", meta.UserAgent,
+		"remote_addr", meta.RemoteAddr,
+		"created_at", meta.CreatedAt,
+	).Err()
+}
+
+func GetSessionMeta(ctx context.Context, rdb *redis.Client, sessionID string) (*SessionMeta, error) {
+	result, err := rdb.HGetAll(ctx, "session:"+sessionID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	createdAt, _ := strconv.ParseInt(result["created_at"], 10, 64)
+	return &SessionMeta{
+		ID:         sessionID,
+		User:       result["user"],
+		Persona:    result["persona"],
+		Model:      result["model"],
+		UserAgent:  result["user_agent"],
+		RemoteAddr: result["remote_addr"],
+		CreatedAt:  createdAt,
+	}, nil
+}
+
+func DeleteSessionMeta(ctx context.Context, rdb *redis.Client, sessionID string) error {
+	return rdb.Del(ctx, "session:"+sessionID).Err()
+}
+
+// ValidateSessionOwner 确认会话属于 user。有元数据时以元数据为准，
+// 没有元数据的旧会话则要求该用户名下存在对应的归档或 Redis 记录。
+func ValidateSessionOwner(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) error {
+	if user == "" || sessionID == "" {
+		return ErrSessionNotFound
+	}
+	meta, err := GetSessionMeta(ctx, rdb, sessionID)
+	if err == nil {
+		if meta.User != user {
+			return ErrSessionForbidden
+		}
+		return nil
+	}
+	if !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+
+	if db != nil {
+		_, err := GetSession(ctx, db, user, sessionID)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+	exists, err := rdb.Exists(ctx, "chat:"+user+":"+sessionID).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// CreateSession 在归档中登记会话，已存在时保持原有的标题和角色。
+// 以角色问候语开始的会话登记时没有标题，之后由第一条用户消息补上
+func CreateSession(ctx context.Context, db *pgxpool.Pool, user string, sessionID string, persona string, firstMessage string) error {
+	_, err := db.Exec(ctx, `
+	INSERT INTO chat_sessions (id, user_name, title, persona)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_name, id) DO UPDATE SET title = EXCLUDED.title
+	WHERE chat_sessions.title = ''`,
+		sessionID, user, sessionTitle(firstMessage), persona)
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	return nil
+}
+
+// GetSession 读取单个会话的信息
+func GetSession(ctx context.Context, db *pgxpool.Pool, user string, sessionID string) (*Session, error) {
+	var session Session
+	err := db.QueryRow(ctx, `
+	SELECT s.id, s.user_name, s.title, s.persona, s.created_at, s.updated_at,
+		(SELECT count(*) FROM chat_messages m WHERE m.user_name = s.user_name AND m.session_id = s.id)
+	FROM chat_sessions s
+	WHERE s.user_name = $1 AND s.id = $2`, user, sessionID).Scan(
+		&session.ID, &session.User, &session.Title, &session.Persona,
+		&session.CreatedAt, &session.UpdatedAt, &session.MessageCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ListSessions 按最近更新时间分页列出用户的会话，返回本页会话和总数。
+// 第一次列出时会把仅存在于 Redis 中的旧会话同步到归档。
+func ListSessions(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, offset int, limit int) ([]Session, int, error) {
+	if err := archiveLegacySessions(ctx, rdb, db, user); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		limit = 20
+	}
+
+	var total int
+	err := db.QueryRow(ctx, `SELECT count(*) FROM chat_sessions WHERE user_name = $1`, user).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(ctx, `
+	SELECT s.id, s.user_name, s.title, s.persona, s.created_at, s.updated_at, count(m.id)
+	FROM chat_sessions s
+	LEFT JOIN chat_messages m ON m.user_name = s.user_name AND m.session_id = s.id
+	WHERE s.user_name = $1
+	GROUP BY s.user_name, s.id
+	ORDER BY s.updated_at DESC
+	OFFSET $2 LIMIT $3`, user, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.User, &session.Title, &session.Persona,
+			&session.CreatedAt, &session.UpdatedAt, &session.MessageCount); err != nil {
+			return nil, 0, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return sessions, total, nil
+}
+
+func RenameSession(ctx context.Context, db *pgxpool.Pool, user string, sessionID string, title string) error {
+	tag, err := db.Exec(ctx, `
+	UPDATE chat_sessions SET title = $3, updated_at = now()
+	WHERE user_name = $1 AND id = $2`, user, sessionID, strings.TrimSpace(title))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// DeleteSession 删除会话的归档与 Redis 缓存
+func DeleteSession(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) error {
+	tag, err := db.Exec(ctx, `DELETE FROM chat_sessions WHERE user_name = $1 AND id = $2`, user, sessionID)
+	if err != nil {
+		return err
+	}
+	deleted, err := rdb.Del(ctx, "chat:"+user+":"+sessionID).Result()
+	if err != nil {
+		return err
+	}
+	if err := rdb.Del(ctx, legacyArchiveKey(user, sessionID)).Err(); err != nil {
+		return err
+	}
+	if meta, err := GetSessionMeta(ctx, rdb, sessionID); err == nil && meta.User == user {
+		if err := DeleteSessionMeta(ctx, rdb, sessionID); err != nil {
+			return err
+		}
+	}
+	if tag.RowsAffected() == 0 && deleted == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// ForkSession 把会话中从第一条消息到 fromMessageID 的分支复制到新会话，
+// fromMessageID 为 0 时复制当前分支
+func ForkSession(ctx context.Context, db *pgxpool.Pool, user string, sessionID string, fromMessageID int64, newSessionID string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var headID *int64
+	err = tx.QueryRow(ctx, `SELECT head_id FROM chat_sessions WHERE user_name = $1 AND id = $2`,
+		user, sessionID).Scan(&headID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO chat_sessions (id, user_name, title, persona)
+	SELECT $3, user_name, title || ' (fork)', persona
+	FROM chat_sessions WHERE user_name = $1 AND id = $2`, user, sessionID, newSessionID)
+	if err != nil {
+		return fmt.Errorf("error forking session: %w", err)
+	}
+
+	leafID := fromMessageID
+	if leafID == 0 {
+		if headID == nil {
+			return tx.Commit(ctx)
+		}
+		leafID = *headID
+	}
+	messages, err := getBranch(ctx, tx, user, sessionID, leafID)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("message %d not found in session %s", fromMessageID, sessionID)
+	}
+
+	var parentID *int64
+	for _, msg := range messages {
+		id, err := insertMessage(ctx, tx, newSessionID, user, parentID, msg, time.Unix(msg.Timestamp, 0))
+		if err != nil {
+			return fmt.Errorf("error copying messages: %w", err)
+		}
+		parentID = &id
+	}
+	return tx.Commit(ctx)
+}
+
+// ImportSession 在一个事务中写入会话及其消息，保留原有的标题、角色和时间。
+// 消息的 ID 会被忽略，由归档重新分配，并按顺序连成一条分支。
+func ImportSession(ctx context.Context, db *pgxpool.Pool, session Session, messages []Message) error {
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+	if session.UpdatedAt.IsZero() {
+		session.UpdatedAt = session.CreatedAt
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO chat_sessions (id, user_name, title, persona, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6)`,
+		session.ID, session.User, session.Title, session.Persona, session.CreatedAt, session.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("error importing session: %w", err)
+	}
+
+	var parentID *int64
+	for _, msg := range messages {
+		createdAt := time.Unix(msg.Timestamp, 0)
+		if msg.Timestamp == 0 {
+			createdAt = session.CreatedAt
+		}
+		id, err := insertMessage(ctx, tx, session.ID, session.User, parentID, msg, createdAt)
+		if err != nil {
+			return fmt.Errorf("error importing message: %w", err)
+		}
+		parentID = &id
+	}
+	return tx.Commit(ctx)
+}
+
+// legacyArchiveKey 是旧会话已经（或正在）同步到归档的标记，sessionID 为空时表示用户的全部会话已经扫描过
+func legacyArchiveKey(user string, sessionID string) string {
+	if sessionID == "" {
+		return "archive:legacy:" + user
+	}
+	return "archive:legacy:" + user + ":" + sessionID
+}
+
+// migrateOnceWith 用 SETNX 标记保证 migrate 只被执行一次，其他调用直接返回；migrate 失败时清除标记以便重试
+func migrateOnceWith(ctx context.Context, rdb *redis.Client, key string, migrate func() error) error {
+	ok, err := rdb.SetNX(ctx, key, time.Now().Unix(), 0).Result()
+	if err != nil || !ok {
+		return err
+	}
+	if err := migrate(); err != nil {
+		rdb.Del(ctx, key)
+		return err
+	}
+	return nil
+}
+
+// archiveLegacySessions 把只存在于 Redis 中、尚未归档的会话写入 Postgres，每个用户只扫描一次
+func archiveLegacySessions(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string) error {
+	return migrateOnceWith(ctx, rdb, legacyArchiveKey(user, ""), func() error {
+		sessionIDs, err := GetAllChatMessionID(ctx, rdb, user)
+		if err != nil {
+			return err
+		}
+		for _, sessionID := range sessionIDs {
+			if err := ArchiveLegacySession(ctx, rdb, db, user, sessionID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ArchiveLegacySession 在会话尚未归档时把 Redis 中的消息写入 Postgres，
+// 续写旧会话前调用，避免缓存过期后丢失归档前的消息。并发调用时只有一个会执行同步
+func ArchiveLegacySession(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) error {
+	_, err := GetSession(ctx, db, user, sessionID)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+	return migrateOnceWith(ctx, rdb, legacyArchiveKey(user, sessionID), func() error {
+		return archiveLegacySession(ctx, rdb, db, user, sessionID)
+	})
+}
+
+func archiveLegacySession(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string, sessionID string) error {
+	key := "chat:" + user + ":" + sessionID
+	raw, err := rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	messages := make([]Message, 0, len(raw))
+	for _, item := range raw {
+		msg, err := decodeMessage(item)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	firstUserMessage := ""
+	for _, msg := range messages {
+		if IsUserRole(msg.Role, user) {
+			firstUserMessage = msg.Content
+			break
+		}
+	}
+	if err := CreateSession(ctx, db, user, sessionID, "", firstUserMessage); err != nil {
+		return err
+	}
+	for i := range messages {
+		id, err := ArchiveChatMessage(ctx, db, messages[i], sessionID, user)
+		if err != nil {
+			return err
+		}
+		messages[i].ID = id
+	}
+	_, err = cacheChatMessages(ctx, rdb, key, messages)
+	return err
+}
+
+func sessionTitle(firstMessage string) string {
+	// 标题取自首条消息，同样需要脱敏，原文已随消息保存
+	firstMessage, _ = pii.Default.Redact(firstMessage)
+	title := []rune(strings.TrimSpace(strings.ReplaceAll(firstMessage, "\n", " ")))
+	if len(title) > sessionTitleLength {
+		return string(title[:sessionTitleLength]) + "…"
+	}
+	return string(title)
+}
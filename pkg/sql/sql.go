@@ -4,23 +4,54 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
 
+// CharaPrompt 是角色设定，保存在 Redis 哈希 ai:chara:<id> 中，历史版本见 persona.go
 type CharaPrompt struct {
-	Name   string
-	Prompt string
+	// ID 是稳定的角色 ID，由 ai:chara:seq 分配，删除后不会复用
+	ID     string `json:"id,omitempty" yaml:"id,omitempty"`
+	Name   string `json:"name" yaml:"name"`
+	Prompt string `json:"prompt" yaml:"prompt"`
+	// Greeting 是新会话开始时角色说的第一句话
+	Greeting string `json:"greeting,omitempty" yaml:"greeting,omitempty"`
+	// GenerateGreeting 为 true 时结合用户的记忆和上次的对话生成问候语，Greeting 作为参考和生成失败时的兜底
+	GenerateGreeting bool `json:"generate_greeting,omitempty" yaml:"generate_greeting,omitempty"`
+	// Examples 是示例对话，会拼接进系统提示
+	Examples []DialogueExample `json:"examples,omitempty" yaml:"examples,omitempty"`
+	// Style 是说话风格规则，每条一句
+	Style  []string    `json:"style,omitempty" yaml:"style,omitempty"`
+	Params ModelParams `json:"params,omitempty" yaml:"params,omitempty"`
+	// Guard 是生成后检查回复的风格规则，见 pkg/style
+	Guard StyleGuard `json:"guard,omitempty" yaml:"guard,omitempty"`
+	// Tools 是该角色允许调用的工具白名单，"*" 表示全部
+	Tools []string `json:"tools,omitempty" yaml:"tools,omitempty"`
+	// Version 从 1 开始，每次修改加一；旧数据没有版本时为 0
+	Version   int   `json:"version,omitempty" yaml:"version,omitempty"`
+	UpdatedAt int64 `json:"updated_at,omitempty" yaml:"updated_at,omitempty"`
 }
 
 type Message struct {
+	// ID 是消息在 Postgres 归档中的 ID，未归档时为 0
+	ID int64 `json:"id,omitempty"`
+	// ParentID 是当前分支上的上一条消息，会话的第一条消息为 0
+	ParentID int64 `json:"parent_id,omitempty"`
+	// Role 是规范角色 RoleUser / RoleAI，Speaker 是显示用的名字（用户名或角色名）
 	Role      string `json:"role"`
+	Speaker   string `json:"speaker,omitempty"`
 	Content   string `json:"content"`
 	Timestamp int64  `json:"timestamp"`
+	// Kind 标记智能体模式的过程记录（plan / step / reflection 等），普通对话为空
+	Kind string `json:"kind,omitempty"`
+	// Params 是生成这条回复时实际使用的参数，只有 AI 回复才有
+	Params *ModelParams `json:"params,omitempty"`
 }
 
 // POSTGRES
@@ -37,6 +68,8 @@ func CreatePSQLClient(ctx context.Context) (*pgxpool.Pool, error) {
 	postgresConfig.MaxConns = 10
 	postgresConfig.MinConns = 1
 	postgresConfig.MaxConnLifetime = time.Hour
+	// 查询出错时计入 aiagent_store_errors_total
+	postgresConfig.ConnConfig.Tracer = metrics.PGTracer{}
 
 	pool, err := pgxpool.NewWithConfig(ctx, postgresConfig)
 
@@ -97,7 +130,29 @@ func CreatePSQLTable(ctx context.Context, db *pgxpool.Pool) error {
 	if err != nil {
 		return fmt.Errorf("error creating table: %w", err)
 	}
-	return nil
+
+	// 检索内容的注入检测：flagged 表示疑似包含指令，quarantined 的内容不再参与检索
+	_, err = db.Exec(ctx, `
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS flag_reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE documents ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE memory ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE memory ADD COLUMN IF NOT EXISTS flag_reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE memory ADD COLUMN IF NOT EXISTS quarantined BOOLEAN NOT NULL DEFAULT false;
+	`)
+	if err != nil {
+		return fmt.Errorf("error migrating table: %w", err)
+	}
+	if err := CreateUsageTable(ctx, db); err != nil {
+		return err
+	}
+	if err := CreatePIIVaultTable(ctx, db); err != nil {
+		return err
+	}
+	if err := CreateModerationTable(ctx, db); err != nil {
+		return err
+	}
+	return CreateArchiveTable(ctx, db)
 }
 
 func GetAllDocument(ctx context.Context, db *pgxpool.Pool) ([]string, error) {
@@ -134,50 +189,20 @@ func CreateRedisClient(ctx context.Context) (*redis.Client, error) {
 		MinIdleConns: 5,
 		PoolTimeout:  30 * time.Second,
 	})
+	// 命令出错时计入 aiagent_store_errors_total
+	rdb.AddHook(metrics.RedisHook{})
 	return rdb, nil
 }
 
+// CountCharaPrompt 返回已登记的角色数量
 func CountCharaPrompt(ctx context.Context, rdb *redis.Client) (int64, error) {
-	baseCount := 0
-	var cursor uint64
-	for {
-		// 执行 SCAN 命令
-		var keys []string
-		var err error
-		keys, cursor, err = rdb.Scan(ctx, cursor, "ai:chara:*", 0).Result()
-		if err != nil {
-			fmt.Printf("Error scanning keys: %v\n", err)
-			return 0, err
-		}
-
-		// 更新计数器
-		baseCount += len(keys)
-
-		// 如果游标为 0，表示遍历完成
-		if cursor == 0 {
-			break
-		}
-	}
-	// 输出结果
-	return int64(baseCount), nil
+	return rdb.SCard(ctx, "ai:chara:ids").Result()
 }
 
+// SaveCharaPrompt 用名字和提示词创建一个新角色
 func SaveCharaPrompt(ctx context.Context, rdb *redis.Client, chara string, content string) error {
-	baseCount, err := CountCharaPrompt(ctx, rdb)
-	if err != nil {
-		return fmt.Errorf("error counting chara prompts: %w", err)
-	}
-	roleID := fmt.Sprint(baseCount + 1)
-	key := fmt.Sprintf("ai:chara:%s", roleID)
-
-	res := rdb.HSet(ctx, key, "name", chara, "prompt", content)
-
-	if err := res.Err(); err != nil {
-		return err
-	}
-
-	rdb.SAdd(ctx, "ai:chara:ids", roleID)
-	return nil
+	_, err := CreateChara(ctx, rdb, CharaPrompt{Name: chara, Prompt: content})
+	return err
 }
 
 func RemoveCharaPrompt(ctx context.Context, rdb *redis.Client, roleID string) error {
@@ -192,8 +217,8 @@ func RemoveCharaPrompt(ctx context.Context, rdb *redis.Client, roleID string) er
 		return fmt.Errorf("角色不存在: %s", key)
 	}
 
-	// 删除整个角色 Hash
-	if err := rdb.Del(ctx, key).Err(); err != nil {
+	// 删除整个角色 Hash 和历史版本
+	if err := rdb.Del(ctx, key, charaVersionsKey(roleID)).Err(); err != nil {
 		return fmt.Errorf("删除角色失败: %v", err)
 	}
 
@@ -202,7 +227,7 @@ func RemoveCharaPrompt(ctx context.Context, rdb *redis.Client, roleID string) er
 		return fmt.Errorf("从ID集合中移除失败: %v", err)
 	}
 
-	fmt.Printf("成功删除角色 %s\n", roleID)
+	logging.FromContext(ctx).Info("deleted chara", "chara", roleID)
 	return nil
 }
 func CleanInvalidCharaIDs(ctx context.Context, rdb *redis.Client) error {
@@ -217,7 +242,7 @@ func CleanInvalidCharaIDs(ctx context.Context, rdb *redis.Client) error {
 		if exists == 0 {
 			// 删除失效 ID
 			rdb.SRem(ctx, "ai:chara:ids", id)
-			fmt.Printf("清理无效角色ID: %s\n", id)
+			logging.FromContext(ctx).Info("removed invalid chara id", "chara", id)
 		}
 	}
 	return nil
@@ -226,68 +251,179 @@ func GetCharaPrompt(ctx context.Context, rdb *redis.Client, roleID string) (*Cha
 
 	result, err := rdb.HGetAll(ctx, roleID).Result()
 	if err != nil {
-		log.Fatal("Error getting chara prompt from Redis:", err)
+		return nil, fmt.Errorf("error getting chara prompt from Redis: %w", err)
 	}
 	if len(result) == 0 {
 		return nil, fmt.Errorf("no chara found with roleID %s", roleID)
 	}
-	charaPrompt := &CharaPrompt{
-		Name:   result["name"],
-		Prompt: result["prompt"],
+	return decodeChara(strings.TrimPrefix(roleID, "ai:chara:"), result), nil
+}
+
+// SetCharaTools 设置角色的工具白名单，会生成一个新版本
+func SetCharaTools(ctx context.Context, rdb *redis.Client, roleID string, tools []string) error {
+	chara, err := GetCharaByID(ctx, rdb, roleID)
+	if err != nil {
+		return err
+	}
+	chara.Tools = tools
+	_, err = UpdateChara(ctx, rdb, roleID, *chara)
+	return err
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return charaPrompt, nil
+	return items
 }
 func GetAllCharaIDs(ctx context.Context, rdb *redis.Client) ([]string, error) {
 	return rdb.SMembers(ctx, "ai:chara:ids").Result()
 }
 
-func GetAllChatMessionID(ctx context.Context, rdb *redis.Client, user string) ([]string, error) {
-	// 扫描出所有符合条件的会话 ID
-	messionsID, _, err := rdb.Scan(ctx, 0, "chat:"+user+":*", 0).Result()
+// FindCharaPrompt 按 ID（"3" 或 "ai:chara:3"）或角色名查找角色设定
+func FindCharaPrompt(ctx context.Context, rdb *redis.Client, ref string) (*CharaPrompt, error) {
+	roleID := strings.TrimPrefix(ref, "ai:chara:")
+	exists, err := rdb.SIsMember(ctx, "ai:chara:ids", roleID).Result()
 	if err != nil {
-		fmt.Printf("Error scanning for daily messages: %v\n", err)
 		return nil, err
 	}
+	if exists {
+		return GetCharaPrompt(ctx, rdb, "ai:chara:"+roleID)
+	}
 
-	if len(messionsID) == 0 {
-		return []string{"这个人没有对话喵"}, nil
+	ids, err := GetAllCharaIDs(ctx, rdb)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		name, err := rdb.HGet(ctx, "ai:chara:"+id, "name").Result()
+		if err != nil {
+			continue
+		}
+		if name == ref {
+			return GetCharaPrompt(ctx, rdb, "ai:chara:"+id)
+		}
 	}
+	return nil, fmt.Errorf("no chara found with name or id %s", ref)
+}
 
+// GetAllChatMessionID 返回用户在 Redis 中的全部会话 ID，没有会话时返回空列表
+func GetAllChatMessionID(ctx context.Context, rdb *redis.Client, user string) ([]string, error) {
+	prefix := "chat:" + user + ":"
+	messionsID := []string{}
+	var cursor uint64
+	for {
+		keys, next, err := rdb.Scan(ctx, cursor, prefix+"*", 100).Result()
+		if err != nil {
+			logging.FromContext(ctx).Error("error scanning for chat sessions", logging.KeyError, err)
+			return nil, err
+		}
+		for _, key := range keys {
+			messionID := strings.TrimPrefix(key, prefix)
+			// 用户名中含有 ":" 时可能匹配到其他用户的会话
+			if !strings.Contains(messionID, ":") {
+				messionsID = append(messionsID, messionID)
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
 	return messionsID, nil
 }
 
-func SaveChatMessage(ctx context.Context, rdb *redis.Client, message Message, messionID string, user string) error {
+func decodeMessage(raw string) (Message, error) {
+	var msg Message
+	err := json.Unmarshal([]byte(raw), &msg)
+	return msg, err
+}
+
+// SaveChatMessage 保存一条聊天消息。db 不为 nil 时先写入 Postgres 归档，
+// 再写入 Redis 作为热会话缓存（write-through）；db 为 nil 时只写 Redis。
+func SaveChatMessage(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, message Message, messionID string, user string) error {
+	message = NormalizeRole(message, user)
+	// 个人信息在写入 Redis 和归档（以及之后的向量化）之前脱敏，回复中复述的也一并处理
+	message.Content = RedactPII(ctx, db, PIISourceMessage, user, messionID, message.Content)
+	if db != nil {
+		id, err := ArchiveChatMessage(ctx, db, message, messionID, user)
+		if err != nil {
+			return err
+		}
+		message.ID = id
+	}
+
 	msgJson, err := json.Marshal(message)
 	if err != nil {
-		fmt.Printf("Error marshalling message: %v\n", err)
+		return fmt.Errorf("error marshalling message: %w", err)
 	}
 
 	key := "chat:" + user + ":" + messionID
-	err = rdb.RPush(ctx, key, msgJson).Err()
-
-	if err != nil {
-		panic(err)
+	pipe := rdb.TxPipeline()
+	if db != nil {
+		// 缓存过期或被清空后不能只写入这一条，否则读取时会把它当作完整历史而不再回填；
+		// 缓存不存在时跳过，由下次 GetChatMessage 从归档回填
+		pipe.RPushX(ctx, key, msgJson)
+		pipe.Expire(ctx, key, ChatCacheTTL)
+	} else {
+		pipe.RPush(ctx, key, msgJson)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error caching message: %w", err)
 	}
 
 	return nil
 }
 
-func GetChatMessage(ctx context.Context, rdb *redis.Client, messionID string, user string) ([]string, error) {
+// GetChatMessage 读取会话的全部消息（JSON 字符串），Redis 未命中时从归档读取并回填缓存
+func GetChatMessage(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, messionID string, user string) ([]string, error) {
 	chatList := "chat:" + user + ":" + messionID
 	result, err := rdb.LRange(ctx, chatList, 0, -1).Result()
 
 	if err != nil {
-		fmt.Printf("Error getting chat message: %v\n", err)
+		logging.FromContext(ctx).Error("error getting chat message", logging.KeyError, err)
 		return nil, err
 	}
-	return result, nil
+	if len(result) > 0 || db == nil {
+		return result, nil
+	}
+
+	archived, err := GetArchivedChatMessage(ctx, db, messionID, user)
+	if err != nil {
+		return nil, fmt.Errorf("error reading chat archive: %w", err)
+	}
+	return cacheChatMessages(ctx, rdb, chatList, archived)
 }
 
-func GetDailyChatMessage(ctx context.Context, rdb *redis.Client, user string) ([]string, error) {
+func GetDailyChatMessage(ctx context.Context, rdb *redis.Client, db *pgxpool.Pool, user string) ([]string, error) {
+	if db != nil {
+		// 有归档时直接按时间查询今天的消息
+		year, month, day := time.Now().Date()
+		messages, err := GetArchivedMessagesSince(ctx, db, user, time.Date(year, month, day, 0, 0, 0, 0, time.Local))
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			return []string{"今天没有对话喵"}, nil
+		}
+		var allMessages []string
+		for _, msg := range messages {
+			msgJson, err := json.Marshal(msg)
+			if err != nil {
+				return nil, err
+			}
+			allMessages = append(allMessages, string(msgJson))
+		}
+		return allMessages, nil
+	}
+
 	// 扫描出所有符合条件的会话 ID
 	dailyMessionIds, _, err := rdb.Scan(ctx, 0, "chat:"+user+":*", 0).Result()
 	if err != nil {
-		fmt.Printf("Error scanning for daily messages: %v\n", err)
+		logging.FromContext(ctx).Error("error scanning for daily messages", logging.KeyError, err)
 		return nil, err
 	}
 
@@ -297,10 +433,11 @@ func GetDailyChatMessage(ctx context.Context, rdb *redis.Client, user string) ([
 
 	var allMessages []string
 	// 获取每个会话的消息并将它们追加到 allMessages 列表中
-	for _, messionID := range dailyMessionIds {
-		messages, err := GetChatMessage(ctx, rdb, messionID, user)
+	for _, messionKey := range dailyMessionIds {
+		messionID := strings.TrimPrefix(messionKey, "chat:"+user+":")
+		messages, err := GetChatMessage(ctx, rdb, nil, messionID, user)
 		if err != nil {
-			fmt.Printf("Error getting chat messages for mession %s: %v\n", messionID, err)
+			logging.FromContext(ctx).Error("error getting chat messages", logging.KeySessionID, messionID, logging.KeyError, err)
 			continue // 如果某个会话出错，跳过这个会话
 		}
 		allMessages = append(allMessages, messages...) // 将每个会话的消息添加到最终结果中
@@ -0,0 +1,74 @@
+package sql
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StyleMetrics 是角色回复风格检查的累计统计，保存在 Redis 哈希 style:metrics:<角色名> 中
+type StyleMetrics struct {
+	Persona string `json:"persona"`
+	// Checked 是检查过的回复数，Violated 是第一次生成就违规的回复数
+	Checked  int64 `json:"checked"`
+	Violated int64 `json:"violated"`
+	// Regenerated 是重新生成的次数，Fixed 是重新生成后通过检查的次数
+	Regenerated int64 `json:"regenerated"`
+	Fixed       int64 `json:"fixed"`
+	// Rules 是各规则的违规次数
+	Rules map[string]int64 `json:"rules"`
+}
+
+func styleMetricsKey(persona string) string {
+	return "style:metrics:" + persona
+}
+
+// RecordStyleCheck 记录一次风格检查，rules 是第一次生成的回复违反的规则
+func RecordStyleCheck(ctx context.Context, rdb *redis.Client, persona string, rules []string, regenerated bool, fixed bool) error {
+	key := styleMetricsKey(persona)
+	pipe := rdb.TxPipeline()
+	pipe.HIncrBy(ctx, key, "checked", 1)
+	if len(rules) > 0 {
+		pipe.HIncrBy(ctx, key, "violated", 1)
+	}
+	for _, rule := range rules {
+		pipe.HIncrBy(ctx, key, "rule:"+rule, 1)
+	}
+	if regenerated {
+		pipe.HIncrBy(ctx, key, "regenerated", 1)
+	}
+	if fixed {
+		pipe.HIncrBy(ctx, key, "fixed", 1)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetStyleMetrics 读取角色的风格检查统计，没有记录时各项为 0
+func GetStyleMetrics(ctx context.Context, rdb *redis.Client, persona string) (*StyleMetrics, error) {
+	values, err := rdb.HGetAll(ctx, styleMetricsKey(persona)).Result()
+	if err != nil {
+		return nil, err
+	}
+	metrics := &StyleMetrics{Persona: persona, Rules: map[string]int64{}}
+	for field, value := range values {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch field {
+		case "checked":
+			metrics.Checked = n
+		case "violated":
+			metrics.Violated = n
+		case "regenerated":
+			metrics.Regenerated = n
+		case "fixed":
+			metrics.Fixed = n
+		default:
+			if rule, ok := strings.CutPrefix(field, "rule:"); ok {
+				metrics.Rules[rule] = n
+			}
+		}
+	}
+	return metrics, nil
+}
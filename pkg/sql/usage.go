@@ -0,0 +1,91 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aiagent/pkg/usage"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UsageSummary 是某个用户某一天的用量合计
+type UsageSummary struct {
+	Day              string  `json:"day"`
+	User             string  `json:"user"`
+	Kind             string  `json:"kind"`
+	Model            string  `json:"model"`
+	Calls            int64   `json:"calls"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+}
+
+func CreateUsageTable(ctx context.Context, db *pgxpool.Pool) error {
+	_, err := db.Exec(ctx, `
+	CREATE TABLE IF NOT EXISTS llm_usage (
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		user_name TEXT NOT NULL DEFAULT '',
+		session_id TEXT NOT NULL DEFAULT '',
+		persona TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		prompt_tokens INT NOT NULL DEFAULT 0,
+		completion_tokens INT NOT NULL DEFAULT 0,
+		latency_ms INT NOT NULL DEFAULT 0,
+		cost DOUBLE PRECISION NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE INDEX IF NOT EXISTS llm_usage_user_idx ON llm_usage (user_name, created_at);
+	CREATE INDEX IF NOT EXISTS llm_usage_created_idx ON llm_usage (created_at);`)
+	if err != nil {
+		return fmt.Errorf("error creating usage table: %w", err)
+	}
+	return nil
+}
+
+// SaveUsage 写入一次模型或向量化调用的用量
+func SaveUsage(ctx context.Context, db *pgxpool.Pool, record usage.Record) error {
+	_, err := db.Exec(ctx, `
+	INSERT INTO llm_usage (kind, user_name, session_id, persona, model, prompt_tokens, completion_tokens, latency_ms, cost, error)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		record.Kind, record.User, record.SessionID, record.Persona, record.Model,
+		record.PromptTokens, record.CompletionTokens, record.Latency.Milliseconds(), record.Cost, record.Error)
+	if err != nil {
+		return fmt.Errorf("error saving usage: %w", err)
+	}
+	return nil
+}
+
+// UsageReport 按用户、日期（UTC）、调用种类和模型汇总 [from, to) 之间的用量，user 为空时汇总全部用户
+func UsageReport(ctx context.Context, db *pgxpool.Pool, user string, from time.Time, to time.Time) ([]UsageSummary, error) {
+	rows, err := db.Query(ctx, `
+	SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, user_name, kind, model,
+		count(*), count(*) FILTER (WHERE error <> ''),
+		coalesce(sum(prompt_tokens), 0), coalesce(sum(completion_tokens), 0),
+		coalesce(sum(cost), 0), coalesce(avg(latency_ms), 0)
+	FROM llm_usage
+	WHERE ($1 = '' OR user_name = $1) AND created_at >= $2 AND created_at < $3
+	GROUP BY day, user_name, kind, model
+	ORDER BY day DESC, user_name, kind, model`, user, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []UsageSummary{}
+	for rows.Next() {
+		var summary UsageSummary
+		if err := rows.Scan(&summary.Day, &summary.User, &summary.Kind, &summary.Model,
+			&summary.Calls, &summary.Errors, &summary.PromptTokens, &summary.CompletionTokens,
+			&summary.Cost, &summary.AvgLatencyMs); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
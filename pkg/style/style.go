@@ -0,0 +1,166 @@
+package style
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/aiagent/pkg/sql"
+)
+
+// 违规的规则名，也用作统计中的字段名
+const (
+	RuleBannedPhrase  = "banned_phrase"
+	RuleMissingMarker = "missing_marker"
+	RuleKaomoji       = "kaomoji"
+	RuleMaxLength     = "max_length"
+	RuleLanguage      = "language"
+)
+
+// Violation 是回复违反的一条风格规则
+type Violation struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+// Result 是一次检查（以及可能的重新生成）的结果
+type Result struct {
+	Content string
+	// Violations 是第一次生成的回复的违规，为空表示直接通过
+	Violations []Violation
+	// Regenerated 表示是否带着反馈重新生成过
+	Regenerated bool
+	// Remaining 是最终回复仍然存在的违规
+	Remaining []Violation
+}
+
+// kaomojiPattern 匹配括号中由符号组成的颜文字，如 (=^･ω･^=)、(≧▽≦)
+var kaomojiPattern = regexp.MustCompile(`[(（][^()（）\p{Han}\p{Latin}\p{Hiragana}\p{Katakana}\p{N}\s]{2,}[)）]`)
+
+// kaomojiRunes 是颜文字中常见、正常文字中很少出现的字符
+const kaomojiRunes = "ω▽≧≦´｀･◕‿﹏∀ﾉヾ๑ᴗ°□╯╰"
+
+// Check 按风格规则检查回复，返回全部违规
+func Check(guard sql.StyleGuard, content string) []Violation {
+	var violations []Violation
+	lower := strings.ToLower(content)
+	for _, phrase := range guard.BannedPhrases {
+		if phrase != "" && strings.Contains(lower, strings.ToLower(phrase)) {
+			violations = append(violations, Violation{Rule: RuleBannedPhrase, Detail: phrase})
+		}
+	}
+	if len(guard.RequiredMarkers) > 0 && !containsAny(content, guard.RequiredMarkers) {
+		violations = append(violations, Violation{Rule: RuleMissingMarker, Detail: strings.Join(guard.RequiredMarkers, "、")})
+	}
+	if guard.RequireKaomoji && !HasKaomoji(content) {
+		violations = append(violations, Violation{Rule: RuleKaomoji})
+	}
+	if length := len([]rune(content)); guard.MaxLength > 0 && length > guard.MaxLength {
+		violations = append(violations, Violation{Rule: RuleMaxLength, Detail: fmt.Sprintf("%d/%d", length, guard.MaxLength)})
+	}
+	if guard.Language != "" && !matchesLanguage(content, guard.Language) {
+		violations = append(violations, Violation{Rule: RuleLanguage, Detail: guard.Language})
+	}
+	return violations
+}
+
+// HasKaomoji 判断文本中是否带有颜文字
+func HasKaomoji(content string) bool {
+	return kaomojiPattern.MatchString(content) || strings.ContainsAny(content, kaomojiRunes)
+}
+
+// Feedback 把违规整理成重新生成时给模型的提示
+func Feedback(violations []Violation) string {
+	var lines []string
+	for _, v := range violations {
+		switch v.Rule {
+		case RuleBannedPhrase:
+			lines = append(lines, fmt.Sprintf("不要使用“%s”这样的说法", v.Detail))
+		case RuleMissingMarker:
+			lines = append(lines, fmt.Sprintf("回复中要带上%s", v.Detail))
+		case RuleKaomoji:
+			lines = append(lines, "回复中要带上颜文字")
+		case RuleMaxLength:
+			lines = append(lines, fmt.Sprintf("回复太长了（%s 字），请缩短", v.Detail))
+		case RuleLanguage:
+			lines = append(lines, "请使用"+languageName(v.Detail)+"回复")
+		}
+	}
+	return "上一条回复不符合你的角色设定：\n- " + strings.Join(lines, "\n- ") +
+		"\n请按要求重新回复，只输出新的回复内容。"
+}
+
+// Enforce 检查回复，不合格时带着反馈调用 regenerate 重新生成一次。
+// 重新生成失败时保留原回复
+func Enforce(guard sql.StyleGuard, content string, regenerate func(feedback string) (string, error)) (Result, error) {
+	result := Result{Content: content}
+	if guard.IsZero() {
+		return result, nil
+	}
+	result.Violations = Check(guard, content)
+	result.Remaining = result.Violations
+	if len(result.Violations) == 0 || regenerate == nil {
+		return result, nil
+	}
+
+	retry, err := regenerate(Feedback(result.Violations))
+	if err != nil {
+		return result, err
+	}
+	result.Regenerated = true
+	result.Content = retry
+	result.Remaining = Check(guard, retry)
+	return result, nil
+}
+
+func containsAny(content string, markers []string) bool {
+	for _, marker := range markers {
+		if marker != "" && strings.Contains(content, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLanguage 按文字比例粗略判断回复的语言，颜文字和标点不计入
+func matchesLanguage(content string, language string) bool {
+	var han, kana, latin int
+	for _, r := range content {
+		switch {
+		case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case r < unicode.MaxASCII && unicode.IsLetter(r):
+			latin++
+		}
+	}
+	// 英文按字母计数，中日文按字计数，一个英文单词大约相当于一个汉字
+	words := latin / 4
+	total := han + kana + words
+	if total == 0 {
+		return true
+	}
+	switch language {
+	case "zh":
+		return han*2 >= total && kana*5 < total
+	case "ja":
+		return kana > 0 && (han+kana)*2 >= total
+	case "en":
+		return words*2 >= total
+	}
+	return true
+}
+
+func languageName(language string) string {
+	switch language {
+	case "zh":
+		return "中文"
+	case "ja":
+		return "日语"
+	case "en":
+		return "英语"
+	}
+	return language
+}
@@ -3,37 +3,84 @@ package timer
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+	"github.com/aiagent/pkg/rag"
 	"github.com/aiagent/pkg/sql"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
 )
 
+// SummaryMemoryJob 是总结每日对话的定时任务名，用于 aiagent_scheduler_jobs_total
+const SummaryMemoryJob = "summary_memory"
+
+// IndexChatHistoryJob 是为归档消息生成 embedding 的定时任务名
+const IndexChatHistoryJob = "index_chat_history"
+
+// IndexChatHistoryInterval 是 IndexChatHistoryJob 的执行间隔
+const IndexChatHistoryInterval = time.Minute
+
+// TimerIndexChatHistory 每隔 interval 为全部用户新归档的消息生成 embedding，供 rag.SearchHistory 语义检索，ctx 结束时退出
+func TimerIndexChatHistory(ctx context.Context, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		indexChatHistory(ctx, db, embedder)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func indexChatHistory(ctx context.Context, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl) {
+	start := time.Now()
+	indexed, err := rag.IndexChatHistory(ctx, db, embedder, "")
+	metrics.ObserveJob(IndexChatHistoryJob, start, err)
+	if err != nil {
+		slog.Error("error indexing chat history", "job", IndexChatHistoryJob, logging.KeyError, err)
+		return
+	}
+	if indexed > 0 {
+		slog.Debug("indexed chat history", "job", IndexChatHistoryJob, "count", indexed)
+	}
+}
+
 func TimerSummaryMemory(rdb *redis.Client, db *pgxpool.Pool, user string) {
 	ctx := context.Background()
+	logger := slog.With(logging.KeyUser, user, "job", SummaryMemoryJob)
+	start := time.Now()
+	var err error
+	defer func() { metrics.ObserveJob(SummaryMemoryJob, start, err) }()
+
 	llm, err := base.CreateLLMClient()
 	if err != nil {
-		fmt.Printf("Error creating LLM: %s", err)
+		logger.Error("error creating LLM", logging.KeyError, err)
+		return
 	}
 	messages := []llms.MessageContent{}
 	messages = append(messages, llms.TextParts(llms.ChatMessageTypeSystem, "总结对话历史，返回一段作为记忆体的内容"))
 
-	dailyChatList, err := sql.GetDailyChatMessage(ctx, rdb, user)
+	dailyChatList, err := sql.GetDailyChatMessage(ctx, rdb, db, user)
 
 	if err != nil {
-		fmt.Printf("Error getting daily chat message: %s", err)
+		logger.Error("error getting daily chat message", logging.KeyError, err)
+		return
 	}
 
 	var doc string
 	doc += "以下是对话历史："
 	for _, message := range dailyChatList {
 		var msg string
-		err = json.Unmarshal([]byte(message), &msg)
-		if err != nil {
-			fmt.Printf("Error unmarshalling message: %s", err)
+		if err := json.Unmarshal([]byte(message), &msg); err != nil {
+			logger.Error("error unmarshalling message", logging.KeyError, err)
 		}
 		doc += msg
 	}
@@ -43,8 +90,9 @@ func TimerSummaryMemory(rdb *redis.Client, db *pgxpool.Pool, user string) {
 	result, err := llm.GenerateContent(ctx, messages)
 
 	if err != nil {
-		fmt.Printf("Error generating content: %s", err)
+		logger.Error("error generating content", logging.KeyError, err)
+		return
 	}
 
-	fmt.Printf("Result: %s\n", result.Choices[0].Content)
+	logger.Debug("summary memory generated", "content", result.Choices[0].Content)
 }
@@ -0,0 +1,74 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/rag"
+	"github.com/aiagent/pkg/sql"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+type searchHistoryArgs struct {
+	Query string `json:"query"`
+	// Days 限定只检索最近若干天的消息，0 表示不限
+	Days  int `json:"days,omitempty"`
+	Limit int `json:"limit,omitempty"`
+}
+
+// RegisterHistoryTools 注册 search_history 工具，检索当前用户过去的聊天记录。
+// 它不属于 KnowledgeTools，两种检索模式下都按角色的白名单（包括 *）使用
+func RegisterHistoryTools(r *Registry, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl) error {
+	return r.Register(Tool{
+		Name:        "search_history",
+		Description: "检索和当前用户过去的聊天记录，例如“上周聊过的面包”",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{"type": "string", "description": "要查找的话题或关键词"},
+				"days":  map[string]any{"type": "integer", "description": "只检索最近多少天，默认不限"},
+				"limit": map[string]any{"type": "integer", "description": "最多返回的条数，默认 5"},
+			},
+			"required": []string{"query"},
+		},
+		Handler: func(ctx context.Context, args string) (string, error) {
+			user := UserFromContext(ctx)
+			if user == "" {
+				return "", fmt.Errorf("no user in context")
+			}
+			var input searchHistoryArgs
+			if err := json.Unmarshal([]byte(args), &input); err != nil {
+				return "", fmt.Errorf("invalid arguments: %w", err)
+			}
+			if strings.TrimSpace(input.Query) == "" {
+				return "", fmt.Errorf("query is empty")
+			}
+
+			search := rag.HistorySearch{User: user, Query: input.Query, Limit: input.Limit, ContextSize: 1}
+			if input.Days > 0 {
+				search.Since = time.Now().AddDate(0, 0, -input.Days)
+			}
+			hits, err := rag.SearchHistory(ctx, db, embedder, search)
+			if err != nil {
+				return "", err
+			}
+			if len(hits) == 0 {
+				return "没有找到相关的聊天记录", nil
+			}
+
+			var sb strings.Builder
+			for _, hit := range hits {
+				fmt.Fprintf(&sb, "[%s 会话 %s] %s: %s\n",
+					time.Unix(hit.Timestamp, 0).Format("2006-01-02 15:04"), hit.SessionID, sql.SpeakerName(hit.Message), hit.Content)
+				for _, msg := range hit.Context {
+					fmt.Fprintf(&sb, "    %s: %s\n", sql.SpeakerName(msg), msg.Content)
+				}
+			}
+			return strings.TrimSuffix(sb.String(), "\n"), nil
+		},
+	})
+}
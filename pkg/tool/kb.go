@@ -0,0 +1,130 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aiagent/pkg/rag"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+// KnowledgeTools 是知识库相关的内置工具名，工具驱动检索模式下会自动加入白名单，
+// 注入模式下由检索结果代替
+var KnowledgeTools = []string{"search_docs", "recall_memory", "save_memory"}
+
+const (
+	defaultTopK = 3
+	// maxTopK 是模型一次最多能取回的条数
+	maxTopK = 10
+)
+
+type queryArgs struct {
+	Query string `json:"query"`
+	TopK  int    `json:"top_k,omitempty"`
+}
+
+type saveMemoryArgs struct {
+	Content string `json:"content"`
+}
+
+var queryParameters = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"query": map[string]any{"type": "string", "description": "检索用的问题或关键词"},
+		"top_k": map[string]any{"type": "integer", "description": "最多返回的条数，默认 3，最多 10"},
+	},
+	"required": []string{"query"},
+}
+
+// RegisterKnowledgeTools 注册 KnowledgeTools 中的 search_docs、recall_memory、save_memory，
+// 聊天记录检索 search_history 由 RegisterHistoryTools 单独注册
+func RegisterKnowledgeTools(r *Registry, db *pgxpool.Pool, embedder *embeddings.EmbedderImpl) error {
+	tools := []Tool{
+		{
+			Name:        "search_docs",
+			Description: "在知识库中检索与问题相关的背景资料",
+			Parameters:  queryParameters,
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return retrieve(ctx, args, embedder, func(vec []float64, topK int) ([]string, error) {
+					return rag.RetrieveRelevantDocs(ctx, vec, topK, db)
+				})
+			},
+		},
+		{
+			Name:        "recall_memory",
+			Description: "回忆与当前话题相关的过去记忆",
+			Parameters:  queryParameters,
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return retrieve(ctx, args, embedder, func(vec []float64, topK int) ([]string, error) {
+					return rag.RetrieveRelevantMemory(ctx, vec, topK, db)
+				})
+			},
+		},
+		{
+			Name:        "save_memory",
+			Description: "把值得长期记住的事情保存为记忆，使用第一人称简洁描述",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"content": map[string]any{"type": "string", "description": "要保存的记忆内容"},
+				},
+				"required": []string{"content"},
+			},
+			Handler: func(ctx context.Context, args string) (string, error) {
+				var input saveMemoryArgs
+				if err := json.Unmarshal([]byte(args), &input); err != nil {
+					return "", fmt.Errorf("invalid arguments: %w", err)
+				}
+				if strings.TrimSpace(input.Content) == "" {
+					return "", fmt.Errorf("content is empty")
+				}
+				// 记下这条记忆来自哪位用户，群聊中尤其需要区分
+				if user := UserFromContext(ctx); user != "" {
+					input.Content = rag.MemoryOwnerPrefix(user) + input.Content
+				}
+				if err := rag.InsertMemory(ctx, db, input.Content, embedder); err != nil {
+					return "", err
+				}
+				return "记忆已保存", nil
+			},
+		},
+	}
+
+	for _, t := range tools {
+		if err := r.Register(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func retrieve(ctx context.Context, args string, embedder *embeddings.EmbedderImpl, search func([]float64, int) ([]string, error)) (string, error) {
+	var input queryArgs
+	if err := json.Unmarshal([]byte(args), &input); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(input.Query) == "" {
+		return "", fmt.Errorf("query is empty")
+	}
+	if input.TopK <= 0 {
+		input.TopK = defaultTopK
+	}
+	input.TopK = min(input.TopK, maxTopK)
+
+	vec, err := rag.EmbedText(ctx, input.Query, embedder)
+	if err != nil {
+		return "", err
+	}
+	results, err := search(vec, input.TopK)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "没有找到相关内容", nil
+	}
+	// 工具结果同样是检索到的外部内容，按不可信数据包裹后交给模型
+	return rag.WrapUntrusted("【检索结果】", results), nil
+}
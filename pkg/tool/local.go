@@ -0,0 +1,242 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	// 内嵌时区数据，避免容器内缺少 zoneinfo 时 current_time 失败
+	_ "time/tzdata"
+)
+
+// LocalTools 是不依赖数据库的确定性内置工具名
+var LocalTools = []string{"calculator", "current_time", "convert_units", "http_get"}
+
+const (
+	defaultTimezone     = "Asia/Shanghai"
+	defaultHTTPMaxBytes = 64 * 1024
+	defaultHTTPTimeout  = 5 * time.Second
+)
+
+type LocalConfig struct {
+	// HTTPAllowlist 是 http_get 允许访问的主机名，为空时 http_get 拒绝所有请求
+	HTTPAllowlist []string
+	HTTPMaxBytes  int64
+	HTTPTimeout   time.Duration
+	// Client 与 Now 可在测试中替换
+	Client *http.Client
+	Now    func() time.Time
+}
+
+// RegisterLocalTools 注册计算器、当前时间、单位换算与白名单 HTTP GET 工具
+func RegisterLocalTools(r *Registry, cfg LocalConfig) error {
+	if cfg.HTTPMaxBytes <= 0 {
+		cfg.HTTPMaxBytes = defaultHTTPMaxBytes
+	}
+	if cfg.HTTPTimeout <= 0 {
+		cfg.HTTPTimeout = defaultHTTPTimeout
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	tools := []Tool{
+		{
+			Name:        "calculator",
+			Description: "计算算术表达式，支持 + - * / % ^、括号、pi、e 以及 sqrt/abs/sin/cos/tan/ln/log/exp/floor/ceil/round",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"expression": map[string]any{"type": "string", "description": "例如 (3+4)*2^3"},
+				},
+				"required": []string{"expression"},
+			},
+			Handler: calculatorHandler,
+		},
+		{
+			Name:        "current_time",
+			Description: "获取指定时区的当前日期和时间",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"timezone": map[string]any{"type": "string", "description": "IANA 时区名，例如 Asia/Shanghai，默认 Asia/Shanghai"},
+				},
+			},
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return currentTimeHandler(args, cfg.Now)
+			},
+		},
+		{
+			Name:        "convert_units",
+			Description: "单位换算，支持长度、质量、时间、数据大小、面积、体积和温度",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"value": map[string]any{"type": "number"},
+					"from":  map[string]any{"type": "string", "description": "原单位，例如 km、lb、celsius；数据单位区分大小写，MB 是字节、Mb 是比特"},
+					"to":    map[string]any{"type": "string", "description": "目标单位"},
+				},
+				"required": []string{"value", "from", "to"},
+			},
+			Handler: convertUnitsHandler,
+		},
+		{
+			Name:        "http_get",
+			Description: "对白名单内的网址发起 HTTP GET 请求并返回响应正文（有大小和时间限制）",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"url": map[string]any{"type": "string"},
+				},
+				"required": []string{"url"},
+			},
+			Handler: func(ctx context.Context, args string) (string, error) {
+				return httpGetHandler(ctx, args, cfg)
+			},
+		},
+	}
+
+	for _, t := range tools {
+		if err := r.Register(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func calculatorHandler(ctx context.Context, args string) (string, error) {
+	var input struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal([]byte(args), &input); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	value, err := Evaluate(input.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', 12, 64), nil
+}
+
+func currentTimeHandler(args string, now func() time.Time) (string, error) {
+	var input struct {
+		Timezone string `json:"timezone"`
+	}
+	if args != "" {
+		if err := json.Unmarshal([]byte(args), &input); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+	if input.Timezone == "" {
+		input.Timezone = defaultTimezone
+	}
+	loc, err := time.LoadLocation(input.Timezone)
+	if err != nil {
+		return "", fmt.Errorf("unknown timezone %q", input.Timezone)
+	}
+	t := now().In(loc)
+	return fmt.Sprintf("%s %s (%s)", t.Format("2006-01-02 15:04:05"), t.Weekday(), input.Timezone), nil
+}
+
+func convertUnitsHandler(ctx context.Context, args string) (string, error) {
+	var input struct {
+		Value float64 `json:"value"`
+		From  string  `json:"from"`
+		To    string  `json:"to"`
+	}
+	if err := json.Unmarshal([]byte(args), &input); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	result, err := ConvertUnit(input.Value, input.From, input.To)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s = %s %s",
+		strconv.FormatFloat(input.Value, 'g', 12, 64), input.From,
+		strconv.FormatFloat(result, 'g', 12, 64), input.To), nil
+}
+
+func httpGetHandler(ctx context.Context, args string, cfg LocalConfig) (string, error) {
+	var input struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(args), &input); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	target, err := url.Parse(input.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %w", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	if !hostAllowed(target.Hostname(), cfg.HTTPAllowlist) {
+		return "", fmt.Errorf("host %s is not in the allowlist", target.Hostname())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.HTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	// 禁止重定向到白名单以外的主机
+	client := *cfg.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !hostAllowed(req.URL.Hostname(), cfg.HTTPAllowlist) {
+			return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+		}
+		if len(via) >= 3 {
+			return fmt.Errorf("too many redirects")
+		}
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.HTTPMaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	truncated := ""
+	if int64(len(body)) > cfg.HTTPMaxBytes {
+		body = body[:cfg.HTTPMaxBytes]
+		truncated = "\n[内容过长，已截断]"
+	}
+	return fmt.Sprintf("HTTP %d\n%s%s", resp.StatusCode, body, truncated), nil
+}
+
+// hostAllowed 判断主机是否在白名单内，"example.com" 同时匹配其子域名
+func hostAllowed(host string, allowlist []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	for _, allowed := range allowlist {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+		if net.ParseIP(host) == nil && strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
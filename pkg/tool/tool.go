@@ -0,0 +1,238 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// AllowAll 出现在白名单中时表示允许使用全部已注册工具
+const AllowAll = "*"
+
+// Except 加在工具名前（如 "!search_docs"）表示 AllowAll 不包含该工具，明确列出工具名时仍然允许
+const Except = "!"
+
+// DefaultMaxSteps 是一次对话中最多执行的工具调用轮数
+const DefaultMaxSteps = 5
+
+// Handler 接收模型给出的 JSON 参数字符串，返回交给模型的结果文本
+type Handler func(ctx context.Context, args string) (string, error)
+
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters 是 JSON Schema 描述的参数结构
+	Parameters map[string]any
+	Handler    Handler
+}
+
+// Event 描述一次工具调用或其结果，用于推送给客户端
+type Event struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+const (
+	EventToolCall   = "tool_call"
+	EventToolResult = "tool_result"
+)
+
+type contextKey struct{}
+
+// WithUser 把当前用户放入 context，供需要区分用户的工具读取
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(contextKey{}).(string)
+	return user
+}
+
+type Registry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{tools: map[string]Tool{}}
+}
+
+func (r *Registry) Register(t Tool) error {
+	if t.Name == "" {
+		return fmt.Errorf("tool name is empty")
+	}
+	if t.Handler == nil {
+		return fmt.Errorf("tool %s has no handler", t.Name)
+	}
+	if t.Parameters == nil {
+		t.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.tools[t.Name]; exists {
+		return fmt.Errorf("tool %s already registered", t.Name)
+	}
+	r.tools[t.Name] = t
+	return nil
+}
+
+func (r *Registry) Get(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tools[name]
+	return t, ok
+}
+
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.tools))
+	for name := range r.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Allowed 根据白名单筛选工具名，白名单为空时不允许任何工具
+func (r *Registry) Allowed(allow []string) []string {
+	var names []string
+	for _, name := range r.Names() {
+		if isAllowed(name, allow) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Definitions 返回白名单内工具的 langchaingo 定义
+func (r *Registry) Definitions(allow []string) []llms.Tool {
+	var defs []llms.Tool
+	for _, name := range r.Allowed(allow) {
+		t, _ := r.Get(name)
+		defs = append(defs, llms.Tool{
+			Type: "function",
+			Function: &llms.FunctionDefinition{
+				Name:        t.Name,
+				Description: t.Description,
+				Parameters:  t.Parameters,
+			},
+		})
+	}
+	return defs
+}
+
+// Call 执行一个工具，工具不存在或不在白名单内时返回错误
+func (r *Registry) Call(ctx context.Context, name string, args string, allow []string) (string, error) {
+	t, ok := r.Get(name)
+	if !ok || !isAllowed(name, allow) {
+		return "", fmt.Errorf("tool %s is not available", name)
+	}
+	return t.Handler(ctx, args)
+}
+
+func isAllowed(name string, allow []string) bool {
+	all, excluded := false, false
+	for _, a := range allow {
+		switch a {
+		case name:
+			return true
+		case AllowAll:
+			all = true
+		case Except + name:
+			excluded = true
+		}
+	}
+	return all && !excluded
+}
+
+// Run 调用模型并循环执行模型请求的工具，直到模型给出最终回答或达到 maxSteps。
+// 返回最终回答以及本轮追加的消息（包含工具调用与工具结果）。
+func Run(ctx context.Context, llm llms.Model, r *Registry, messages []llms.MessageContent, allow []string,
+	maxSteps int, onEvent func(Event) error, options ...llms.CallOption) (*llms.ContentChoice, []llms.MessageContent, error) {
+	var defs []llms.Tool
+	if r != nil {
+		defs = r.Definitions(allow)
+	}
+	if len(defs) > 0 {
+		options = append(options, llms.WithTools(defs))
+	}
+	if maxSteps <= 0 {
+		maxSteps = DefaultMaxSteps
+	}
+
+	history := append([]llms.MessageContent{}, messages...)
+	var added []llms.MessageContent
+
+	for step := 0; ; step++ {
+		result, err := llm.GenerateContent(ctx, history, options...)
+		if err != nil {
+			return nil, added, err
+		}
+		if len(result.Choices) == 0 {
+			return nil, added, fmt.Errorf("empty response from model")
+		}
+		choice := result.Choices[0]
+		if len(choice.ToolCalls) == 0 {
+			return choice, added, nil
+		}
+		if step >= maxSteps {
+			return nil, added, fmt.Errorf("tool call limit of %d steps exceeded", maxSteps)
+		}
+
+		callMsg := llms.MessageContent{Role: llms.ChatMessageTypeAI}
+		for _, call := range choice.ToolCalls {
+			callMsg.Parts = append(callMsg.Parts, call)
+		}
+		history = append(history, callMsg)
+		added = append(added, callMsg)
+
+		for _, call := range choice.ToolCalls {
+			if call.FunctionCall == nil {
+				continue
+			}
+			name, args := call.FunctionCall.Name, call.FunctionCall.Arguments
+			if onEvent != nil {
+				if err := onEvent(Event{Type: EventToolCall, ID: call.ID, Name: name, Arguments: args}); err != nil {
+					return nil, added, err
+				}
+			}
+
+			output, err := r.Call(ctx, name, args, allow)
+			if err != nil {
+				// 把错误交还给模型，让它自己决定如何继续
+				output = errorResult(err)
+			}
+			if onEvent != nil {
+				if err := onEvent(Event{Type: EventToolResult, ID: call.ID, Name: name, Content: output}); err != nil {
+					return nil, added, err
+				}
+			}
+
+			resultMsg := llms.MessageContent{
+				Role: llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{llms.ToolCallResponse{
+					ToolCallID: call.ID,
+					Name:       name,
+					Content:    output,
+				}},
+			}
+			history = append(history, resultMsg)
+			added = append(added, resultMsg)
+		}
+	}
+}
+
+func errorResult(err error) string {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(data)
+}
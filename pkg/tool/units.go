@@ -0,0 +1,112 @@
+package tool
+
+import (
+	"fmt"
+	"strings"
+)
+
+type unit struct {
+	category string
+	// factor 是换算到该类别基准单位的倍数
+	factor float64
+}
+
+// unitTable 的基准单位：长度 m、质量 kg、时间 s、数据 B、面积 m2、体积 L。
+// 数据单位区分大小写：B 是字节、b 是比特，KB 和 Kb 不能混用，其余单位键一律小写
+var unitTable = map[string]unit{
+	"mm": {"length", 0.001}, "cm": {"length", 0.01}, "m": {"length", 1}, "km": {"length", 1000},
+	"in": {"length", 0.0254}, "ft": {"length", 0.3048}, "yd": {"length", 0.9144}, "mi": {"length", 1609.344},
+	"里": {"length", 500}, "尺": {"length", 1.0 / 3}, "寸": {"length", 1.0 / 30},
+
+	"mg": {"mass", 1e-6}, "g": {"mass", 0.001}, "kg": {"mass", 1}, "t": {"mass", 1000},
+	"oz": {"mass", 0.028349523125}, "lb": {"mass", 0.45359237}, "斤": {"mass", 0.5}, "两": {"mass", 0.05},
+
+	"ms": {"time", 0.001}, "s": {"time", 1}, "min": {"time", 60}, "h": {"time", 3600},
+	"day": {"time", 86400}, "week": {"time", 604800},
+
+	"B": {"data", 1}, "KB": {"data", 1 << 10}, "kB": {"data", 1 << 10}, "MB": {"data", 1 << 20},
+	"GB": {"data", 1 << 30}, "TB": {"data", 1 << 40},
+	"KiB": {"data", 1 << 10}, "MiB": {"data", 1 << 20}, "GiB": {"data", 1 << 30}, "TiB": {"data", 1 << 40},
+	"b": {"data", 1.0 / 8}, "Kb": {"data", 1 << 7}, "kb": {"data", 1 << 7}, "Mb": {"data", 1 << 17},
+	"Gb": {"data", 1 << 27}, "Tb": {"data", 1 << 37},
+
+	"m2": {"area", 1}, "km2": {"area", 1e6}, "ha": {"area", 1e4}, "acre": {"area", 4046.8564224},
+	"ft2": {"area", 0.09290304}, "亩": {"area", 2000.0 / 3},
+
+	"ml": {"volume", 0.001}, "l": {"volume", 1}, "m3": {"volume", 1000},
+	"gal": {"volume", 3.785411784}, "cup": {"volume", 0.2365882365},
+}
+
+var unitAliases = map[string]string{
+	"meter": "m", "meters": "m", "米": "m", "公里": "km", "千米": "km", "厘米": "cm", "毫米": "mm",
+	"inch": "in", "inches": "in", "foot": "ft", "feet": "ft", "mile": "mi", "miles": "mi", "英里": "mi",
+	"gram": "g", "grams": "g", "克": "g", "千克": "kg", "公斤": "kg", "kilogram": "kg", "kilograms": "kg",
+	"pound": "lb", "pounds": "lb", "lbs": "lb", "磅": "lb", "ounce": "oz", "ounces": "oz", "吨": "t",
+	"sec": "s", "second": "s", "seconds": "s", "秒": "s", "minute": "min", "minutes": "min", "分钟": "min",
+	"hour": "h", "hours": "h", "小时": "h", "days": "day", "天": "day", "weeks": "week", "周": "week",
+	"byte": "B", "bytes": "B", "bit": "b", "bits": "b", "liter": "l", "liters": "l", "升": "l", "毫升": "ml", "平方米": "m2",
+	"c": "celsius", "°c": "celsius", "摄氏度": "celsius", "f": "fahrenheit", "°f": "fahrenheit",
+	"华氏度": "fahrenheit", "k": "kelvin", "开尔文": "kelvin",
+}
+
+// normalizeUnit 先按原样匹配单位表，区分大小写的数据单位只在这一步命中；
+// 匹配不到时再转成小写查别名，因此 "KM"、"Kg" 可用，而 "mB" 不会被当成 MB
+func normalizeUnit(name string) string {
+	name = strings.TrimSpace(name)
+	if _, ok := unitTable[name]; ok {
+		return name
+	}
+	name = strings.ToLower(name)
+	if alias, ok := unitAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// ConvertUnit 在同一类别的单位之间换算，温度仅支持 celsius / fahrenheit / kelvin
+func ConvertUnit(value float64, from string, to string) (float64, error) {
+	from, to = normalizeUnit(from), normalizeUnit(to)
+
+	if isTemperature(from) || isTemperature(to) {
+		if !isTemperature(from) || !isTemperature(to) {
+			return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+		}
+		return convertTemperature(value, from, to), nil
+	}
+
+	fromUnit, ok := unitTable[from]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	toUnit, ok := unitTable[to]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if fromUnit.category != toUnit.category {
+		return 0, fmt.Errorf("cannot convert %s (%s) to %s (%s)", from, fromUnit.category, to, toUnit.category)
+	}
+	return value * fromUnit.factor / toUnit.factor, nil
+}
+
+func isTemperature(name string) bool {
+	return name == "celsius" || name == "fahrenheit" || name == "kelvin"
+}
+
+func convertTemperature(value float64, from string, to string) float64 {
+	var celsius float64
+	switch from {
+	case "fahrenheit":
+		celsius = (value - 32) * 5 / 9
+	case "kelvin":
+		celsius = value - 273.15
+	default:
+		celsius = value
+	}
+	switch to {
+	case "fahrenheit":
+		return celsius*9/5 + 32
+	case "kelvin":
+		return celsius + 273.15
+	}
+	return celsius
+}
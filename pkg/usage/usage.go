@@ -0,0 +1,304 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/aiagent/pkg/metrics"
+)
+
+// 调用的种类
+const (
+	KindLLM       = "llm"
+	KindEmbedding = "embedding"
+)
+
+// Caller 是一次调用的归属，由处理请求的代码放入 context
+type Caller struct {
+	User      string
+	SessionID string
+	Persona   string
+}
+
+type callerKey struct{}
+
+// WithCaller 把调用的归属放入 context，经由该 context 发起的模型和向量化调用都记在它名下
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom 读取 context 中的调用归属，没有时返回空值
+func CallerFrom(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+// Record 是一次模型或向量化调用的用量
+type Record struct {
+	Kind             string
+	User             string
+	SessionID        string
+	Persona          string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Latency          time.Duration
+	// Cost 是按 Prices 估算的费用，没有配置价格的模型为 0
+	Cost float64
+	// Error 是调用失败时的 HTTP 状态或错误
+	Error string
+}
+
+// Price 是每一千个 token 的价格
+type Price struct {
+	Prompt     float64
+	Completion float64
+}
+
+// ParsePrices 解析 “模型:输入价格:输出价格” 以逗号分隔的列表，价格按每千 token 计，
+// 输出价格可以省略（向量化模型只有输入）
+func ParsePrices(value string) (map[string]Price, error) {
+	prices := map[string]Price{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid price %q, expected model:prompt[:completion]", item)
+		}
+		var price Price
+		var err error
+		if price.Prompt, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return nil, fmt.Errorf("invalid price %q: %w", item, err)
+		}
+		if len(fields) == 3 {
+			if price.Completion, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return nil, fmt.Errorf("invalid price %q: %w", item, err)
+			}
+		}
+		prices[fields[0]] = price
+	}
+	return prices, nil
+}
+
+// ReportDays 是没有指定起始日期时用量报表覆盖的天数
+const ReportDays = 7
+
+// DayRange 把按天（YYYY-MM-DD，UTC）给出的闭区间转换成 [from, to) 的时间范围；
+// to 默认为今天，from 默认为 to 之前的 ReportDays 天
+func DayRange(fromValue string, toValue string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if toValue != "" {
+		day, err := time.Parse(time.DateOnly, toValue)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to date %q, expected YYYY-MM-DD", toValue)
+		}
+		to = day
+	}
+	from := to.AddDate(0, 0, -(ReportDays - 1))
+	if fromValue != "" {
+		day, err := time.Parse(time.DateOnly, fromValue)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from date %q, expected YYYY-MM-DD", fromValue)
+		}
+		from = day
+	}
+	to = to.AddDate(0, 0, 1)
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from date must not be after to date")
+	}
+	return from, to, nil
+}
+
+// Tracker 计算费用并保存用量记录
+type Tracker struct {
+	Prices map[string]Price
+	Save   func(ctx context.Context, record Record) error
+}
+
+// Default 是所有模型客户端使用的 Tracker，由程序启动时设置；为 nil 时只计入指标，不保存
+var Default *Tracker
+
+// Cost 按价格估算一次调用的费用
+func (t *Tracker) Cost(model string, promptTokens int, completionTokens int) float64 {
+	price, ok := t.Prices[model]
+	if !ok {
+		return 0
+	}
+	return (float64(promptTokens)*price.Prompt + float64(completionTokens)*price.Completion) / 1000
+}
+
+func (t *Tracker) record(ctx context.Context, record Record) {
+	metrics.ObserveModelCall(record.Kind, record.Model, record.Latency, record.PromptTokens, record.CompletionTokens, record.Error != "")
+	if t == nil || t.Save == nil {
+		return
+	}
+	caller := CallerFrom(ctx)
+	record.User, record.SessionID, record.Persona = caller.User, caller.SessionID, caller.Persona
+	record.Cost = t.Cost(record.Model, record.PromptTokens, record.CompletionTokens)
+	// 请求的 context 可能已经结束（例如客户端断开），保存时不受它影响
+	if err := t.Save(context.WithoutCancel(ctx), record); err != nil {
+		logging.FromContext(ctx).Error("error saving usage", logging.KeyError, err)
+	}
+}
+
+// HTTPClient 返回记录用量的 HTTP 客户端，用于 openai.WithHTTPClient
+func HTTPClient() *http.Client {
+	return &http.Client{Transport: &Transport{}}
+}
+
+// Transport 从 OpenAI 兼容接口的请求和响应中读取模型名与 token 用量，计入指标并交给 Default 记录；
+// 流式响应在读完后记录，时长包含整个流
+type Transport struct {
+	// Base 为空时使用 http.DefaultTransport
+	Base http.RoundTripper
+}
+
+type usagePayload struct {
+	Model string `json:"model"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	kind := requestKind(req)
+	if kind == "" {
+		return base.RoundTrip(req)
+	}
+
+	record := Record{Kind: kind, Model: requestModel(req)}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		record.Latency = time.Since(start)
+		record.Error = err.Error()
+		Default.record(req.Context(), record)
+		return resp, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		record.Latency = time.Since(start)
+		record.Error = resp.Status
+		Default.record(req.Context(), record)
+		return resp, nil
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = &streamBody{ReadCloser: resp.Body, ctx: req.Context(), record: record, start: start}
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	record.Latency = time.Since(start)
+	if err != nil {
+		return resp, err
+	}
+	applyUsage(&record, body)
+	Default.record(req.Context(), record)
+	return resp, nil
+}
+
+func requestKind(req *http.Request) string {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/chat/completions"):
+		return KindLLM
+	case strings.HasSuffix(req.URL.Path, "/embeddings"):
+		return KindEmbedding
+	}
+	return ""
+}
+
+// requestModel 从请求体中读取模型名，并把请求体放回去
+func requestModel(req *http.Request) string {
+	if req.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var payload usagePayload
+	_ = json.Unmarshal(body, &payload)
+	return payload.Model
+}
+
+func applyUsage(record *Record, data []byte) bool {
+	var payload usagePayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Usage == nil {
+		return false
+	}
+	if payload.Model != "" {
+		record.Model = payload.Model
+	}
+	record.PromptTokens = payload.Usage.PromptTokens
+	record.CompletionTokens = payload.Usage.CompletionTokens
+	return true
+}
+
+// streamBody 在转发流式响应的同时查找带 usage 的数据块，读完或关闭时记录一次
+type streamBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	record  Record
+	start   time.Time
+	pending []byte
+	done    bool
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.scan(p[:n])
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *streamBody) scan(chunk []byte) {
+	b.pending = append(b.pending, chunk...)
+	for {
+		// 最后一行可能还没收完整，留到下次
+		i := bytes.IndexByte(b.pending, '\n')
+		if i < 0 {
+			return
+		}
+		line := bytes.TrimRight(b.pending[:i], "\r")
+		if data, ok := bytes.CutPrefix(line, []byte("data: ")); ok && bytes.Contains(data, []byte(`"usage"`)) {
+			applyUsage(&b.record, data)
+		}
+		b.pending = b.pending[i+1:]
+	}
+}
+
+func (b *streamBody) finish() {
+	if b.done {
+		return
+	}
+	b.done = true
+	b.record.Latency = time.Since(b.start)
+	Default.record(b.ctx, b.record)
+}
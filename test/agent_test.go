@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aiagent/pkg/agent"
+	"github.com/aiagent/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestAgentRunPlansExecutesAndReflects(t *testing.T) {
+	registry := tool.NewRegistry()
+	assert.NoError(t, registry.Register(echoTool()), "注册工具应成功")
+
+	llm := &scriptedLLM{choices: []*llms.ContentChoice{
+		{Content: "```json\n[\"查资料\", \"写回答\"]\n```"},
+		toolCallChoice("call_1", "echo", `{"q":"面包"}`),
+		{Content: "找到了天青色小麦粉"},
+		{Content: "写好了"},
+		{Content: `{"done": true, "answer": "天青色面包做好了喵", "note": "目标完成"}`},
+	}}
+
+	var kinds []string
+	answer, trace, err := agent.Run(context.Background(), "做天青色的面包", agent.Options{
+		LLM:      llm,
+		Registry: registry,
+		Allow:    []string{"echo"},
+		OnStep: func(step agent.Step) error {
+			kinds = append(kinds, step.Kind)
+			return nil
+		},
+	})
+
+	assert.NoError(t, err, "智能体应成功完成目标")
+	assert.Equal(t, "天青色面包做好了喵", answer, "应返回反思给出的最终回答")
+	assert.Equal(t, []string{
+		agent.KindPlan,
+		agent.KindToolCall, agent.KindToolResult, agent.KindStep,
+		agent.KindStep,
+		agent.KindReflection, agent.KindFinal,
+	}, kinds, "过程记录的顺序应正确")
+	assert.Len(t, trace, len(kinds), "返回的过程应与推送的一致")
+}
+
+func TestAgentRunRespectsStepBudget(t *testing.T) {
+	llm := &scriptedLLM{choices: []*llms.ContentChoice{
+		{Content: `["一", "二", "三"]`},
+		{Content: "一完成"},
+		{Content: "总结回答"},
+	}}
+
+	answer, trace, err := agent.Run(context.Background(), "目标", agent.Options{
+		LLM:    llm,
+		Budget: agent.Budget{MaxSteps: 1},
+	})
+
+	assert.NoError(t, err, "预算用尽时应正常结束")
+	assert.Equal(t, "总结回答", answer, "预算用尽时应基于已有结果总结")
+	assert.Equal(t, "1. 一", trace[0].Content, "计划应被截断到预算内")
+}
+
+func TestAgentBudgetLower(t *testing.T) {
+	budget := agent.DefaultBudget.Lower(2, 30*time.Second)
+	assert.Equal(t, agent.Budget{MaxSteps: 2, Timeout: 30 * time.Second}, budget, "客户端可以调低预算")
+
+	budget = agent.DefaultBudget.Lower(1000, 24*time.Hour)
+	assert.Equal(t, agent.DefaultBudget, budget, "客户端不能调高预算")
+
+	budget = agent.DefaultBudget.Lower(0, -time.Second)
+	assert.Equal(t, agent.DefaultBudget, budget, "无效值取默认预算")
+}
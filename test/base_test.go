@@ -0,0 +1,20 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSessionIDUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := base.GenerateSessionID()
+		_, err := uuid.Parse(id)
+		assert.NoError(t, err, "会话 ID 应为合法的 UUID")
+		assert.False(t, seen[id], "同一时刻生成的会话 ID 不应重复")
+		seen[id] = true
+	}
+}
@@ -0,0 +1,42 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/aiagent/pkg/cast"
+	"github.com/aiagent/pkg/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func castPersonas() []*sql.CharaPrompt {
+	return []*sql.CharaPrompt{
+		{Name: "主持人", Prompt: "你是主持人"},
+		{Name: "嘉宾", Prompt: "你是嘉宾"},
+	}
+}
+
+func TestCastSpeakers(t *testing.T) {
+	personas := castPersonas()
+	assert.Equal(t, personas, cast.Speakers(personas, cast.TurnRoundRobin, "大家好"), "轮流模式下全部角色依次发言")
+	assert.Equal(t, personas[:1], cast.Speakers(personas, cast.TurnMention, "大家好"), "没人被提到时由主持人发言")
+	assert.Equal(t, []*sql.CharaPrompt{personas[1], personas[0]},
+		cast.Speakers(personas, cast.TurnMention, "嘉宾先说，然后主持人总结"), "应按提到的先后发言")
+}
+
+func TestCastView(t *testing.T) {
+	personas := castPersonas()
+	transcript := []sql.Message{
+		{Role: sql.RoleUser, Speaker: "alice", Content: "你们好"},
+		{Role: sql.RoleAI, Speaker: "主持人", Content: "欢迎"},
+		{Role: sql.RoleAI, Speaker: "嘉宾", Content: "谢谢"},
+		{Role: sql.RoleAI, Speaker: "主持人", Content: "计划", Kind: "plan"},
+	}
+
+	view := cast.View(personas[1], personas, "alice", transcript)
+	assert.Len(t, view, 5, "两条系统提示加三条对话，过程记录不回放")
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeSystem, "你是嘉宾"), view[0], "应使用该角色自己的系统提示")
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeHuman, "alice: 你们好"), view[2])
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeHuman, "主持人: 欢迎"), view[3], "其他角色的话应带上名字")
+	assert.Equal(t, llms.TextParts(llms.ChatMessageTypeAI, "谢谢"), view[4], "自己的话应作为 AI 消息")
+}
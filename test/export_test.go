@@ -0,0 +1,81 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aiagent/pkg/export"
+	"github.com/aiagent/pkg/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func sampleArchive() *export.Archive {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	return &export.Archive{
+		Version:    export.Version,
+		User:       "alice",
+		ExportedAt: created,
+		Sessions: []export.SessionArchive{
+			{
+				ID:        "s1",
+				Title:     "面包",
+				Persona:   "纱露朵",
+				CreatedAt: created,
+				Messages: []sql.Message{
+					{Role: "user", Content: "你好", Timestamp: created.Unix()},
+					{Role: "ai", Content: "计划", Kind: "plan", Timestamp: created.Unix()},
+					{Role: "纱露朵", Content: "你好喵", Timestamp: created.Unix()},
+				},
+			},
+			{ID: "s2", Messages: []sql.Message{{Role: "alice", Content: "只有提问"}}},
+		},
+	}
+}
+
+func TestExportFineTune(t *testing.T) {
+	var buf bytes.Buffer
+	err := export.Write(&buf, sampleArchive(), export.FormatFineTune, func(persona string) string {
+		return "你是" + persona
+	})
+	assert.NoError(t, err, "导出应成功")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 1, "没有助手回复的会话应被跳过")
+
+	var example struct {
+		Messages []struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &example), "每行应是合法 JSON")
+	assert.Len(t, example.Messages, 3, "应包含系统提示和两轮对话，过程记录不导出")
+	assert.Equal(t, "system", example.Messages[0].Role)
+	assert.Equal(t, "你是纱露朵", example.Messages[0].Content)
+	assert.Equal(t, "user", example.Messages[1].Role)
+	assert.Equal(t, "assistant", example.Messages[2].Role)
+}
+
+func TestExportMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, export.Write(&buf, sampleArchive(), export.FormatMarkdown, nil), "导出应成功")
+
+	text := buf.String()
+	assert.Contains(t, text, "## 面包", "应以会话标题作为小标题")
+	assert.Contains(t, text, "**纱露朵**", "助手消息应显示角色名")
+	assert.Contains(t, text, "**alice**", "用户消息应显示用户名")
+	assert.NotContains(t, text, "计划", "过程记录不应导出")
+}
+
+func TestExportRejectsUnknownFormat(t *testing.T) {
+	assert.Error(t, export.Write(&bytes.Buffer{}, sampleArchive(), "xml", nil), "未知格式应返回错误")
+}
+
+func TestImportRejectsUnknownVersion(t *testing.T) {
+	_, err := export.Import(context.Background(), nil, "alice", strings.NewReader(`{"version": 99, "sessions": []}`))
+	assert.Error(t, err, "未知版本应返回错误")
+}
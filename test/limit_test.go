@@ -0,0 +1,84 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/limit"
+	"github.com/aiagent/pkg/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestLimitHelpers(t *testing.T) {
+	bucket := limit.PerMinute(30, 0)
+	assert.Equal(t, 0.5, bucket.Rate)
+	assert.Equal(t, 30, bucket.Burst, "未指定突发上限时取每分钟的次数")
+
+	assert.Equal(t, 42, limit.Tokens(map[string]any{"TotalTokens": 42, "PromptTokens": 30}))
+	assert.Equal(t, 12, limit.Tokens(map[string]any{"PromptTokens": 10, "CompletionTokens": 2}))
+	assert.Equal(t, 0, limit.Tokens(nil))
+
+	// nil 的 Limits 不做任何限制
+	var limits *limit.Limits
+	exceeded, err := limits.Allow(context.Background(), "tester", "127.0.0.1")
+	assert.NoError(t, err)
+	assert.Nil(t, exceeded)
+	llm := &struct{ llms.Model }{}
+	assert.Same(t, llm, limits.Meter(llm, "tester"), "没有配额时不包装模型")
+	limits = &limit.Limits{User: limit.PerMinute(10, 0)}
+	assert.Same(t, llm, limits.Meter(llm, "tester"), "没有每日配额时不包装模型")
+}
+
+func TestLimitsTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	rdb, err := sql.CreateRedisClient(ctx)
+	assert.NoError(t, err)
+	user := "limit-test-" + base.GenerateSessionID()
+	defer rdb.Del(ctx, "ratelimit:user:"+user)
+
+	limits := &limit.Limits{RDB: rdb, User: limit.Bucket{Rate: 1, Burst: 2}}
+	for i := 0; i < 2; i++ {
+		exceeded, err := limits.Allow(ctx, user, "")
+		assert.NoError(t, err)
+		assert.Nil(t, exceeded, "突发上限内的请求应放行")
+	}
+	exceeded, err := limits.Allow(ctx, user, "")
+	assert.NoError(t, err)
+	if assert.NotNil(t, exceeded, "超过突发上限应被拒绝") {
+		assert.Equal(t, limit.ScopeUser, exceeded.Scope)
+		assert.Greater(t, exceeded.RetryAfter, time.Duration(0))
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	exceeded, err = limits.Allow(ctx, user, "")
+	assert.NoError(t, err)
+	assert.Nil(t, exceeded, "令牌补充后应再次放行")
+}
+
+func TestLimitsDailyTokens(t *testing.T) {
+	ctx := context.Background()
+	rdb, err := sql.CreateRedisClient(ctx)
+	assert.NoError(t, err)
+	user := "quota-test-" + base.GenerateSessionID()
+	defer rdb.Del(ctx, "quota:tokens:"+user+":"+time.Now().UTC().Format("2006-01-02"))
+
+	limits := &limit.Limits{RDB: rdb, DailyTokens: 100}
+	assert.NoError(t, limits.AddTokens(ctx, user, 60))
+	exceeded, err := limits.Allow(ctx, user, "")
+	assert.NoError(t, err)
+	assert.Nil(t, exceeded)
+
+	assert.NoError(t, limits.AddTokens(ctx, user, 40))
+	used, err := limits.TokensUsed(ctx, user)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), used)
+	exceeded, err = limits.Allow(ctx, user, "")
+	assert.NoError(t, err)
+	if assert.NotNil(t, exceeded, "用完配额后应被拒绝") {
+		assert.Equal(t, limit.ScopeTokens, exceeded.Scope)
+		assert.LessOrEqual(t, exceeded.RetryAfter, 24*time.Hour)
+	}
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aiagent/pkg/tool"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLocalRegistry(t *testing.T, cfg tool.LocalConfig) *tool.Registry {
+	registry := tool.NewRegistry()
+	assert.NoError(t, tool.RegisterLocalTools(registry, cfg), "注册本地工具应成功")
+	return registry
+}
+
+func TestEvaluate(t *testing.T) {
+	cases := map[string]float64{
+		"1+2*3":            7,
+		"(1+2)*3":          9,
+		"2^3^2":            512,
+		"-3+5":             2,
+		"10 % 4":           2,
+		"sqrt(16)+abs(-2)": 6,
+		"round(pi*100)":    314,
+	}
+	for expr, expected := range cases {
+		value, err := tool.Evaluate(expr)
+		assert.NoError(t, err, "表达式 %s 应能计算", expr)
+		assert.InDelta(t, expected, value, 1e-9, "表达式 %s 的结果应正确", expr)
+	}
+
+	for _, expr := range []string{"", "1/0", "2+", "foo(1)", "(1+2"} {
+		_, err := tool.Evaluate(expr)
+		assert.Error(t, err, "非法表达式 %q 应返回错误", expr)
+	}
+
+	_, err := tool.Evaluate(strings.Repeat("1+", tool.MaxExpressionLength) + "1")
+	assert.Error(t, err, "超长表达式应返回错误")
+	_, err = tool.Evaluate(strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100))
+	assert.Error(t, err, "嵌套过深的括号应返回错误")
+	_, err = tool.Evaluate(strings.Repeat("-", 100) + "1")
+	assert.Error(t, err, "连续过多的负号应返回错误")
+	value, err := tool.Evaluate(strings.Repeat("(", 10) + "1" + strings.Repeat(")", 10))
+	assert.NoError(t, err, "层数不多的嵌套应能计算")
+	assert.Equal(t, 1.0, value)
+}
+
+func TestConvertUnit(t *testing.T) {
+	value, err := tool.ConvertUnit(5, "km", "mi")
+	assert.NoError(t, err, "长度换算应成功")
+	assert.InDelta(t, 3.10686, value, 1e-5, "5 公里约等于 3.107 英里")
+
+	value, err = tool.ConvertUnit(100, "celsius", "fahrenheit")
+	assert.NoError(t, err, "温度换算应成功")
+	assert.InDelta(t, 212, value, 1e-9, "100 摄氏度等于 212 华氏度")
+
+	value, err = tool.ConvertUnit(1, "斤", "g")
+	assert.NoError(t, err, "中文单位换算应成功")
+	assert.InDelta(t, 500, value, 1e-9, "1 斤等于 500 克")
+
+	_, err = tool.ConvertUnit(1, "kg", "m")
+	assert.Error(t, err, "不同类别的单位不能换算")
+
+	value, err = tool.ConvertUnit(1, "MB", "Mb")
+	assert.NoError(t, err, "字节与比特应能换算")
+	assert.InDelta(t, 8, value, 1e-9, "1 MB 等于 8 Mb")
+
+	value, err = tool.ConvertUnit(1, "B", "b")
+	assert.NoError(t, err)
+	assert.InDelta(t, 8, value, 1e-9, "B 是字节、b 是比特")
+
+	value, err = tool.ConvertUnit(2, "KM", "m")
+	assert.NoError(t, err, "不区分大小写的单位仍可用大写")
+	assert.InDelta(t, 2000, value, 1e-9)
+
+	_, err = tool.ConvertUnit(1, "mB", "B")
+	assert.Error(t, err, "mB 不应被当成 MB")
+}
+
+func TestCurrentTimeTool(t *testing.T) {
+	fixed := time.Date(2025, 4, 14, 12, 0, 0, 0, time.UTC)
+	registry := newLocalRegistry(t, tool.LocalConfig{Now: func() time.Time { return fixed }})
+
+	result, err := registry.Call(context.Background(), "current_time", `{"timezone":"Asia/Tokyo"}`, []string{tool.AllowAll})
+	assert.NoError(t, err, "获取时间应成功")
+	assert.Equal(t, "2025-04-14 21:00:00 Monday (Asia/Tokyo)", result, "应返回指定时区的时间")
+
+	_, err = registry.Call(context.Background(), "current_time", `{"timezone":"Mars/Base"}`, []string{tool.AllowAll})
+	assert.Error(t, err, "未知时区应返回错误")
+}
+
+func TestHTTPGetTool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("喵", 100))
+	}))
+	defer server.Close()
+
+	allowed := newLocalRegistry(t, tool.LocalConfig{HTTPAllowlist: []string{"127.0.0.1"}, HTTPMaxBytes: 30})
+	result, err := allowed.Call(context.Background(), "http_get", fmt.Sprintf(`{"url":%q}`, server.URL), []string{"http_get"})
+	assert.NoError(t, err, "白名单内的请求应成功")
+	assert.True(t, strings.HasPrefix(result, "HTTP 200\n"), "应包含状态码")
+	assert.Contains(t, result, "已截断", "超过大小限制的正文应被截断")
+
+	denied := newLocalRegistry(t, tool.LocalConfig{HTTPAllowlist: []string{"example.com"}})
+	_, err = denied.Call(context.Background(), "http_get", fmt.Sprintf(`{"url":%q}`, server.URL), []string{"http_get"})
+	assert.Error(t, err, "白名单以外的主机应被拒绝")
+
+	_, err = denied.Call(context.Background(), "http_get", `{"url":"file:///etc/passwd"}`, []string{"http_get"})
+	assert.Error(t, err, "非 HTTP 协议应被拒绝")
+}
@@ -0,0 +1,72 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aiagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggingNew(t *testing.T) {
+	level, err := logging.ParseLevel("")
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelInfo, level, "未配置时取 info")
+	level, err = logging.ParseLevel("DEBUG")
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+	_, err = logging.ParseLevel("verbose")
+	assert.Error(t, err)
+	_, err = logging.New(&bytes.Buffer{}, "info", "xml")
+	assert.Error(t, err)
+
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "info", logging.FormatJSON)
+	assert.NoError(t, err)
+	logger.Debug("prompt", "messages", "用户说的话")
+	assert.Empty(t, buf.String(), "对话内容只在 debug 级别输出")
+
+	ctx, logger := logging.With(logging.WithLogger(context.Background(), logger), logging.KeyUser, "tester", logging.KeySessionID, "s1")
+	logger.Info("received message")
+	var entry map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "received message", entry["msg"])
+	assert.Equal(t, "tester", entry[logging.KeyUser])
+	assert.Equal(t, "s1", entry[logging.KeySessionID])
+	assert.Same(t, logger, logging.FromContext(ctx))
+
+	assert.Same(t, slog.Default(), logging.FromContext(context.Background()), "没有日志时使用默认日志")
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(&buf, "info", logging.FormatText)
+	assert.NoError(t, err)
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(previous)
+
+	handler := logging.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.FromContext(r.Context()).Info("handled")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+	req.Header.Set(logging.HeaderRequestID, "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", rec.Header().Get(logging.HeaderRequestID), "沿用客户端的请求 ID")
+	assert.Contains(t, buf.String(), "request_id=req-1")
+
+	buf.Reset()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/sessions", nil))
+	requestID := rec.Header().Get(logging.HeaderRequestID)
+	assert.NotEmpty(t, requestID, "没有请求 ID 时由服务端生成")
+	assert.True(t, strings.Contains(buf.String(), "request_id="+requestID))
+}
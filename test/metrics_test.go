@@ -0,0 +1,83 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aiagent/pkg/metrics"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsInstrument(t *testing.T) {
+	route := "/ws/test"
+	var active float64
+	handler := metrics.Instrument(route, func(w http.ResponseWriter, r *http.Request) {
+		active = testutil.ToFloat64(metrics.WSConnections.WithLabelValues(route))
+		metrics.MessageProcessed(r.Context())
+		metrics.MessageProcessed(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, route, nil)
+	req.Header.Set("Upgrade", "websocket")
+	handler(httptest.NewRecorder(), req)
+	assert.Equal(t, 1.0, active, "连接存续期间计入连接数")
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.WSConnections.WithLabelValues(route)), "连接结束后减一")
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.Messages.WithLabelValues(route)))
+
+	// 没有经过 Instrument 的 context 不计
+	metrics.MessageProcessed(context.Background())
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.Messages.WithLabelValues(route)))
+}
+
+func TestMetricsObserve(t *testing.T) {
+	metrics.ObserveModelCall("llm", "test-model", 300*time.Millisecond, 100, 20, false)
+	metrics.ObserveModelCall("llm", "test-model", time.Second, 0, 0, true)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ModelRequests.WithLabelValues("llm", "test-model", "ok")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ModelRequests.WithLabelValues("llm", "test-model", "error")))
+	assert.Equal(t, 100.0, testutil.ToFloat64(metrics.ModelTokens.WithLabelValues("llm", "test-model", "prompt")))
+	assert.Equal(t, 20.0, testutil.ToFloat64(metrics.ModelTokens.WithLabelValues("llm", "test-model", "completion")))
+
+	metrics.ObserveRetrieval("test_documents", []float64{0.2, 0.4, 0.9}, 2)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Retrievals.WithLabelValues("test_documents")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.RetrievalHits.WithLabelValues("test_documents")))
+
+	metrics.ObserveJob("test_job", time.Now(), nil)
+	metrics.ObserveJob("test_job", time.Now(), errors.New("boom"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Jobs.WithLabelValues("test_job", metrics.OutcomeSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Jobs.WithLabelValues("test_job", metrics.OutcomeError)))
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `aiagent_model_request_duration_seconds_count{kind="llm",model="test-model"} 2`)
+	assert.Contains(t, string(body), `aiagent_retrieval_distance_count{table="test_documents"} 3`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
+
+func TestMetricsStoreErrors(t *testing.T) {
+	hook := metrics.RedisHook{}
+	failing := hook.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error { return errors.New("connection refused") })
+	missing := hook.ProcessHook(func(ctx context.Context, cmd redis.Cmder) error { return redis.Nil })
+	cmd := redis.NewStringCmd(context.Background(), "get", "key")
+	assert.Error(t, failing(context.Background(), cmd))
+	assert.ErrorIs(t, missing(context.Background(), cmd), redis.Nil)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.StoreErrors.WithLabelValues(metrics.StoreRedis, "get")), "未命中不算错误")
+
+	tracer := metrics.PGTracer{}
+	before := testutil.ToFloat64(metrics.StoreErrors.WithLabelValues(metrics.StorePostgres, "insert"))
+	ctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "\n\tINSERT INTO llm_usage VALUES ($1)"})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: errors.New("relation does not exist")})
+	ctx = tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: pgx.ErrNoRows})
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.StoreErrors.WithLabelValues(metrics.StorePostgres, "insert")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.StoreErrors.WithLabelValues(metrics.StorePostgres, "select")), "没有结果不算错误")
+}
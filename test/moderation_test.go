@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aiagent/internal/handler"
+	"github.com/aiagent/pkg/moderation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModerationKeywordRedact(t *testing.T) {
+	checker, err := moderation.NewKeywordChecker("abuse", []string{"Stupid"}, []string{`\d{11}`})
+	assert.NoError(t, err)
+
+	var audited []moderation.AuditEntry
+	pipeline := &moderation.Pipeline{
+		Rules: []moderation.Rule{{Checker: checker, Action: moderation.ActionRedact}},
+		Audit: func(ctx context.Context, entry moderation.AuditEntry) error {
+			audited = append(audited, entry)
+			return nil
+		},
+	}
+	result, err := pipeline.Moderate(context.Background(), moderation.StageInput, "tokiya", "s1", "you STUPID cat, call 13800138000")
+	assert.NoError(t, err)
+	assert.Equal(t, moderation.ActionRedact, result.Action)
+	assert.Equal(t, "you *** cat, call ***", result.Text)
+	assert.Len(t, result.Flags, 2)
+	assert.Len(t, audited, 1)
+	assert.Equal(t, "you STUPID cat, call 13800138000", audited[0].Content)
+
+	result, _ = pipeline.Moderate(context.Background(), moderation.StageInput, "tokiya", "s1", "你好喵")
+	assert.Empty(t, result.Action)
+	assert.Equal(t, "你好喵", result.Text)
+	assert.Len(t, audited, 1, "clean text is not audited")
+}
+
+func TestModerationSeverityAndStages(t *testing.T) {
+	warn := &moderation.StubChecker{Flags: []moderation.Flag{{Category: "spam", Match: "buy"}}}
+	block := &moderation.StubChecker{Flags: []moderation.Flag{{Category: "violence"}}}
+	pipeline := &moderation.Pipeline{Rules: []moderation.Rule{
+		{Checker: warn, Action: moderation.ActionWarn},
+		{Checker: block, Action: moderation.ActionRedact, Stages: []string{moderation.StageOutput}},
+	}}
+
+	result, _ := pipeline.Moderate(context.Background(), moderation.StageInput, "u", "", "buy now")
+	assert.Equal(t, moderation.ActionWarn, result.Action)
+	assert.Equal(t, "buy now", result.Text)
+
+	// 分类器类的检查没有命中片段，脱敏时升级为拦截
+	result, _ = pipeline.Moderate(context.Background(), moderation.StageOutput, "u", "", "buy now")
+	assert.True(t, result.Blocked())
+	assert.Empty(t, result.Text)
+
+	assert.True(t, pipeline.HasStage(moderation.StageOutput))
+	var none *moderation.Pipeline
+	assert.False(t, none.HasStage(moderation.StageInput))
+	result, err := none.Moderate(context.Background(), moderation.StageInput, "u", "", "anything")
+	assert.NoError(t, err)
+	assert.Equal(t, "anything", result.Text)
+}
+
+func TestModerationCheckerError(t *testing.T) {
+	pipeline := &moderation.Pipeline{Rules: []moderation.Rule{
+		{Checker: &moderation.StubChecker{Err: errors.New("timeout")}, Action: moderation.ActionBlock},
+	}}
+	result, err := pipeline.Moderate(context.Background(), moderation.StageInput, "u", "", "hello")
+	assert.Error(t, err)
+	assert.False(t, result.Blocked())
+	assert.Equal(t, "hello", result.Text)
+}
+
+func TestModerationConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+keywords:
+  - category: abuse
+    words: [笨蛋]
+    action: redact
+classifier:
+  provider: stub
+  action: block
+  stages: [input]
+`), 0o644))
+	config, err := moderation.LoadConfig(path)
+	assert.NoError(t, err)
+	pipeline, err := moderation.New(config, nil)
+	assert.NoError(t, err)
+	assert.Len(t, pipeline.Rules, 2)
+
+	result, _ := pipeline.Moderate(context.Background(), moderation.StageOutput, "u", "", "你这个笨蛋")
+	assert.Equal(t, "你这个***", result.Text)
+
+	_, err = moderation.New(&moderation.Config{Keywords: []moderation.KeywordConfig{{Category: "x", Action: "delete"}}}, nil)
+	assert.Error(t, err)
+	_, err = moderation.New(&moderation.Config{Classifier: &moderation.ClassifierConfig{Provider: moderation.ProviderLLM, Action: moderation.ActionBlock}}, nil)
+	assert.Error(t, err)
+}
+
+func TestModerationAuditRequiresAdminToken(t *testing.T) {
+	request := func(adminToken string, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/moderation/audit", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ModerationAuditHandler(rec, req, nil, adminToken)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusForbidden, request("", "Bearer "), "没有配置令牌时接口不可用")
+	assert.Equal(t, http.StatusUnauthorized, request("secret", ""), "缺少令牌时拒绝")
+	assert.Equal(t, http.StatusUnauthorized, request("secret", "Bearer wrong"), "令牌错误时拒绝")
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aiagent/internal/handler"
+	"github.com/aiagent/pkg/base"
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/tool"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// fakeUpstream 模拟 OpenAI 的 /chat/completions，按请求是否 stream 返回完整回复或 SSE 块
+func fakeUpstream(t *testing.T, chunks ...string) *openai.LLM {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Stream bool `json:"stream"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if !body.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id":"up","object":"chat.completion","model":"test-model","choices":[{"index":0,"message":{"role":"assistant","content":%q},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":3,"total_tokens":13}}`,
+				strings.Join(chunks, ""))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: {\"id\":\"up\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+
+	llm, err := openai.New(openai.WithToken("test"), openai.WithBaseURL(server.URL), openai.WithModel("test-model"))
+	assert.NoError(t, err)
+	return llm
+}
+
+func completionRequest(t *testing.T, rdb *redis.Client, llm *openai.LLM, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ChatCompletionsHandler(rec, req, rdb, nil, nil, llm, tool.NewRegistry(), nil, nil)
+	return rec
+}
+
+// testChara 创建一个测试用角色，测试结束时删除
+func testChara(t *testing.T) (*redis.Client, string) {
+	return testCharaWith(t, sql.CharaPrompt{Name: "兼容接口测试", Prompt: "你是测试用的猫娘"})
+}
+
+func testCharaWith(t *testing.T, prompt sql.CharaPrompt) (*redis.Client, string) {
+	ctx := context.Background()
+	rdb, err := sql.CreateRedisClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	t.Cleanup(func() { rdb.Close() })
+	chara, err := sql.CreateChara(ctx, rdb, prompt)
+	if err != nil {
+		t.Fatalf("创建角色失败: %v", err)
+	}
+	t.Cleanup(func() { sql.RemoveCharaPrompt(ctx, rdb, chara.ID) })
+	// 检索改为工具模式，测试不需要向量库
+	t.Setenv("RETRIEVAL_MODE", base.RetrievalTool)
+	return rdb, chara.ID
+}
+
+func TestChatCompletionMessageContent(t *testing.T) {
+	var msg handler.ChatCompletionMessage
+	assert.NoError(t, json.Unmarshal([]byte(`{"role":"user","content":"你好"}`), &msg))
+	assert.Equal(t, "你好", msg.Content)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"role":"user","content":[{"type":"text","text":"你好"},{"type":"text","text":"在吗"}]}`), &msg))
+	assert.Equal(t, handler.ChatCompletionMessage{Role: "user", Content: "你好\n在吗"}, msg, "数组形式的文本按换行拼接")
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"role":"assistant","content":null}`), &msg))
+	assert.Empty(t, msg.Content)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}`), &msg), "不支持的内容类型应报错")
+}
+
+func TestChatCompletionsBadBody(t *testing.T) {
+	for _, body := range []string{`{"model":`, `{"model":"x","messages":[]}`, `{"model":"x","messages":[{"role":"user","content":1}]}`} {
+		rec := completionRequest(t, nil, nil, body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+		var resp struct {
+			Error struct {
+				Type string `json:"type"`
+			} `json:"error"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "invalid_request_error", resp.Error.Type)
+	}
+}
+
+func TestChatCompletionsUnknownModel(t *testing.T) {
+	rdb, _ := testChara(t)
+	rec := completionRequest(t, rdb, fakeUpstream(t, "你好喵"), `{"model":"不存在的角色","messages":[{"role":"user","content":"你好"}]}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "model_not_found")
+}
+
+func TestChatCompletionsNonStream(t *testing.T) {
+	rdb, charaID := testChara(t)
+	rec := completionRequest(t, rdb, fakeUpstream(t, "你好喵"),
+		`{"model":"`+charaID+`","messages":[{"role":"user","content":[{"type":"text","text":"你好"}]}]}`)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp handler.ChatCompletionResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "chat.completion", resp.Object)
+	assert.Equal(t, charaID, resp.Model)
+	if assert.Len(t, resp.Choices, 1) {
+		assert.Equal(t, "你好喵", resp.Choices[0].Message.Content)
+		assert.Equal(t, "stop", *resp.Choices[0].FinishReason)
+	}
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	rdb, charaID := testChara(t)
+	content, parts := streamCompletion(t, rdb, charaID)
+	assert.Equal(t, "你好喵", content, "各块拼接后应是完整回复")
+	assert.Equal(t, 2, parts, "没有审核、工具和风格规则时逐块转发")
+}
+
+func TestChatCompletionsStreamWithGuard(t *testing.T) {
+	rdb, charaID := testCharaWith(t, sql.CharaPrompt{
+		Name:   "兼容接口风格测试",
+		Prompt: "你是测试用的猫娘",
+		Guard:  sql.StyleGuard{BannedPhrases: []string{"作为一个AI"}},
+	})
+	content, parts := streamCompletion(t, rdb, charaID)
+	assert.Equal(t, "你好喵", content)
+	assert.Equal(t, 1, parts, "角色有风格规则时先检查完整回复再作为一个块发送")
+}
+
+// streamCompletion 以流式请求角色回复，返回拼接后的内容和非空内容块的个数
+func streamCompletion(t *testing.T, rdb *redis.Client, charaID string) (string, int) {
+	rec := completionRequest(t, rdb, fakeUpstream(t, "你好", "喵"),
+		`{"model":"`+charaID+`","stream":true,"messages":[{"role":"user","content":"你好"}]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+
+	var content strings.Builder
+	var events []string
+	parts := 0
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		events = append(events, data)
+		if data == "[DONE]" {
+			continue
+		}
+		var chunk handler.ChatCompletionResponse
+		assert.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		assert.Equal(t, "chat.completion.chunk", chunk.Object)
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			content.WriteString(delta)
+			parts++
+		}
+	}
+	assert.Equal(t, "[DONE]", events[len(events)-1], "流以 [DONE] 结束")
+	return content.String(), parts
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aiagent/pkg/persona"
+	"github.com/aiagent/pkg/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func samplePersona() *sql.CharaPrompt {
+	temperature := 0.8
+	return &sql.CharaPrompt{
+		Name:             "纱露朵",
+		Prompt:           "你是一个猫娘。",
+		Greeting:         "欢迎回来喵~",
+		GenerateGreeting: true,
+		Examples:         []sql.DialogueExample{{User: "你好", AI: "你好喵 (=^･ω･^=)"}},
+		Style:            []string{"句尾加上“喵”", "多用颜文字"},
+		Params:           sql.ModelParams{Temperature: &temperature, MaxTokens: 512},
+		Tools:            []string{"search_knowledge"},
+	}
+}
+
+func TestPersonaFileRoundTrip(t *testing.T) {
+	for _, format := range []string{persona.FormatYAML, persona.FormatJSON} {
+		var buf bytes.Buffer
+		assert.NoError(t, persona.Encode(&buf, samplePersona(), format))
+
+		decoded, err := persona.Decode(&buf, format)
+		assert.NoError(t, err, format)
+		assert.Equal(t, samplePersona(), decoded, format)
+	}
+}
+
+func TestPersonaDecodeRejectsInvalidFiles(t *testing.T) {
+	_, err := persona.Decode(strings.NewReader("name: 纱露朵\n"), persona.FormatYAML)
+	assert.Error(t, err, "missing prompt")
+
+	_, err = persona.Decode(strings.NewReader("name: 纱露朵\nprompt: hi\ntemprature: 1\n"), persona.FormatYAML)
+	assert.Error(t, err, "unknown field")
+
+	_, err = persona.Decode(strings.NewReader(`{"name": "纱露朵", "prompt": "hi"}`), persona.FormatJSON)
+	assert.NoError(t, err)
+}
+
+func TestPersonaFormatFromName(t *testing.T) {
+	assert.Equal(t, persona.FormatYAML, persona.FormatFromName("shaluduo.yml"))
+	assert.Equal(t, persona.FormatYAML, persona.FormatFromName("application/yaml"))
+	assert.Equal(t, persona.FormatJSON, persona.FormatFromName("shaluduo.json"))
+}
+
+func TestPersonaSystemPrompt(t *testing.T) {
+	assert.Equal(t, "你是一个猫娘。\n\n说话风格：\n- 句尾加上“喵”\n- 多用颜文字\n\n示例对话：\n用户：你好\n纱露朵：你好喵 (=^･ω･^=)",
+		samplePersona().SystemPrompt())
+
+	plain := &sql.CharaPrompt{Name: "a", Prompt: "只有提示词"}
+	assert.Equal(t, "只有提示词", plain.SystemPrompt())
+}
+
+func TestPersonaParamsOverride(t *testing.T) {
+	chara := samplePersona()
+	temperature, seed := 0.2, 42
+	params := persona.Params(chara, &sql.ModelParams{Temperature: &temperature, Seed: &seed, Stop: []string{"\n\n"}})
+	assert.Equal(t, 0.2, *params.Temperature)
+	assert.Equal(t, 512, params.MaxTokens)
+	assert.Equal(t, 42, *params.Seed)
+	assert.Equal(t, 0.8, *chara.Params.Temperature, "override must not modify the persona")
+
+	var opts llms.CallOptions
+	for _, option := range persona.CallOptions(params) {
+		option(&opts)
+	}
+	assert.Equal(t, 0.2, opts.Temperature)
+	assert.Equal(t, 512, opts.MaxTokens)
+	assert.Equal(t, 42, opts.Seed)
+	assert.Equal(t, []string{"\n\n"}, opts.StopWords)
+
+	assert.Empty(t, persona.CallOptions(sql.ModelParams{}))
+	assert.Nil(t, sql.ModelParams{}.Record())
+}
+
+func TestUpdateCharaConcurrentVersions(t *testing.T) {
+	ctx := context.Background()
+	rdb, err := sql.CreateRedisClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer rdb.Close()
+	chara, err := sql.CreateChara(ctx, rdb, *samplePersona())
+	if err != nil {
+		t.Fatalf("创建角色失败: %v", err)
+	}
+	defer sql.RemoveCharaPrompt(ctx, rdb, chara.ID)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sql.UpdateChara(ctx, rdb, chara.ID, *samplePersona())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	versions, err := sql.ListCharaVersions(ctx, rdb, chara.ID)
+	assert.NoError(t, err)
+	seen := map[int]bool{}
+	for _, v := range versions {
+		assert.False(t, seen[v.Version], "版本号 %d 重复", v.Version)
+		seen[v.Version] = true
+	}
+	assert.Len(t, versions, 6, "每次更新都应生成一个版本")
+	current, err := sql.GetCharaByID(ctx, rdb, chara.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, current.Version, "当前内容应是最新的版本")
+}
@@ -0,0 +1,76 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aiagent/pkg/pii"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPIIRedact(t *testing.T) {
+	redactor, err := pii.New([]string{"all"}, "")
+	assert.NoError(t, err)
+
+	cases := map[string]string{
+		"我的邮箱是 tom.lee@example.com 哦":        "我的邮箱是 [EMAIL] 哦",
+		"手机号13812345678，有事打给我":               "手机号[PHONE]，有事打给我",
+		"call me at +86 138 1234 5678":       "call me at [PHONE]",
+		"办公室电话 010-12345678":                 "办公室电话 [PHONE]",
+		"身份证 11010519491231002X 已登记":         "身份证 [ID_CARD] 已登记",
+		"卡号 4111 1111 1111 1111":             "卡号 [BANK_CARD]",
+		"服务器在 192.168.1.10":                  "服务器在 [IP]",
+		"我住在北京市朝阳区建国路88号，欢迎来玩":               "我住在[ADDRESS]，欢迎来玩",
+		"I live at 221 Baker Street, London": "I live at [ADDRESS], London",
+	}
+	for text, expected := range cases {
+		redacted, findings := redactor.Redact(text)
+		assert.Equal(t, expected, redacted, "脱敏结果不符：%s", text)
+		assert.NotEmpty(t, findings)
+	}
+
+	// 校验不通过或者是更长数字的一部分时不算
+	for _, text := range []string{"订单号 110105194912310021", "编号 4111111111111112", "流水号 2013812345678999"} {
+		redacted, findings := redactor.Redact(text)
+		assert.Equal(t, text, redacted, "不应脱敏：%s", text)
+		assert.Empty(t, findings)
+	}
+}
+
+func TestPIIDetectorSelection(t *testing.T) {
+	redactor, err := pii.New([]string{"email"}, "")
+	assert.NoError(t, err)
+	redacted, findings := redactor.Redact("a@b.co 13812345678")
+	assert.Equal(t, "[EMAIL] 13812345678", redacted)
+	assert.Equal(t, []string{pii.DetectorEmail}, pii.Kinds(findings))
+
+	_, err = pii.New([]string{"passport"}, "")
+	assert.Error(t, err, "未知的检测器应报错")
+
+	redactor, err = pii.New(nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, redactor, "没有检测器时不脱敏")
+	redacted, _ = redactor.Redact("a@b.co")
+	assert.Equal(t, "a@b.co", redacted)
+}
+
+func TestPIIVault(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	vault, err := pii.NewVault(key)
+	assert.NoError(t, err)
+
+	sealed, err := vault.Seal("手机号13812345678")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "13812345678")
+	original, err := vault.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "手机号13812345678", original)
+
+	other, err := pii.NewVault(strings.Repeat("cd", 32))
+	assert.NoError(t, err)
+	_, err = other.Open(sealed)
+	assert.Error(t, err, "密钥不同时不能解密")
+
+	_, err = pii.NewVault("short")
+	assert.Error(t, err)
+}
@@ -0,0 +1,31 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/aiagent/pkg/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRole(t *testing.T) {
+	cases := []struct {
+		in   sql.Message
+		want sql.Message
+	}{
+		{sql.Message{Role: "user", Speaker: "tokiya"}, sql.Message{Role: sql.RoleUser, Speaker: "tokiya"}},
+		{sql.Message{Role: "tokiya"}, sql.Message{Role: sql.RoleUser, Speaker: "tokiya"}},
+		{sql.Message{Role: "纱露朵"}, sql.Message{Role: sql.RoleAI, Speaker: "纱露朵"}},
+		{sql.Message{Role: "Ai"}, sql.Message{Role: sql.RoleAI}},
+		{sql.Message{Role: "ai", Kind: "plan"}, sql.Message{Role: sql.RoleAI, Kind: "plan"}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, sql.NormalizeRole(c.in, "tokiya"), "角色 %s 的转换结果不正确", c.in.Role)
+	}
+}
+
+func TestSpeakerName(t *testing.T) {
+	assert.Equal(t, "纱露朵", sql.SpeakerName(sql.Message{Role: sql.RoleAI, Speaker: "纱露朵"}))
+	assert.Equal(t, sql.RoleAI, sql.SpeakerName(sql.Message{Role: sql.RoleAI}), "没有名字时应显示规范角色")
+	assert.True(t, sql.IsUserRole("tokiya", "tokiya"), "旧数据中的用户名应视为用户")
+	assert.False(t, sql.IsUserRole("纱露朵", "tokiya"), "角色名应视为 AI")
+}
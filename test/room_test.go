@@ -0,0 +1,61 @@
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aiagent/pkg/room"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldReply(t *testing.T) {
+	assert.True(t, room.ShouldReply("@纱露朵 你在吗", "纱露朵", nil), "@ 角色时应回复")
+	assert.True(t, room.ShouldReply("快来看 @纱露朵", "纱露朵", nil), "@ 可以在消息中间")
+	assert.False(t, room.ShouldReply("纱露朵今天做面包了吗", "纱露朵", nil), "只提到角色名时不应回复")
+	assert.True(t, room.ShouldReply("有人知道 Bread 吗", "纱露朵", []string{"bread"}), "命中触发词时应回复（不区分大小写）")
+	assert.False(t, room.ShouldReply("今天天气不错", "纱露朵", []string{"面包"}), "无关消息不应回复")
+}
+
+func TestHubBroadcast(t *testing.T) {
+	hub := room.NewHub()
+	var alice, bob []string
+	a := &room.Member{User: "alice", Send: func(data []byte) error { alice = append(alice, string(data)); return nil }}
+	b := &room.Member{User: "bob", Send: func(data []byte) error { bob = append(bob, string(data)); return nil }}
+	broken := &room.Member{User: "carol", Send: func([]byte) error { return errors.New("closed") }}
+	hub.Join("r1", a)
+	hub.Join("r1", b)
+	hub.Join("r1", broken)
+	hub.Join("r2", &room.Member{User: "dave", Send: func([]byte) error { return nil }})
+
+	assert.Equal(t, []string{"alice", "bob", "carol"}, hub.Online("r1"), "应返回排序后的在线用户")
+	failed := hub.Broadcast("r1", []byte("hi"))
+	assert.Equal(t, []string{"hi"}, alice)
+	assert.Equal(t, []string{"hi"}, bob)
+	assert.Equal(t, []*room.Member{broken}, failed, "应返回发送失败的连接")
+
+	hub.Leave("r1", b)
+	hub.Broadcast("r1", []byte("bye"))
+	assert.Equal(t, []string{"hi"}, bob, "离开后不应再收到消息")
+	assert.Equal(t, []string{"hi", "bye"}, alice)
+}
+
+func TestHubLockReplySurvivesEmptyRoom(t *testing.T) {
+	hub := room.NewHub()
+	a := &room.Member{User: "alice", Send: func([]byte) error { return nil }}
+	hub.Join("r1", a)
+	unlock := hub.LockReply("r1")
+
+	// 回复进行中时房间清空再有人加入，新的回复仍要等待同一把锁
+	hub.Leave("r1", a)
+	hub.Join("r1", &room.Member{User: "bob", Send: func([]byte) error { return nil }})
+	acquired := make(chan func())
+	go func() { acquired <- hub.LockReply("r1") }()
+	select {
+	case <-acquired:
+		t.Fatal("上一条回复结束前不应拿到回复锁")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	(<-acquired)()
+}
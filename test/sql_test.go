@@ -2,9 +2,11 @@ package test
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aiagent/pkg/base"
 	"github.com/aiagent/pkg/sql"
 )
 
@@ -47,7 +49,7 @@ func TestSaveChatMessage(t *testing.T) {
 		Timestamp: timestamp,
 	}
 
-	err = sql.SaveChatMessage(ctx, rdb, message, "12345", "test")
+	err = sql.SaveChatMessage(ctx, rdb, nil, message, "12345", "test")
 	if err != nil {
 		t.Fatalf("保存聊天消息失败: %v", err)
 	}
@@ -64,7 +66,7 @@ func TestGetChatMessage(t *testing.T) {
 		t.Fatalf("创建数据库连接失败: %v", err)
 	}
 	defer rdb.Close()
-	messages, err := sql.GetChatMessage(ctx, rdb, "20250414210843", "tokiya")
+	messages, err := sql.GetChatMessage(ctx, rdb, nil, "20250414210843", "tokiya")
 	if err != nil {
 		t.Fatalf("获取聊天消息失败: %v", err)
 	}
@@ -77,3 +79,145 @@ func TestGetChatMessage(t *testing.T) {
 		t.Logf("聊天消息内容: %s", msg)
 	}
 }
+
+func TestEditAndRegenerateBranch(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.CreatePSQLClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer db.Close()
+	rdb, err := sql.CreateRedisClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer rdb.Close()
+	if err := sql.CreateArchiveTable(ctx, db); err != nil {
+		t.Fatalf("创建归档表失败: %v", err)
+	}
+
+	user, sessionID := "branch-test", base.GenerateSessionID()
+	defer sql.DeleteSession(ctx, rdb, db, user, sessionID)
+	for _, msg := range []sql.Message{{Role: "user", Content: "你好"}, {Role: "ai", Content: "你好喵"}} {
+		if err := sql.SaveChatMessage(ctx, rdb, db, msg, sessionID, user); err != nil {
+			t.Fatalf("保存聊天消息失败: %v", err)
+		}
+	}
+	branch, err := sql.GetBranch(ctx, db, user, sessionID)
+	if err != nil || len(branch) != 2 {
+		t.Fatalf("当前分支应有两条消息: %v %v", branch, err)
+	}
+
+	edited, err := sql.EditMessage(ctx, rdb, db, user, sessionID, branch[0].ID, "晚上好")
+	if err != nil {
+		t.Fatalf("编辑消息失败: %v", err)
+	}
+	branch, err = sql.GetBranch(ctx, db, user, sessionID)
+	if err != nil || len(branch) != 1 || branch[0].ID != edited.ID || len(branch[0].Siblings) != 2 {
+		t.Fatalf("编辑后应切换到只有新消息的分支: %v %v", branch, err)
+	}
+	turn, err := sql.RewindReply(ctx, rdb, db, user, sessionID)
+	if err != nil || turn.ID != edited.ID {
+		t.Fatalf("分支停在用户消息上时应直接为它生成回复: %v %v", turn, err)
+	}
+	branch, err = sql.GetBranch(ctx, db, user, sessionID)
+	if err != nil || len(branch) != 1 || branch[0].ID != edited.ID {
+		t.Fatalf("重新生成不应移动分支: %v %v", branch, err)
+	}
+
+	if err := sql.SwitchBranch(ctx, rdb, db, user, sessionID, branch[0].Siblings[0]); err != nil {
+		t.Fatalf("切换分支失败: %v", err)
+	}
+	messages, err := sql.GetArchivedChatMessage(ctx, db, sessionID, user)
+	if err != nil || len(messages) != 2 || messages[1].Content != "你好喵" {
+		t.Fatalf("切回原分支后应包含原来的回复: %v %v", messages, err)
+	}
+	turn, err = sql.RewindReply(ctx, rdb, db, user, sessionID)
+	if err != nil || turn.Content != "你好" {
+		t.Fatalf("重新生成应退回到用户消息: %v %v", turn, err)
+	}
+}
+
+func TestSaveChatMessageAfterCacheExpired(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.CreatePSQLClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer db.Close()
+	rdb, err := sql.CreateRedisClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer rdb.Close()
+	if err := sql.CreateArchiveTable(ctx, db); err != nil {
+		t.Fatalf("创建归档表失败: %v", err)
+	}
+
+	user, sessionID := "cache-test", base.GenerateSessionID()
+	defer sql.DeleteSession(ctx, rdb, db, user, sessionID)
+	for _, msg := range []sql.Message{{Role: "user", Content: "你好"}, {Role: "ai", Content: "你好喵"}} {
+		if err := sql.SaveChatMessage(ctx, rdb, db, msg, sessionID, user); err != nil {
+			t.Fatalf("保存聊天消息失败: %v", err)
+		}
+	}
+
+	// 模拟缓存过期后再保存一条消息
+	if err := rdb.Del(ctx, "chat:"+user+":"+sessionID).Err(); err != nil {
+		t.Fatalf("删除缓存失败: %v", err)
+	}
+	if err := sql.SaveChatMessage(ctx, rdb, db, sql.Message{Role: "user", Content: "还在吗"}, sessionID, user); err != nil {
+		t.Fatalf("保存聊天消息失败: %v", err)
+	}
+
+	messages, err := sql.GetChatMessage(ctx, rdb, db, sessionID, user)
+	if err != nil || len(messages) != 3 {
+		t.Fatalf("缓存过期后应从归档读取完整历史: %v %v", messages, err)
+	}
+}
+
+func TestArchiveLegacySessionOnce(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.CreatePSQLClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer db.Close()
+	rdb, err := sql.CreateRedisClient(ctx)
+	if err != nil {
+		t.Fatalf("创建数据库连接失败: %v", err)
+	}
+	defer rdb.Close()
+	if err := sql.CreateArchiveTable(ctx, db); err != nil {
+		t.Fatalf("创建归档表失败: %v", err)
+	}
+
+	// 只存在于 Redis 中的旧会话
+	user, sessionID := "legacy-test", base.GenerateSessionID()
+	defer sql.DeleteSession(ctx, rdb, db, user, sessionID)
+	for _, msg := range []sql.Message{{Role: user, Content: "你好"}, {Role: "纱露朵", Content: "你好喵"}} {
+		if err := sql.SaveChatMessage(ctx, rdb, nil, msg, sessionID, user); err != nil {
+			t.Fatalf("保存聊天消息失败: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sql.ArchiveLegacySession(ctx, rdb, db, user, sessionID); err != nil {
+				t.Errorf("同步旧会话失败: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages, err := sql.GetArchivedChatMessage(ctx, db, sessionID, user)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("并发同步时消息不应重复: %v %v", messages, err)
+	}
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aiagent/pkg/sql"
+	"github.com/aiagent/pkg/style"
+	"github.com/stretchr/testify/assert"
+)
+
+func rules(violations []style.Violation) []string {
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+	return names
+}
+
+func TestStyleCheck(t *testing.T) {
+	guard := sql.StyleGuard{
+		BannedPhrases:   []string{"我不确定"},
+		RequiredMarkers: []string{"喵"},
+		MaxLength:       20,
+		Language:        "zh",
+	}
+	assert.Empty(t, style.Check(guard, "今天也要加油喵~"))
+	assert.Equal(t, []string{style.RuleBannedPhrase, style.RuleMissingMarker},
+		rules(style.Check(guard, "我不确定这个问题的答案。")))
+	assert.Equal(t, []string{style.RuleMaxLength},
+		rules(style.Check(guard, "喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵喵")))
+	assert.Equal(t, []string{style.RuleLanguage},
+		rules(style.Check(guard, "喵 how are you today")))
+}
+
+func TestStyleKaomoji(t *testing.T) {
+	assert.True(t, style.HasKaomoji("你好喵 (=^･ω･^=)"))
+	assert.True(t, style.HasKaomoji("好耶（≧▽≦）"))
+	assert.False(t, style.HasKaomoji("你好（小麦粉）"))
+	assert.Equal(t, []string{style.RuleKaomoji},
+		rules(style.Check(sql.StyleGuard{RequireKaomoji: true}, "你好喵")))
+}
+
+func TestStyleEnforce(t *testing.T) {
+	guard := sql.StyleGuard{BannedPhrases: []string{"我需要更多信息"}}
+
+	calls := 0
+	result, err := style.Enforce(guard, "我需要更多信息。", func(feedback string) (string, error) {
+		calls++
+		assert.Contains(t, feedback, "我需要更多信息")
+		return "告诉我更多细节吧喵~", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.True(t, result.Regenerated)
+	assert.Equal(t, "告诉我更多细节吧喵~", result.Content)
+	assert.Len(t, result.Violations, 1)
+	assert.Empty(t, result.Remaining)
+
+	// 只重新生成一次，仍然违规时保留第二次的回复
+	result, _ = style.Enforce(guard, "我需要更多信息。", func(string) (string, error) {
+		return "我需要更多信息喵", nil
+	})
+	assert.Len(t, result.Remaining, 1)
+
+	// 重新生成失败时保留原回复
+	result, err = style.Enforce(guard, "我需要更多信息。", func(string) (string, error) {
+		return "", errors.New("upstream error")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "我需要更多信息。", result.Content)
+
+	result, _ = style.Enforce(sql.StyleGuard{}, "随便说说", func(string) (string, error) {
+		t.Fatal("regenerate must not be called without rules")
+		return "", nil
+	})
+	assert.Equal(t, "随便说说", result.Content)
+}
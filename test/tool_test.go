@@ -0,0 +1,113 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aiagent/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// scriptedLLM 按顺序返回预设的回答，用于在不访问网络的情况下测试工具循环
+type scriptedLLM struct {
+	choices []*llms.ContentChoice
+	calls   [][]llms.MessageContent
+}
+
+func (s *scriptedLLM) GenerateContent(_ context.Context, messages []llms.MessageContent, _ ...llms.CallOption) (*llms.ContentResponse, error) {
+	s.calls = append(s.calls, messages)
+	choice := s.choices[0]
+	s.choices = s.choices[1:]
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+}
+
+func (s *scriptedLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, s, prompt, options...)
+}
+
+func echoTool() tool.Tool {
+	return tool.Tool{
+		Name:        "echo",
+		Description: "原样返回参数",
+		Handler: func(ctx context.Context, args string) (string, error) {
+			return args, nil
+		},
+	}
+}
+
+func toolCallChoice(id string, name string, args string) *llms.ContentChoice {
+	return &llms.ContentChoice{ToolCalls: []llms.ToolCall{{
+		ID:           id,
+		Type:         "function",
+		FunctionCall: &llms.FunctionCall{Name: name, Arguments: args},
+	}}}
+}
+
+func TestRegistryAllowlist(t *testing.T) {
+	registry := tool.NewRegistry()
+	assert.NoError(t, registry.Register(echoTool()), "注册工具应成功")
+	assert.Error(t, registry.Register(echoTool()), "重复注册应失败")
+
+	assert.Empty(t, registry.Definitions(nil), "空白名单不应暴露任何工具")
+	assert.Len(t, registry.Definitions([]string{"echo"}), 1, "白名单内的工具应被暴露")
+	assert.Len(t, registry.Definitions([]string{tool.AllowAll}), 1, "* 应暴露全部工具")
+	assert.Empty(t, registry.Definitions([]string{tool.AllowAll, tool.Except + "echo"}), "* 不应包含被排除的工具")
+	assert.Len(t, registry.Definitions([]string{"echo", tool.Except + "echo"}), 1, "明确列出的工具不受排除影响")
+
+	_, err := registry.Call(context.Background(), "echo", "{}", []string{"other"})
+	assert.Error(t, err, "不在白名单内的工具不应被执行")
+}
+
+func TestRunExecutesToolCalls(t *testing.T) {
+	registry := tool.NewRegistry()
+	assert.NoError(t, registry.Register(echoTool()), "注册工具应成功")
+
+	llm := &scriptedLLM{choices: []*llms.ContentChoice{
+		toolCallChoice("call_1", "echo", `{"text":"喵"}`),
+		{Content: "完成喵"},
+	}}
+
+	var events []tool.Event
+	result, added, err := tool.Run(context.Background(), llm, registry,
+		[]llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "你好")},
+		[]string{"echo"}, tool.DefaultMaxSteps, func(e tool.Event) error {
+			events = append(events, e)
+			return nil
+		})
+
+	assert.NoError(t, err, "工具循环应成功")
+	assert.Equal(t, "完成喵", result.Content, "应返回模型的最终回答")
+	assert.Len(t, added, 2, "应追加工具调用与工具结果两条消息")
+	assert.Len(t, llm.calls, 2, "模型应被调用两次")
+	assert.Equal(t, []tool.Event{
+		{Type: tool.EventToolCall, ID: "call_1", Name: "echo", Arguments: `{"text":"喵"}`},
+		{Type: tool.EventToolResult, ID: "call_1", Name: "echo", Content: `{"text":"喵"}`},
+	}, events, "应依次推送调用与结果事件")
+}
+
+func TestRunStopsAtMaxSteps(t *testing.T) {
+	registry := tool.NewRegistry()
+	assert.NoError(t, registry.Register(echoTool()), "注册工具应成功")
+
+	llm := &scriptedLLM{choices: []*llms.ContentChoice{
+		toolCallChoice("call_1", "echo", "{}"),
+		toolCallChoice("call_2", "echo", "{}"),
+	}}
+	_, _, err := tool.Run(context.Background(), llm, registry, nil, []string{"echo"}, 1, nil)
+	assert.Error(t, err, "超过最大步数时应返回错误")
+}
+
+func TestUserContext(t *testing.T) {
+	ctx := tool.WithUser(context.Background(), "alice")
+	assert.Equal(t, "alice", tool.UserFromContext(ctx), "应能取回放入的用户")
+	assert.Empty(t, tool.UserFromContext(context.Background()), "没有用户时应返回空字符串")
+}
+
+func TestSearchHistoryRequiresUser(t *testing.T) {
+	registry := tool.NewRegistry()
+	assert.NoError(t, tool.RegisterHistoryTools(registry, nil, nil), "注册工具应成功")
+
+	_, err := registry.Call(context.Background(), "search_history", `{"query":"面包"}`, []string{"search_history"})
+	assert.Error(t, err, "没有用户时不应检索")
+}
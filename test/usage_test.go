@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aiagent/internal/handler"
+	"github.com/aiagent/pkg/usage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsagePrices(t *testing.T) {
+	prices, err := usage.ParsePrices("gpt-4o-mini:0.15:0.6, text-embedding-3-small:0.02")
+	assert.NoError(t, err)
+	assert.Equal(t, usage.Price{Prompt: 0.15, Completion: 0.6}, prices["gpt-4o-mini"])
+	assert.Equal(t, usage.Price{Prompt: 0.02}, prices["text-embedding-3-small"], "向量化模型可以省略输出价格")
+
+	_, err = usage.ParsePrices("gpt-4o-mini")
+	assert.Error(t, err)
+	_, err = usage.ParsePrices("gpt-4o-mini:abc")
+	assert.Error(t, err)
+
+	tracker := &usage.Tracker{Prices: prices}
+	assert.InDelta(t, 0.075, tracker.Cost("gpt-4o-mini", 100, 100), 0.0000001)
+	assert.Equal(t, 0.0, tracker.Cost("unknown", 1000, 1000), "没有价格的模型费用为 0")
+}
+
+func TestUsageDayRange(t *testing.T) {
+	now := time.Date(2024, 5, 10, 15, 0, 0, 0, time.UTC)
+	from, to, err := usage.DayRange("", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2024, 5, 11, 0, 0, 0, 0, time.UTC), to, "结束日期包含在内")
+
+	from, to, err = usage.DayRange("2024-05-01", "2024-05-01", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, to.Sub(from))
+
+	_, _, err = usage.DayRange("2024-05-02", "2024-05-01", now)
+	assert.Error(t, err)
+	_, _, err = usage.DayRange("05/01", "", now)
+	assert.Error(t, err)
+}
+
+func TestUsageTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/chat/completions":
+			body, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(body), `"stream":true`) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = io.WriteString(w, "data: {\"model\":\"gpt-4o-mini\",\"choices\":[{\"delta\":{\"content\":\"你好\"}}]}\n\n")
+				_, _ = io.WriteString(w, "data: {\"model\":\"gpt-4o-mini\",\"choices\":[],\"usage\":{\"prompt_tokens\":20,\"completion_tokens\":5}}\n\n")
+				_, _ = io.WriteString(w, "data: [DONE]\n\n")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"model":"gpt-4o-mini","usage":{"prompt_tokens":100,"completion_tokens":50}}`)
+		case "/v1/embeddings":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var records []usage.Record
+	prices, err := usage.ParsePrices("gpt-4o-mini:1:2")
+	assert.NoError(t, err)
+	previous := usage.Default
+	usage.Default = &usage.Tracker{
+		Prices: prices,
+		Save: func(ctx context.Context, record usage.Record) error {
+			records = append(records, record)
+			return nil
+		},
+	}
+	defer func() { usage.Default = previous }()
+
+	client := usage.HTTPClient()
+	ctx := usage.WithCaller(context.Background(), usage.Caller{User: "tester", SessionID: "s1", Persona: "alice"})
+	post := func(path string, body string) string {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	// 非流式：响应体原样交给调用方
+	reply := post("/v1/chat/completions", `{"model":"gpt-4o-mini","messages":[]}`)
+	assert.Contains(t, reply, `"prompt_tokens":100`)
+	// 流式：读完后记录最后一块中的用量
+	reply = post("/v1/chat/completions", `{"model":"gpt-4o-mini","stream":true,"messages":[]}`)
+	assert.Contains(t, reply, "[DONE]")
+	// 失败的调用也记录
+	post("/v1/embeddings", `{"model":"text-embedding-3-small","input":["x"]}`)
+	// 其他接口不记录
+	post("/v1/models", `{}`)
+
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, usage.KindLLM, records[0].Kind)
+		assert.Equal(t, "tester", records[0].User)
+		assert.Equal(t, "s1", records[0].SessionID)
+		assert.Equal(t, "alice", records[0].Persona)
+		assert.Equal(t, 100, records[0].PromptTokens)
+		assert.Equal(t, 50, records[0].CompletionTokens)
+		assert.InDelta(t, 0.2, records[0].Cost, 0.0000001)
+
+		assert.Equal(t, 20, records[1].PromptTokens)
+		assert.Equal(t, 5, records[1].CompletionTokens)
+		assert.Empty(t, records[1].Error)
+
+		assert.Equal(t, usage.KindEmbedding, records[2].Kind)
+		assert.Equal(t, "text-embedding-3-small", records[2].Model)
+		assert.Contains(t, records[2].Error, "429")
+	}
+}
+
+func TestUsageReportRequiresAdminToken(t *testing.T) {
+	request := func(adminToken string, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/usage/report", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.UsageReportHandler(rec, req, nil, adminToken)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusForbidden, request("", "Bearer "), "没有配置令牌时接口不可用")
+	assert.Equal(t, http.StatusUnauthorized, request("secret", ""), "缺少令牌时拒绝")
+	assert.Equal(t, http.StatusUnauthorized, request("secret", "Bearer wrong"), "令牌错误时拒绝")
+}